@@ -2,17 +2,24 @@ package blockchain
 
 import (
 	"encoding/hex"
-	"log"
+	"fmt"
 
-	"go.etcd.io/bbolt"
+	"gambim.com/blockchain/storage"
 )
 
 var (
 	utxoBucket = []byte("utxo")
 )
 
+type UnspentOutput struct {
+	TransactionID []byte
+	OutputIndex   int
+	Output        TxOutput
+}
+
 type UTXOSet struct {
-	Chain *Blockchain
+	Chain   *Blockchain
+	Exclude func(transactionId []byte, outputIndex int) bool
 }
 
 func NewUTXOSet(chain *Blockchain) *UTXOSet {
@@ -21,96 +28,144 @@ func NewUTXOSet(chain *Blockchain) *UTXOSet {
 	}
 }
 
-func (u *UTXOSet) Update(block *Block) {
-	err := u.Chain.Database.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket(utxoBucket)
-		if bucket == nil {
-			return bbolt.ErrBucketNotFound
-		}
-		for _, transaction := range block.Transactions {
-			if transaction.IsCoinBase() == false {
-				for _, input := range transaction.Inputs {
-					updatedOuts := TxOutputs{}
-					item := bucket.Get(input.ID)
-					if item == nil {
-						log.Panic("Output doesn't exist")
-					}
-					outputs := DeserializeOutputs(item)
-					for outputIndex, output := range outputs.Outputs {
-						if outputIndex != input.OutputIndex {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, output)
-						}
+func (u *UTXOSet) Update(block *Block) error {
+	return u.Chain.Database.Update(func(tx storage.Tx) error {
+		return updateUTXO(tx, block)
+	})
+}
+
+func updateUTXO(tx storage.Tx, block *Block) error {
+	bucket := tx.Bucket(utxoBucket)
+	if bucket == nil {
+		return storage.ErrBucketNotFound
+	}
+	undo := &BlockUndo{}
+	for _, transaction := range block.Transactions {
+		if transaction.IsCoinBase() == false {
+			for _, input := range transaction.Inputs {
+				updatedOuts := TxOutputs{}
+				item := bucket.Get(input.ID)
+				if item == nil {
+					return fmt.Errorf("output %x:%d: %w", input.ID, input.OutputIndex, ErrMissingInput)
+				}
+				outputs, err := DeserializeOutputs(item)
+				if err != nil {
+					return err
+				}
+				spent, ok := outputs.Find(input.OutputIndex)
+				if !ok {
+					return fmt.Errorf("output %x:%d: %w", input.ID, input.OutputIndex, ErrMissingInput)
+				}
+				undo.Spent = append(undo.Spent, SpentOutput{TransactionID: input.ID, OutputIndex: input.OutputIndex, Output: spent})
+				for position, output := range outputs.Outputs {
+					if outputs.Index(position) != input.OutputIndex {
+						updatedOuts.Add(outputs.Index(position), output)
 					}
-					err := bucket.Delete(input.ID)
-					if err != nil {
+				}
+				err = bucket.Delete(input.ID)
+				if err != nil {
+					return err
+				}
+				if len(updatedOuts.Outputs) != 0 {
+					if err = bucket.Put(input.ID, updatedOuts.Serialize()); err != nil {
 						return err
 					}
-					if len(updatedOuts.Outputs) != 0 {
-						if err = bucket.Put(input.ID, updatedOuts.Serialize()); err != nil {
-							return err
-						}
-					}
 				}
 			}
-			newOutputs := TxOutputs{}
-			for _, output := range transaction.Outputs {
-				newOutputs.Outputs = append(newOutputs.Outputs, output)
-			}
+		}
+		newOutputs := TxOutputs{}
+		for outputIndex, output := range transaction.Outputs {
+			newOutputs.Add(outputIndex, output)
+		}
 
-			if err := bucket.Put(transaction.ID, newOutputs.Serialize()); err != nil {
+		if err := bucket.Put(transaction.ID, newOutputs.Serialize()); err != nil {
+			return err
+		}
+	}
+
+	return putBlockUndo(tx, block.Hash, undo)
+}
+
+func rebuildUTXO(tx storage.Tx, tipHash []byte) error {
+	var blocks []*Block
+
+	for hash := tipHash; len(hash) != 0; {
+		block, err := getBlock(tx, hash)
+		if err != nil {
+			return err
+		}
+		blocks = append(blocks, block)
+		hash = block.PrevHash
+	}
+
+	for _, bucketName := range [][]byte{utxoBucket, undoBucket} {
+		if tx.Bucket(bucketName) != nil {
+			if err := tx.DeleteBucket(bucketName); err != nil {
 				return err
 			}
 		}
+	}
+	if _, err := tx.CreateBucket(utxoBucket); err != nil {
+		return err
+	}
 
-		return nil
-	})
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if err := updateUTXO(tx, blocks[i]); err != nil {
+			return err
+		}
+	}
 
-	Handle(err)
+	return nil
 }
 
-func (u *UTXOSet) CountTransactions() int {
+func (u *UTXOSet) CountTransactions() (int, error) {
 	counter := 0
-	err := u.Chain.Database.View(func(tx *bbolt.Tx) error {
+	err := u.Chain.Database.View(func(tx storage.Tx) error {
 		bucket := tx.Bucket(utxoBucket)
 		if bucket == nil {
-			return bbolt.ErrBucketNotFound
+			return storage.ErrBucketNotFound
 		}
 
-		bucket.ForEach(func(key []byte, value []byte) error {
+		return bucket.ForEach(func(key []byte, value []byte) error {
 			counter++
 			return nil
 		})
-		return nil
 	})
-	Handle(err)
 
-	return counter
+	return counter, err
 }
 
-func (u *UTXOSet) Reindex() {
-	u.DeleteAll()
-	unspentOutputs := u.Chain.FindUnspentTransactionOutputs()
-
-	err := u.Chain.Database.Update(func(tx *bbolt.Tx) error {
-		bucket, err := tx.CreateBucket(utxoBucket)
-		if err != nil {
-			return err
+func (u *UTXOSet) TotalValue() (int, error) {
+	total := 0
+	err := u.Chain.Database.View(func(tx storage.Tx) error {
+		bucket := tx.Bucket(utxoBucket)
+		if bucket == nil {
+			return storage.ErrBucketNotFound
 		}
-		for transactionId, outputs := range unspentOutputs {
-			key, err := hex.DecodeString(transactionId)
+
+		return bucket.ForEach(func(key []byte, item []byte) error {
+			txOutputs, err := DeserializeOutputs(item)
 			if err != nil {
 				return err
 			}
-			bucket.Put(key, outputs.Serialize())
-		}
+			for _, output := range txOutputs.Outputs {
+				total += output.Value
+			}
+			return nil
+		})
+	})
+
+	return total, err
+}
 
-		return nil
+func (u *UTXOSet) Reindex() error {
+	return u.Chain.Database.Update(func(tx storage.Tx) error {
+		return rebuildUTXO(tx, u.Chain.LastHash)
 	})
-	Handle(err)
 }
 
-func (u *UTXOSet) DeleteAll() {
-	err := u.Chain.Database.Update(func(tx *bbolt.Tx) error {
+func (u *UTXOSet) DeleteAll() error {
+	return u.Chain.Database.Update(func(tx storage.Tx) error {
 		bucket := tx.Bucket(utxoBucket)
 		if bucket != nil {
 			return tx.DeleteBucket(utxoBucket)
@@ -118,20 +173,22 @@ func (u *UTXOSet) DeleteAll() {
 			return nil
 		}
 	})
-	Handle(err)
 }
 
-func (u *UTXOSet) FindUnspentTransactionOutputs(publicHashKey []byte) []TxOutput {
+func (u *UTXOSet) FindUnspentTransactionOutputs(publicHashKey []byte) ([]TxOutput, error) {
 	var unspentTransactionOutputs []TxOutput
 
-	err := u.Chain.Database.View(func(tx *bbolt.Tx) error {
+	err := u.Chain.Database.View(func(tx storage.Tx) error {
 		bucket := tx.Bucket(utxoBucket)
 		if bucket == nil {
-			return bbolt.ErrBucketNotFound
+			return storage.ErrBucketNotFound
 		}
 
-		bucket.ForEach(func(key []byte, item []byte) error {
-			txOutputs := DeserializeOutputs(item)
+		return bucket.ForEach(func(key []byte, item []byte) error {
+			txOutputs, err := DeserializeOutputs(item)
+			if err != nil {
+				return err
+			}
 			for _, output := range txOutputs.Outputs {
 				if output.IsLockedWithKey(publicHashKey) {
 					unspentTransactionOutputs = append(unspentTransactionOutputs, output)
@@ -139,29 +196,63 @@ func (u *UTXOSet) FindUnspentTransactionOutputs(publicHashKey []byte) []TxOutput
 			}
 			return nil
 		})
-		return nil
 	})
-	Handle(err)
 
-	return unspentTransactionOutputs
+	return unspentTransactionOutputs, err
 }
 
-func (u *UTXOSet) FindSpendableOutputs(publicHashKey []byte, amount int) (int, map[string][]int) {
+func (u *UTXOSet) FindUnspentOutputs(publicHashKey []byte) ([]UnspentOutput, error) {
+	var unspentOutputs []UnspentOutput
+
+	err := u.Chain.Database.View(func(tx storage.Tx) error {
+		bucket := tx.Bucket(utxoBucket)
+		if bucket == nil {
+			return storage.ErrBucketNotFound
+		}
+
+		return bucket.ForEach(func(key []byte, item []byte) error {
+			txOutputs, err := DeserializeOutputs(item)
+			if err != nil {
+				return err
+			}
+			for position, output := range txOutputs.Outputs {
+				if output.IsLockedWithKey(publicHashKey) {
+					unspentOutputs = append(unspentOutputs, UnspentOutput{
+						TransactionID: append([]byte{}, key...),
+						OutputIndex:   txOutputs.Index(position),
+						Output:        output,
+					})
+				}
+			}
+			return nil
+		})
+	})
+
+	return unspentOutputs, err
+}
+
+func (u *UTXOSet) FindSpendableOutputs(publicHashKey []byte, amount int) (int, map[string][]int, error) {
 	unspentOutputs := make(map[string][]int)
 	accumulated := 0
 
-	err := u.Chain.Database.View(func(tx *bbolt.Tx) error {
+	err := u.Chain.Database.View(func(tx storage.Tx) error {
 		bucket := tx.Bucket(utxoBucket)
 		if bucket == nil {
-			return bbolt.ErrBucketNotFound
+			return storage.ErrBucketNotFound
 		}
 
-		bucket.ForEach(func(key []byte, item []byte) error {
-			txOutputs := DeserializeOutputs(item)
-			for outputIndex, output := range txOutputs.Outputs {
+		return bucket.ForEach(func(key []byte, item []byte) error {
+			txOutputs, err := DeserializeOutputs(item)
+			if err != nil {
+				return err
+			}
+			for position, output := range txOutputs.Outputs {
+				if u.Exclude != nil && u.Exclude(key, txOutputs.Index(position)) {
+					continue
+				}
 				if output.IsLockedWithKey(publicHashKey) && accumulated < amount {
 					accumulated += output.Value
-					unspentOutputs[hex.EncodeToString(key)] = append(unspentOutputs[hex.EncodeToString(key)], outputIndex)
+					unspentOutputs[hex.EncodeToString(key)] = append(unspentOutputs[hex.EncodeToString(key)], txOutputs.Index(position))
 
 					if accumulated >= amount {
 						return nil
@@ -170,9 +261,7 @@ func (u *UTXOSet) FindSpendableOutputs(publicHashKey []byte, amount int) (int, m
 			}
 			return nil
 		})
-		return nil
 	})
-	Handle(err)
 
-	return accumulated, unspentOutputs
+	return accumulated, unspentOutputs, err
 }
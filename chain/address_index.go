@@ -0,0 +1,247 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+
+	"gambim.com/blockchain/storage"
+	"gambim.com/blockchain/wallet"
+)
+
+var (
+	addressIndexBucket = []byte("address index")
+)
+
+type AddressEntry struct {
+	TransactionID  []byte
+	BlockHash      []byte
+	Height         int
+	Received       int
+	Sent           int
+	Coinbase       bool
+	Counterparties [][]byte
+	Balance        int
+}
+
+func (entry *AddressEntry) Serialize() []byte {
+	return encode(entry)
+}
+
+func DeserializeAddressEntry(data []byte) (*AddressEntry, error) {
+	var entry AddressEntry
+
+	if err := decode(data, &entry); err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+func addressKey(publicKeyHash []byte, height int, position int) []byte {
+	key := append([]byte{}, publicKeyHash...)
+	key = append(key, ToHex(int64(height))...)
+	return append(key, ToHex(int64(position))...)
+}
+
+func addHash(hashes [][]byte, hash []byte) [][]byte {
+	for _, existing := range hashes {
+		if bytes.Equal(existing, hash) {
+			return hashes
+		}
+	}
+	return append(hashes, hash)
+}
+
+// addressEntries groups the effect of each transaction in a block by address.
+// spent holds the outputs consumed by the block's inputs, in input order.
+func addressEntries(block *Block, spent []TxOutput) map[string]*AddressEntry {
+	entries := make(map[string]*AddressEntry)
+	entry := func(publicKeyHash []byte, position int) *AddressEntry {
+		key := string(addressKey(publicKeyHash, block.Height, position))
+		if entries[key] == nil {
+			entries[key] = &AddressEntry{TransactionID: block.Transactions[position].ID, BlockHash: block.Hash, Height: block.Height}
+		}
+		return entries[key]
+	}
+
+	for position, transaction := range block.Transactions {
+		var senders [][]byte
+		var recipients [][]byte
+
+		if !transaction.IsCoinBase() {
+			for range transaction.Inputs {
+				output := spent[0]
+				spent = spent[1:]
+				entry(output.PublicKeyHash, position).Sent += output.Value
+				senders = addHash(senders, output.PublicKeyHash)
+			}
+		}
+		for _, output := range transaction.Outputs {
+			received := entry(output.PublicKeyHash, position)
+			received.Received += output.Value
+			received.Coinbase = transaction.IsCoinBase()
+			recipients = addHash(recipients, output.PublicKeyHash)
+		}
+
+		for _, sender := range senders {
+			current := entry(sender, position)
+			for _, recipient := range recipients {
+				if !bytes.Equal(recipient, sender) {
+					current.Counterparties = addHash(current.Counterparties, recipient)
+				}
+			}
+		}
+		for _, recipient := range recipients {
+			current := entry(recipient, position)
+			for _, sender := range senders {
+				if !bytes.Equal(recipient, sender) {
+					current.Counterparties = addHash(current.Counterparties, sender)
+				}
+			}
+		}
+	}
+
+	return entries
+}
+
+func indexAddresses(tx storage.Tx, block *Block, spent []TxOutput) error {
+	bucket, err := tx.CreateBucketIfNotExists(addressIndexBucket)
+	if err != nil {
+		return err
+	}
+
+	for key, entry := range addressEntries(block, spent) {
+		if err := bucket.Put([]byte(key), entry.Serialize()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func unindexAddresses(tx storage.Tx, block *Block) error {
+	bucket := tx.Bucket(addressIndexBucket)
+	if bucket == nil {
+		return nil
+	}
+
+	for position, transaction := range block.Transactions {
+		for _, output := range transaction.Outputs {
+			if err := bucket.Delete(addressKey(output.PublicKeyHash, block.Height, position)); err != nil {
+				return err
+			}
+		}
+		if transaction.IsCoinBase() {
+			continue
+		}
+		for _, input := range transaction.Inputs {
+			publicKeyHash := wallet.PublicKeyHash(input.PublicKey)
+			if err := bucket.Delete(addressKey(publicKeyHash, block.Height, position)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func spentOutputs(undo *BlockUndo) []TxOutput {
+	var outputs []TxOutput
+	for _, spent := range undo.Spent {
+		outputs = append(outputs, spent.Output)
+	}
+	return outputs
+}
+
+func buildAddressIndex(tx storage.Tx, tipHash []byte) error {
+	var blocks []*Block
+
+	for hash := tipHash; len(hash) != 0; {
+		block, err := getBlock(tx, hash)
+		if err != nil {
+			return err
+		}
+		blocks = append(blocks, block)
+		hash = block.PrevHash
+	}
+
+	if tx.Bucket(addressIndexBucket) != nil {
+		if err := tx.DeleteBucket(addressIndexBucket); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.CreateBucket(addressIndexBucket); err != nil {
+		return err
+	}
+
+	created := make(map[string]TxOutputs)
+	for i := len(blocks) - 1; i >= 0; i-- {
+		var spent []TxOutput
+		for _, transaction := range blocks[i].Transactions {
+			if !transaction.IsCoinBase() {
+				for _, input := range transaction.Inputs {
+					output, ok := created[hex.EncodeToString(input.ID)].Find(input.OutputIndex)
+					if !ok {
+						return ErrMissingInput
+					}
+					spent = append(spent, output)
+				}
+			}
+			outputs := TxOutputs{}
+			for outputIndex, output := range transaction.Outputs {
+				outputs.Add(outputIndex, output)
+			}
+			created[hex.EncodeToString(transaction.ID)] = outputs
+		}
+
+		if err := indexAddresses(tx, blocks[i], spent); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AddressHistory returns the transactions touching publicKeyHash, newest
+// first, skipping offset entries and returning at most limit (0 means all).
+// Balance holds the running balance after each transaction.
+func (chain *Blockchain) AddressHistory(publicKeyHash []byte, offset int, limit int) ([]AddressEntry, int, error) {
+	var entries []AddressEntry
+
+	err := chain.Database.View(func(tx storage.Tx) error {
+		bucket := tx.Bucket(addressIndexBucket)
+		if bucket == nil {
+			return storage.ErrBucketNotFound
+		}
+
+		balance := 0
+		cursor := bucket.Cursor()
+		for key, item := cursor.Seek(publicKeyHash); key != nil && len(key) == len(publicKeyHash)+16 && bytes.HasPrefix(key, publicKeyHash); key, item = cursor.Next() {
+			entry, err := DeserializeAddressEntry(item)
+			if err != nil {
+				return err
+			}
+			balance += entry.Received - entry.Sent
+			entry.Balance = balance
+			entries = append(entries, *entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total := len(entries)
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if offset > len(entries) {
+		offset = len(entries)
+	}
+	entries = entries[offset:]
+	if limit > 0 && limit < len(entries) {
+		entries = entries[:limit]
+	}
+
+	return entries, total, nil
+}
@@ -2,73 +2,126 @@ package blockchain
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"context"
 	"encoding/gob"
-	"log"
+	"errors"
+	"fmt"
+	"time"
 )
 
+const BlockVersion = 1
+
+var ErrBadEncoding = errors.New("stored data can not be decoded")
+
+type BlockHeader struct {
+	Version    int
+	Height     int
+	Timestamp  int64
+	Bits       int
+	MerkleRoot []byte
+	PrevHash   []byte
+	Nounce     int
+}
+
 type Block struct {
-	Hash         []byte
+	Hash []byte
+	BlockHeader
 	Transactions []*Transaction
-	PrevHash     []byte
-	Nounce       int
 }
 
-func CreateBlock(transactions []*Transaction, prevHash []byte) *Block {
+func NewBlock(transactions []*Transaction, prevHash []byte, height int, bits int) *Block {
 	newBlock := &Block{
-		PrevHash:     prevHash,
+		BlockHeader: BlockHeader{
+			Version:   BlockVersion,
+			Height:    height,
+			Timestamp: time.Now().Unix(),
+			Bits:      bits,
+			PrevHash:  prevHash,
+		},
 		Transactions: transactions,
 	}
+	newBlock.MerkleRoot = newBlock.HashTransactions()
+
+	return newBlock
+}
+
+func CreateBlock(transactions []*Transaction, prevHash []byte, height int, bits int) (*Block, error) {
+	newBlock := NewBlock(transactions, prevHash, height, bits)
+
 	proofOfWork := NewProof(newBlock)
-	nounce, hash := proofOfWork.Run()
+	nounce, hash, err := proofOfWork.Run(context.Background())
+	if err != nil {
+		return nil, err
+	}
 
 	newBlock.Hash = hash[:]
 	newBlock.Nounce = nounce
 
-	return newBlock
+	return newBlock, nil
 }
 
-func Genesis(coinbase *Transaction) *Block {
-	return CreateBlock([]*Transaction{coinbase}, []byte{})
+func Genesis(coinbase *Transaction, bits int) (*Block, error) {
+	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0, bits)
 }
 
 func (block *Block) HashTransactions() []byte {
 	var txHashes [][]byte
-	var txHash [32]byte
 
 	for _, transaction := range block.Transactions {
 		txHashes = append(txHashes, transaction.ID)
 	}
-	txHash = sha256.Sum256(bytes.Join(txHashes, []byte{}))
+	tree := NewMerkleTree(txHashes)
 
-	return txHash[:]
+	return tree.Root()
 }
 
 func (block *Block) Serialize() []byte {
-	var res bytes.Buffer
-	encoder := gob.NewEncoder(&res)
+	return encode(block)
+}
 
-	err := encoder.Encode(block)
+func Deserialize(data []byte) (*Block, error) {
+	var block Block
 
-	Handle(err)
+	if err := decode(data, &block); err != nil {
+		return nil, err
+	}
 
-	return res.Bytes()
+	return &block, nil
 }
 
-func Deserialize(data []byte) *Block {
-	var block Block
+func (header *BlockHeader) Serialize() []byte {
+	return encode(header)
+}
 
-	decoder := gob.NewDecoder(bytes.NewReader(data))
+func DeserializeHeader(data []byte) (*BlockHeader, error) {
+	var header BlockHeader
+
+	if err := decode(data, &header); err != nil {
+		return nil, err
+	}
+
+	return &header, nil
+}
 
-	err := decoder.Decode(&block)
+// encode is only used on this package's own types, which gob can always
+// encode, so an error here is a programming mistake rather than bad input.
+func encode(value interface{}) []byte {
+	var res bytes.Buffer
+	encoder := gob.NewEncoder(&res)
 
-	Handle(err)
+	if err := encoder.Encode(value); err != nil {
+		panic(err)
+	}
 
-	return &block
+	return res.Bytes()
 }
 
-func Handle(err error) {
-	if err != nil {
-		log.Panic(err)
+func decode(data []byte, value interface{}) error {
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+
+	if err := decoder.Decode(value); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadEncoding, err)
 	}
+
+	return nil
 }
@@ -0,0 +1,336 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+
+	"gambim.com/blockchain/storage"
+)
+
+const (
+	BlockStatusValid = iota
+	BlockStatusInvalid
+)
+
+var (
+	blockIndexBucket = []byte("block index")
+
+	ErrBlockExists   = errors.New("block already exists")
+	ErrOrphanBlock   = errors.New("parent block is unknown")
+	ErrInvalidParent = errors.New("parent block is invalid")
+)
+
+type BlockIndex struct {
+	Height    int
+	ChainWork []byte
+	Status    int
+}
+
+func (index *BlockIndex) Work() *big.Int {
+	return new(big.Int).SetBytes(index.ChainWork)
+}
+
+func (index *BlockIndex) Serialize() []byte {
+	return encode(index)
+}
+
+func DeserializeBlockIndex(data []byte) (*BlockIndex, error) {
+	var index BlockIndex
+
+	if err := decode(data, &index); err != nil {
+		return nil, err
+	}
+
+	return &index, nil
+}
+
+func (chain *Blockchain) GetBlockIndex(hash []byte) (*BlockIndex, error) {
+	var index *BlockIndex
+
+	err := chain.Database.View(func(tx storage.Tx) error {
+		var err error
+		index, err = getBlockIndex(tx, hash)
+		return err
+	})
+
+	return index, err
+}
+
+func getBlockIndex(tx storage.Tx, hash []byte) (*BlockIndex, error) {
+	bucket := tx.Bucket(blockIndexBucket)
+	if bucket == nil {
+		return nil, storage.ErrBucketNotFound
+	}
+
+	item := bucket.Get(hash)
+	if item == nil {
+		return nil, errors.New("Block index is not found")
+	}
+
+	return DeserializeBlockIndex(item)
+}
+
+func putBlockIndex(tx storage.Tx, hash []byte, index *BlockIndex) error {
+	bucket, err := tx.CreateBucketIfNotExists(blockIndexBucket)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(hash, index.Serialize())
+}
+
+func buildBlockIndex(tx storage.Tx, tipHash []byte) error {
+	var hashes [][]byte
+	var headers []BlockHeader
+
+	hash := tipHash
+	for len(hash) != 0 {
+		header, err := getBlockHeader(tx, hash)
+		if err != nil {
+			block, blockErr := getBlock(tx, hash)
+			if blockErr != nil {
+				return blockErr
+			}
+			header = block.BlockHeader
+		}
+		hashes = append(hashes, hash)
+		headers = append(headers, header)
+		hash = header.PrevHash
+	}
+
+	chainWork := new(big.Int)
+	for i := len(hashes) - 1; i >= 0; i-- {
+		chainWork.Add(chainWork, headers[i].Work())
+		index := &BlockIndex{Height: headers[i].Height, ChainWork: chainWork.Bytes(), Status: BlockStatusValid}
+		if err := putBlockIndex(tx, hashes[i], index); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func findFork(tx storage.Tx, first []byte, second []byte) ([]byte, error) {
+	firstHeader, err := getBlockHeader(tx, first)
+	if err != nil {
+		return nil, err
+	}
+	secondHeader, err := getBlockHeader(tx, second)
+	if err != nil {
+		return nil, err
+	}
+
+	for !bytes.Equal(first, second) {
+		if firstHeader.Height >= secondHeader.Height {
+			first = firstHeader.PrevHash
+			if firstHeader, err = getBlockHeader(tx, first); err != nil {
+				return nil, err
+			}
+		} else {
+			second = secondHeader.PrevHash
+			if secondHeader, err = getBlockHeader(tx, second); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return first, nil
+}
+
+func branchHashes(tx storage.Tx, tip []byte, fork []byte) ([][]byte, error) {
+	var hashes [][]byte
+
+	hash := tip
+	for !bytes.Equal(hash, fork) {
+		header, err := getBlockHeader(tx, hash)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+		hash = header.PrevHash
+	}
+
+	for i, j := 0, len(hashes)-1; i < j; i, j = i+1, j-1 {
+		hashes[i], hashes[j] = hashes[j], hashes[i]
+	}
+
+	return hashes, nil
+}
+
+// markInvalid marks a block and every block built on it invalid.
+func markInvalid(tx storage.Tx, hash []byte) error {
+	invalidIndex, err := getBlockIndex(tx, hash)
+	if err != nil {
+		return err
+	}
+
+	children := make(map[string][][]byte)
+	err = tx.Bucket(blockIndexBucket).ForEach(func(key []byte, item []byte) error {
+		index, err := DeserializeBlockIndex(item)
+		if err != nil {
+			return err
+		}
+		if index.Height <= invalidIndex.Height {
+			return nil
+		}
+
+		header, err := getBlockHeader(tx, key)
+		if err != nil {
+			return err
+		}
+		children[string(header.PrevHash)] = append(children[string(header.PrevHash)], append([]byte{}, key...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	pending := [][]byte{hash}
+	for len(pending) > 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		index, err := getBlockIndex(tx, current)
+		if err != nil {
+			return err
+		}
+		if index.Status != BlockStatusInvalid {
+			index.Status = BlockStatusInvalid
+			if err = putBlockIndex(tx, current, index); err != nil {
+				return err
+			}
+		}
+		pending = append(pending, children[string(current)]...)
+	}
+
+	return nil
+}
+
+// bestValidTip returns the stored block with the most work that is not
+// known to be invalid.
+func bestValidTip(tx storage.Tx) ([]byte, *BlockIndex, error) {
+	var best []byte
+	var bestIndex *BlockIndex
+
+	err := tx.Bucket(blockIndexBucket).ForEach(func(key []byte, item []byte) error {
+		index, err := DeserializeBlockIndex(item)
+		if err != nil {
+			return err
+		}
+		if index.Status == BlockStatusInvalid {
+			return nil
+		}
+		if bestIndex == nil || index.Work().Cmp(bestIndex.Work()) > 0 {
+			best, bestIndex = append([]byte{}, key...), index
+		}
+		return nil
+	})
+
+	return best, bestIndex, err
+}
+
+func (chain *Blockchain) connectBlocks(tx storage.Tx, hashes [][]byte) (connected int, err error) {
+	for i, hash := range hashes {
+		block, err := getBlock(tx, hash)
+		if err != nil {
+			return i, err
+		}
+		if err = chain.connectBlock(tx, block); err != nil {
+			return i, err
+		}
+	}
+
+	return len(hashes), nil
+}
+
+// ForkBranches returns the blocks that moving the tip from oldTip to newTip
+// disconnects and connects, oldest first.
+func (chain *Blockchain) ForkBranches(oldTip []byte, newTip []byte) (disconnected []*Block, connected []*Block, err error) {
+	err = chain.Database.View(func(tx storage.Tx) error {
+		fork, err := findFork(tx, oldTip, newTip)
+		if err != nil {
+			return err
+		}
+		if disconnected, err = branchBlocks(tx, oldTip, fork); err != nil {
+			return err
+		}
+		connected, err = branchBlocks(tx, newTip, fork)
+		return err
+	})
+
+	return disconnected, connected, err
+}
+
+func branchBlocks(tx storage.Tx, tip []byte, fork []byte) ([]*Block, error) {
+	hashes, err := branchHashes(tx, tip, fork)
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks []*Block
+	for _, hash := range hashes {
+		block, err := getBlock(tx, hash)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+
+	return blocks, nil
+}
+
+func (chain *Blockchain) reorganize(tx storage.Tx, oldTip []byte, newTip []byte) (tip []byte, invalid error, err error) {
+	fork, err := findFork(tx, oldTip, newTip)
+	if err != nil {
+		return nil, nil, err
+	}
+	oldBranch, err := branchHashes(tx, oldTip, fork)
+	if err != nil {
+		return nil, nil, err
+	}
+	newBranch, err := branchHashes(tx, newTip, fork)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err = disconnectBlocks(tx, oldBranch); err != nil {
+		return nil, nil, err
+	}
+
+	connected, invalid := chain.connectBlocks(tx, newBranch)
+	if invalid == nil {
+		return newTip, nil, nil
+	}
+	if !IsConsensusError(invalid) {
+		return nil, nil, invalid
+	}
+	if err = markInvalid(tx, newBranch[connected]); err != nil {
+		return nil, nil, err
+	}
+
+	tip = fork
+	if connected > 0 {
+		tip = newBranch[connected-1]
+	}
+	tipIndex, err := getBlockIndex(tx, tip)
+	if err != nil {
+		return nil, nil, err
+	}
+	oldIndex, err := getBlockIndex(tx, oldTip)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tipIndex.Work().Cmp(oldIndex.Work()) > 0 {
+		return tip, invalid, nil
+	}
+
+	if _, err = disconnectBlocks(tx, newBranch[:connected]); err != nil {
+		return nil, nil, err
+	}
+	if _, err = chain.connectBlocks(tx, oldBranch); err != nil {
+		return nil, nil, err
+	}
+
+	return oldTip, invalid, nil
+}
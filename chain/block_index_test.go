@@ -0,0 +1,125 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"gambim.com/blockchain/wallet"
+)
+
+// addTestBranch mines and adds count blocks on prevHash, each holding only
+// its coinbase.
+func addTestBranch(t *testing.T, chain *Blockchain, wlt *wallet.Wallet, prevHash []byte, count int, name string) []*Block {
+	t.Helper()
+
+	var blocks []*Block
+	for i := 0; i < count; i++ {
+		prevHeader, err := chain.GetBlockHeader(prevHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		coinbase := newTestCoinbase(t, chain, wlt, prevHeader.Height+1, 0, fmt.Sprintf("%s %d", name, i))
+		block := newTestBlock(t, chain, prevHash, coinbase)
+		if err = chain.AddBlock(block); err != nil {
+			t.Fatalf("adding %s block %d: %v", name, i, err)
+		}
+		blocks = append(blocks, block)
+		prevHash = block.Hash
+	}
+
+	return blocks
+}
+
+func balance(t *testing.T, chain *Blockchain, wlt *wallet.Wallet) int {
+	t.Helper()
+
+	outputs, err := NewUTXOSet(chain).FindUnspentTransactionOutputs(wallet.PublicKeyHash(wlt.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, output := range outputs {
+		total += output.Value
+	}
+
+	return total
+}
+
+func TestHeavierBranchWins(t *testing.T) {
+	chain, wlt := newTestChain(t)
+	genesis := chain.LastHash
+	recipient, err := wallet.MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first branch pays the recipient, which the second undoes.
+	first := addTestBranch(t, chain, wlt, genesis, 1, "first")
+	payment, err := NewTransaction(wlt, testAddress(recipient), 10, 1, NewUTXOSet(chain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := newTestBlock(t, chain, chain.LastHash, newTestCoinbase(t, chain, wlt, 2, 1, "first 1"), payment)
+	if err = chain.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	first = append(first, block)
+	if got := balance(t, chain, recipient); got != 10 {
+		t.Fatalf("recipient has %d before the reorg, want 10", got)
+	}
+
+	// As much work as the first branch does not replace it.
+	second := addTestBranch(t, chain, wlt, genesis, 2, "second")
+	if !bytes.Equal(chain.LastHash, first[1].Hash) {
+		t.Fatalf("tip moved to a branch with the same work")
+	}
+
+	second = append(second, addTestBranch(t, chain, wlt, second[1].Hash, 1, "second more")...)
+	if !bytes.Equal(chain.LastHash, second[2].Hash) {
+		t.Fatalf("tip is %x, want the heavier branch %x", chain.LastHash, second[2].Hash)
+	}
+	if height, err := chain.GetBestHeight(); err != nil || height != 3 {
+		t.Errorf("best height is %d, %v, want 3", height, err)
+	}
+	if got := balance(t, chain, recipient); got != 0 {
+		t.Errorf("recipient has %d after the reorg, want 0", got)
+	}
+	if err = chain.ValidateFrom(context.Background(), 0); err != nil {
+		t.Errorf("UTXO set after the reorg differs from a rebuild: %v", err)
+	}
+}
+
+func TestInvalidHeavierBranchKeepsTip(t *testing.T) {
+	chain, wlt := newTestChain(t)
+	genesis := chain.LastHash
+	first := addTestBranch(t, chain, wlt, genesis, 2, "first")
+	second := addTestBranch(t, chain, wlt, genesis, 2, "second")
+
+	// Its coinbase pays one more than the subsidy.
+	invalid := newTestBlock(t, chain, second[1].Hash, newTestCoinbase(t, chain, wlt, 3, 1, "invalid"))
+	if err := chain.AddBlock(invalid); !errors.Is(err, ErrBadCoinbase) {
+		t.Fatalf("AddBlock() = %v, want %v", err, ErrBadCoinbase)
+	}
+	if !bytes.Equal(chain.LastHash, first[1].Hash) {
+		t.Errorf("tip is %x, want the old tip %x", chain.LastHash, first[1].Hash)
+	}
+	index, err := chain.GetBlockIndex(invalid.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.Status != BlockStatusInvalid {
+		t.Errorf("invalid block has status %v", index.Status)
+	}
+	if err = chain.ValidateFrom(context.Background(), 0); err != nil {
+		t.Errorf("UTXO set after the failed reorg differs from a rebuild: %v", err)
+	}
+
+	// Blocks built on the invalid one are rejected too.
+	child := newTestBlock(t, chain, invalid.Hash, newTestCoinbase(t, chain, wlt, 4, 0, "child"))
+	if err = chain.AddBlock(child); !errors.Is(err, ErrInvalidParent) {
+		t.Errorf("AddBlock() of a child of an invalid block = %v, want %v", err, ErrInvalidParent)
+	}
+}
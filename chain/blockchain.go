@@ -2,100 +2,254 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"math/big"
 	"os"
-	"runtime"
+	"path/filepath"
 
-	"go.etcd.io/bbolt"
+	"gambim.com/blockchain/params"
+	"gambim.com/blockchain/storage"
 )
 
 const (
-	genesisData = "First Transaction from Genesis"
-	dbPath      = "tmp/blocks"
-	dbName      = "my.db"
+	dbPath = "blocks"
+	dbName = "my.db"
+)
+
+var (
+	blocksBucket  = []byte("blockchain bucket")
+	headersBucket = []byte("headers")
+	lastHashKey   = []byte("last hash")
+	networkKey    = []byte("network")
+
+	ErrChainExists   = errors.New("blockchain already exists")
+	ErrChainNotFound = errors.New("blockchain does not exist")
 )
 
 type Blockchain struct {
 	LastHash []byte
-	Database *bbolt.DB
+	Database storage.Store
+	Params   *params.Params
 }
 
-func DBExists() bool {
-	_, err := os.Stat(fmt.Sprintf("%s/%s", dbPath, dbName))
+func DBFile(dataDir string) string {
+	return filepath.Join(dataDir, dbPath, dbName)
+}
+
+func DBExists(dataDir string) bool {
+	_, err := os.Stat(DBFile(dataDir))
 	return !os.IsNotExist(err)
 }
 
-func InitBlockchain(address string) *Blockchain {
-	var lastHash []byte = nil
+func InitBlockchain(dataDir string, chainParams *params.Params, address string) (*Blockchain, error) {
+	if DBExists(dataDir) {
+		return nil, ErrChainExists
+	}
 
-	if DBExists() {
-		fmt.Println("Blockchain already exists")
-		runtime.Goexit()
+	store, err := storage.OpenBolt(DBFile(dataDir))
+	if err != nil {
+		return nil, err
 	}
 
-	db, err := bbolt.Open(fmt.Sprintf("%s/%s", dbPath, dbName), 0600, nil)
-	Handle(err)
+	chain, err := CreateBlockchain(store, chainParams, address)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
 
-	err = db.Update(func(tx *bbolt.Tx) error {
+	return chain, nil
+}
 
-		bucket, err := tx.CreateBucket([]byte("blockchain bucket"))
-		Handle(err)
+func ContinueBlockchain(dataDir string, chainParams *params.Params) (*Blockchain, error) {
+	if !DBExists(dataDir) {
+		return nil, ErrChainNotFound
+	}
 
-		transaction := CoinBaseTx(address, genesisData)
-		genesis := Genesis(transaction)
-		err = bucket.Put(genesis.Hash, genesis.Serialize())
-		Handle(err)
+	store, err := storage.OpenBolt(DBFile(dataDir))
+	if err != nil {
+		return nil, err
+	}
 
-		err = bucket.Put([]byte("last hash"), genesis.Hash)
-		lastHash = genesis.Hash
+	chain, err := LoadBlockchain(store, chainParams)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
 
-		return err
-	})
+	return chain, nil
+}
 
-	Handle(err)
+// InitBlockchainWithGenesis creates a chain in dataDir starting from a genesis
+// block obtained elsewhere, typically from a peer.
+func InitBlockchainWithGenesis(dataDir string, chainParams *params.Params, genesis *Block) (*Blockchain, error) {
+	if DBExists(dataDir) {
+		return nil, ErrChainExists
+	}
 
-	return &Blockchain{
-		LastHash: lastHash,
-		Database: db,
+	store, err := storage.OpenBolt(DBFile(dataDir))
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := CreateBlockchainWithGenesis(store, chainParams, genesis)
+	if err != nil {
+		store.Close()
+		return nil, err
 	}
+
+	return chain, nil
 }
 
-func ContinueBlockchain(address string) *Blockchain {
-	var lastHash []byte = nil
+func CreateBlockchain(store storage.Store, chainParams *params.Params, address string) (*Blockchain, error) {
+	transaction, err := CoinBaseTx(address, chainParams.AddressVersion, chainParams.GenesisMessage, NewMonetaryPolicy(chainParams).SubsidyAtHeight(0))
+	if err != nil {
+		return nil, err
+	}
+	genesis, err := Genesis(transaction, chainParams.InitialDifficulty)
+	if err != nil {
+		return nil, err
+	}
+
+	return CreateBlockchainWithGenesis(store, chainParams, genesis)
+}
 
-	if !DBExists() {
-		fmt.Println("Blockchain not exists")
-		runtime.Goexit()
+func CreateBlockchainWithGenesis(store storage.Store, chainParams *params.Params, genesis *Block) (*Blockchain, error) {
+	if err := checkBlockHeader(genesis, nil, nil, chainParams.InitialDifficulty); err != nil {
+		return nil, err
+	}
+	if err := checkCoinbase(genesis.Transactions, 0, 0, NewMonetaryPolicy(chainParams)); err != nil {
+		return nil, err
+	}
+	if len(genesis.Transactions) != 1 {
+		return nil, ErrBadCoinbase
+	}
+	if !bytes.Equal(genesis.Transactions[0].Hash(), genesis.Transactions[0].ID) {
+		return nil, ErrBadTransactionID
 	}
 
-	db, err := bbolt.Open(fmt.Sprintf("%s/%s", dbPath, dbName), 0600, nil)
-	Handle(err)
+	var lastHash []byte
 
-	err = db.View(func(tx *bbolt.Tx) error {
+	err := store.Update(func(tx storage.Tx) error {
+		bucket, err := tx.CreateBucket(blocksBucket)
+		if errors.Is(err, storage.ErrBucketExists) {
+			return ErrChainExists
+		}
+		if err != nil {
+			return err
+		}
+		headers, err := tx.CreateBucket(headersBucket)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.CreateBucketIfNotExists(utxoBucket); err != nil {
+			return err
+		}
 
-		bucket := tx.Bucket([]byte("blockchain bucket"))
-		lastHash = bucket.Get([]byte("last hash"))
+		if err = bucket.Put(genesis.Hash, genesis.Serialize()); err != nil {
+			return err
+		}
+		if err = headers.Put(genesis.Hash, genesis.BlockHeader.Serialize()); err != nil {
+			return err
+		}
+		if err = putBlockIndex(tx, genesis.Hash, &BlockIndex{Height: 0, ChainWork: genesis.Work().Bytes(), Status: BlockStatusValid}); err != nil {
+			return err
+		}
+		if err = updateUTXO(tx, genesis); err != nil {
+			return err
+		}
+		if err = putHeight(tx, 0, genesis.Hash); err != nil {
+			return err
+		}
+		if err = indexAddresses(tx, genesis, nil); err != nil {
+			return err
+		}
 
-		return err
+		if err = bucket.Put(networkKey, []byte(chainParams.Name)); err != nil {
+			return err
+		}
+		lastHash = genesis.Hash
+		return bucket.Put(lastHashKey, genesis.Hash)
 	})
-	Handle(err)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Blockchain{
 		LastHash: lastHash,
-		Database: db,
+		Database: store,
+		Params:   chainParams,
+	}, nil
+}
+
+func LoadBlockchain(store storage.Store, chainParams *params.Params) (*Blockchain, error) {
+	var lastHash []byte
+
+	err := store.Update(func(tx storage.Tx) error {
+		bucket := tx.Bucket(blocksBucket)
+		if bucket == nil {
+			return ErrChainNotFound
+		}
+		if network := bucket.Get(networkKey); network != nil && string(network) != chainParams.Name {
+			return fmt.Errorf("database belongs to %s, not %s", network, chainParams.Name)
+		}
+		lastHash = append([]byte{}, bucket.Get(lastHashKey)...)
+
+		if tx.Bucket(blockIndexBucket) == nil {
+			if err := buildBlockIndex(tx, lastHash); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(heightIndexBucket) == nil {
+			if err := buildHeightIndex(tx, lastHash); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(addressIndexBucket) == nil {
+			return buildAddressIndex(tx, lastHash)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+
+	return &Blockchain{
+		LastHash: lastHash,
+		Database: store,
+		Params:   chainParams,
+	}, nil
+}
+
+func (chain *Blockchain) MonetaryPolicy() MonetaryPolicy {
+	return NewMonetaryPolicy(chain.Params)
 }
 
-func (chain *Blockchain) FindUnspentTransactionOutputs() map[string]TxOutputs {
+func (chain *Blockchain) FindUnspentTransactionOutputs() (map[string]TxOutputs, error) {
+	var unspentTransactionOutputs map[string]TxOutputs
+
+	err := chain.Database.View(func(tx storage.Tx) error {
+		var err error
+		unspentTransactionOutputs, err = findUnspentTransactionOutputs(tx, chain.LastHash)
+		return err
+	})
+
+	return unspentTransactionOutputs, err
+}
+
+func findUnspentTransactionOutputs(tx storage.Tx, tipHash []byte) (map[string]TxOutputs, error) {
 	unspentTransactionOutputs := make(map[string]TxOutputs)
 	spentTransactions := make(map[string][]int)
 
-	iterator := chain.Iterator()
-	for len(iterator.IteratorHash) != 0 {
-		block := iterator.Next()
+	hash := tipHash
+	for len(hash) != 0 {
+		block, err := getBlock(tx, hash)
+		if err != nil {
+			return nil, err
+		}
 
 		for _, transaction := range block.Transactions {
 			transactionId := hex.EncodeToString(transaction.ID)
@@ -110,7 +264,7 @@ func (chain *Blockchain) FindUnspentTransactionOutputs() map[string]TxOutputs {
 					}
 				}
 				outputs := unspentTransactionOutputs[transactionId]
-				outputs.Outputs = append(outputs.Outputs, output)
+				outputs.Add(outputIndex, output)
 				unspentTransactionOutputs[transactionId] = outputs
 
 			}
@@ -121,35 +275,268 @@ func (chain *Blockchain) FindUnspentTransactionOutputs() map[string]TxOutputs {
 				}
 			}
 		}
+		hash = block.PrevHash
 	}
-	return unspentTransactionOutputs
+	return unspentTransactionOutputs, nil
 }
 
-func (chain *Blockchain) AddBlock(transactions []*Transaction) *Block {
-	var err error
-	newBlock := CreateBlock(transactions, chain.LastHash)
+func (chain *Blockchain) PrepareBlock(transactions []*Transaction) (*Block, error) {
+	lastHeader, err := chain.GetBlockHeader(chain.LastHash)
+	if err != nil {
+		return nil, err
+	}
+	bits, err := chain.NextDifficulty(lastHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	fees, err := chain.validateTransactions(transactions)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkCoinbase(transactions, lastHeader.Height+1, fees, chain.MonetaryPolicy()); err != nil {
+		return nil, err
+	}
+
+	return NewBlock(transactions, chain.LastHash, lastHeader.Height+1, bits), nil
+}
+
+func (chain *Blockchain) MineBlock(ctx context.Context, transactions []*Transaction) (*Block, error) {
+	newBlock, err := chain.PrepareBlock(transactions)
+	if err != nil {
+		return nil, err
+	}
 
-	err = chain.Database.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte("blockchain bucket"))
+	proofOfWork := NewProof(newBlock)
+	nounce, hash, err := proofOfWork.Run(ctx)
+	if err != nil {
+		return nil, err
+	}
+	newBlock.Hash = hash
+	newBlock.Nounce = nounce
+
+	if err = chain.AddBlock(newBlock); err != nil {
+		return nil, err
+	}
+
+	return newBlock, nil
+}
+
+func (chain *Blockchain) AddBlock(newBlock *Block) error {
+	var newTip []byte
+	var reorgErr error
+
+	err := chain.Database.Update(func(tx storage.Tx) error {
+		bucket := tx.Bucket(blocksBucket)
 		if bucket == nil {
-			Handle(bbolt.ErrBucketNotFound)
+			return storage.ErrBucketNotFound
+		}
+		headers, err := tx.CreateBucketIfNotExists(headersBucket)
+		if err != nil {
+			return err
 		}
 
-		if chain.LastHash != nil {
-			err = bucket.Put(newBlock.Hash, newBlock.Serialize())
-			Handle(err)
+		if bucket.Get(newBlock.Hash) != nil {
+			return ErrBlockExists
+		}
+		parentIndex, err := getBlockIndex(tx, newBlock.PrevHash)
+		if err != nil {
+			return ErrOrphanBlock
+		}
+		if parentIndex.Status == BlockStatusInvalid {
+			return ErrInvalidParent
+		}
+		parentHeader, err := getBlockHeader(tx, newBlock.PrevHash)
+		if err != nil {
+			return err
+		}
+		bits, err := chain.nextDifficulty(tx, parentHeader)
+		if err != nil {
+			return err
+		}
+		if err = checkBlockHeader(newBlock, newBlock.PrevHash, &parentHeader, bits); err != nil {
+			return err
+		}
 
-			err = bucket.Delete([]byte("last hash"))
-			Handle(err)
+		tipHash := append([]byte{}, bucket.Get(lastHashKey)...)
+		tipIndex, err := getBlockIndex(tx, tipHash)
+		if err != nil {
+			return err
+		}
 
-			err = bucket.Put([]byte("last hash"), newBlock.Hash)
-			Handle(err)
-			chain.LastHash = newBlock.Hash
+		if err = bucket.Put(newBlock.Hash, newBlock.Serialize()); err != nil {
+			return err
+		}
+		if err = headers.Put(newBlock.Hash, newBlock.BlockHeader.Serialize()); err != nil {
+			return err
+		}
+		index := &BlockIndex{
+			Height:    newBlock.Height,
+			ChainWork: new(big.Int).Add(parentIndex.Work(), newBlock.Work()).Bytes(),
+			Status:    BlockStatusValid,
+		}
+		if err = putBlockIndex(tx, newBlock.Hash, index); err != nil {
+			return err
+		}
+
+		newTip = tipHash
+		if bytes.Equal(newBlock.PrevHash, tipHash) {
+			if err = chain.connectBlock(tx, newBlock); err != nil {
+				return err
+			}
+			newTip = newBlock.Hash
+		} else if index.Work().Cmp(tipIndex.Work()) > 0 {
+			newTip, reorgErr, err = chain.reorganize(tx, tipHash, newBlock.Hash)
+			if err != nil {
+				return err
+			}
 		}
+
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	chain.LastHash = newTip
+
+	return reorgErr
+}
+
+func (chain *Blockchain) connectBlock(tx storage.Tx, block *Block) error {
+	fees, err := checkTransactions(tx, block.Transactions)
+	if err != nil {
+		return err
+	}
+	if err = checkCoinbase(block.Transactions, block.Height, fees, chain.MonetaryPolicy()); err != nil {
+		return err
+	}
+	if err = updateUTXO(tx, block); err != nil {
+		return err
+	}
+	if err = putHeight(tx, block.Height, block.Hash); err != nil {
+		return err
+	}
+	if err = indexTransactions(tx, block); err != nil {
+		return err
+	}
+	undo, err := getBlockUndo(tx, block.Hash)
+	if err != nil {
+		return err
+	}
+	if err = indexAddresses(tx, block, spentOutputs(undo)); err != nil {
+		return err
+	}
+
+	return tx.Bucket(blocksBucket).Put(lastHashKey, block.Hash)
+}
+
+func (chain *Blockchain) GetBlock(hash []byte) (Block, error) {
+	var block Block
+
+	err := chain.Database.View(func(tx storage.Tx) error {
+		found, err := getBlock(tx, hash)
+		if err != nil {
+			return err
+		}
+		block = *found
+
+		return nil
+	})
+
+	return block, err
+}
+
+func getBlock(tx storage.Tx, hash []byte) (*Block, error) {
+	bucket := tx.Bucket(blocksBucket)
+	if bucket == nil {
+		return nil, storage.ErrBucketNotFound
+	}
+
+	blockBlob := bucket.Get(hash)
+	if blockBlob == nil {
+		return nil, errors.New("Block is not found")
+	}
+
+	return Deserialize(blockBlob)
+}
+
+func (chain *Blockchain) GetBlockHeader(hash []byte) (BlockHeader, error) {
+	var header BlockHeader
+
+	err := chain.Database.View(func(tx storage.Tx) error {
+		var err error
+		header, err = getBlockHeader(tx, hash)
+		return err
+	})
+
+	return header, err
+}
 
-	return newBlock
+func getBlockHeader(tx storage.Tx, hash []byte) (BlockHeader, error) {
+	bucket := tx.Bucket(headersBucket)
+	if bucket == nil {
+		return BlockHeader{}, storage.ErrBucketNotFound
+	}
+
+	headerBlob := bucket.Get(hash)
+	if headerBlob == nil {
+		return BlockHeader{}, errors.New("Block header is not found")
+	}
+
+	header, err := DeserializeHeader(headerBlob)
+	if err != nil {
+		return BlockHeader{}, err
+	}
+
+	return *header, nil
+}
+
+func (chain *Blockchain) NextDifficulty(lastHeader BlockHeader) (int, error) {
+	var bits int
+
+	err := chain.Database.View(func(tx storage.Tx) error {
+		var err error
+		bits, err = chain.nextDifficulty(tx, lastHeader)
+		return err
+	})
+
+	return bits, err
+}
+
+func (chain *Blockchain) nextDifficulty(tx storage.Tx, lastHeader BlockHeader) (int, error) {
+	return chain.expectedBits(lastHeader, func(hash []byte) (BlockHeader, error) {
+		return getBlockHeader(tx, hash)
+	})
+}
+
+// expectedBits is the difficulty of the block after lastHeader, looking up
+// earlier headers with getHeader so it also works for headers that are not
+// stored yet.
+func (chain *Blockchain) expectedBits(lastHeader BlockHeader, getHeader func(hash []byte) (BlockHeader, error)) (int, error) {
+	height := lastHeader.Height + 1
+	if height%chain.Params.RetargetInterval != 0 {
+		return lastHeader.Bits, nil
+	}
+
+	firstHeader := lastHeader
+	for i := 0; i < chain.Params.RetargetInterval-1; i++ {
+		header, err := getHeader(firstHeader.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+		firstHeader = header
+	}
+
+	return CalculateNextDifficulty(chain.Params, lastHeader.Bits, lastHeader.Timestamp-firstHeader.Timestamp), nil
+}
+
+func (chain *Blockchain) GetBestHeight() (int, error) {
+	header, err := chain.GetBlockHeader(chain.LastHash)
+	if err != nil {
+		return 0, err
+	}
+
+	return header.Height, nil
 }
 
 func (chain *Blockchain) Iterator() *BlockchainIterator {
@@ -160,37 +547,33 @@ func (chain *Blockchain) Iterator() *BlockchainIterator {
 }
 
 func (chain *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
-	iterator := chain.Iterator()
-	for len(iterator.IteratorHash) != 0 {
-		block := iterator.Next()
+	transaction, _, err := chain.GetTransaction(ID)
 
-		for _, transaction := range block.Transactions {
-			if bytes.Compare(transaction.ID, ID) == 0 {
-				return *transaction, nil
-			}
-		}
-	}
-	return Transaction{}, errors.New("Transaction does not exist")
+	return transaction, err
 }
 
-func (chain *Blockchain) SignTransaction(transaction *Transaction, privateKey ecdsa.PrivateKey) {
+func (chain *Blockchain) SignTransaction(transaction *Transaction, privateKey ecdsa.PrivateKey) error {
 	prevTransactions := make(map[string]Transaction)
 	for _, input := range transaction.Inputs {
 		prevTransaction, err := chain.FindTransaction(input.ID)
-		Handle(err)
+		if err != nil {
+			return err
+		}
 		prevTransactions[hex.EncodeToString(prevTransaction.ID)] = prevTransaction
 	}
 
-	transaction.Sign(privateKey, prevTransactions)
+	return transaction.Sign(privateKey, prevTransactions)
 }
 
-func (chain *Blockchain) VerifyTransaction(transaction *Transaction, privateKey ecdsa.PrivateKey) {
+func (chain *Blockchain) VerifyTransaction(transaction *Transaction) bool {
 	prevTransactions := make(map[string]Transaction)
 	for _, input := range transaction.Inputs {
 		prevTransaction, err := chain.FindTransaction(input.ID)
-		Handle(err)
+		if err != nil || input.OutputIndex < 0 || input.OutputIndex >= len(prevTransaction.Outputs) {
+			return false
+		}
 		prevTransactions[hex.EncodeToString(prevTransaction.ID)] = prevTransaction
 	}
 
-	transaction.Verify(prevTransactions)
+	return transaction.Verify(prevTransactions)
 }
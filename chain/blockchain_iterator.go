@@ -1,30 +1,27 @@
 package blockchain
 
 import (
-	"go.etcd.io/bbolt"
+	"gambim.com/blockchain/storage"
 )
 
 type BlockchainIterator struct {
 	IteratorHash []byte
-	Database     *bbolt.DB
+	Database     storage.Store
 }
 
-func (iterator *BlockchainIterator) Next() *Block {
+func (iterator *BlockchainIterator) Next() (*Block, error) {
 	var block *Block
 
-	err := iterator.Database.View(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte("blockchain bucket"))
-		if bucket == nil {
-			Handle(bbolt.ErrBucketNotFound)
-		}
-
-		blockBlob := bucket.Get(iterator.IteratorHash)
-		block = Deserialize(blockBlob)
-		return nil
+	err := iterator.Database.View(func(tx storage.Tx) error {
+		var err error
+		block, err = getBlock(tx, iterator.IteratorHash)
+		return err
 	})
-	Handle(err)
+	if err != nil {
+		return nil, err
+	}
 
 	iterator.IteratorHash = block.PrevHash
 
-	return block
+	return block, nil
 }
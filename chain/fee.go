@@ -0,0 +1,103 @@
+package blockchain
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	MinFeeRate        = 0.0
+	FeeEstimateBlocks = 10
+)
+
+func (transaction *Transaction) Size() int {
+	return len(transaction.Serialize())
+}
+
+func FeeRate(fee int, size int) float64 {
+	if size == 0 {
+		return 0
+	}
+	return float64(fee) / float64(size)
+}
+
+func EstimateTransactionSize(inputs int, outputs int) int {
+	transaction := Transaction{ID: make([]byte, 32)}
+	for i := 0; i < inputs; i++ {
+		transaction.Inputs = append(transaction.Inputs, TxInput{
+			ID:          make([]byte, 32),
+			OutputIndex: math.MaxInt32,
+			Signature:   make([]byte, 64),
+			PublicKey:   make([]byte, 64),
+		})
+	}
+	for i := 0; i < outputs; i++ {
+		transaction.Outputs = append(transaction.Outputs, TxOutput{Value: math.MaxInt32, PublicKeyHash: make([]byte, 20)})
+	}
+
+	return transaction.Size()
+}
+
+func EstimateFee(feeRate float64, inputs int, outputs int) int {
+	return int(math.Ceil(feeRate * float64(EstimateTransactionSize(inputs, outputs))))
+}
+
+func (chain *Blockchain) TransactionFee(transaction *Transaction) (int, error) {
+	if transaction.IsCoinBase() {
+		return 0, nil
+	}
+
+	fee := 0
+	for _, input := range transaction.Inputs {
+		prevTransaction, err := chain.FindTransaction(input.ID)
+		if err != nil {
+			return 0, err
+		}
+		if input.OutputIndex < 0 || input.OutputIndex >= len(prevTransaction.Outputs) {
+			return 0, ErrMissingInput
+		}
+		fee += prevTransaction.Outputs[input.OutputIndex].Value
+	}
+	for _, output := range transaction.Outputs {
+		fee -= output.Value
+	}
+
+	return fee, nil
+}
+
+func (chain *Blockchain) EstimateFeeRate(blocks int) (float64, error) {
+	var feeRates []float64
+
+	iterator := chain.Iterator()
+	for i := 0; i < blocks && len(iterator.IteratorHash) != 0; i++ {
+		block, err := iterator.Next()
+		if err != nil {
+			return 0, err
+		}
+		for _, transaction := range block.Transactions {
+			if transaction.IsCoinBase() {
+				continue
+			}
+			fee, err := chain.TransactionFee(transaction)
+			if err != nil {
+				return 0, err
+			}
+			feeRates = append(feeRates, FeeRate(fee, transaction.Size()))
+		}
+	}
+
+	if len(feeRates) == 0 {
+		return MinFeeRate, nil
+	}
+
+	sort.Float64s(feeRates)
+	median := feeRates[len(feeRates)/2]
+	if len(feeRates)%2 == 0 {
+		median = (feeRates[len(feeRates)/2-1] + median) / 2
+	}
+	if median < MinFeeRate {
+		median = MinFeeRate
+	}
+
+	return median, nil
+}
@@ -0,0 +1,134 @@
+package blockchain
+
+import (
+	"math/big"
+
+	"gambim.com/blockchain/storage"
+)
+
+func (header *BlockHeader) Hash() []byte {
+	return NewProof(&Block{BlockHeader: *header}).Hash()
+}
+
+// HeaderChain is a chain of headers checked ahead of their blocks, as
+// during initial block download. It starts from a block already stored
+// and only checks linkage, difficulty and proof of work; the blocks are
+// fully validated when they are added to the chain.
+type HeaderChain struct {
+	Hashes  [][]byte
+	Headers []BlockHeader
+
+	chain     *Blockchain
+	baseHash  []byte
+	base      BlockHeader
+	chainWork *big.Int
+	positions map[string]int
+}
+
+func (chain *Blockchain) NewHeaderChain() *HeaderChain {
+	return &HeaderChain{chain: chain, positions: make(map[string]int)}
+}
+
+// Add checks headers and appends them. The first headers added must extend
+// a stored block, later ones the last header added.
+func (headerChain *HeaderChain) Add(headers []BlockHeader) error {
+	if len(headers) == 0 {
+		return nil
+	}
+
+	return headerChain.chain.Database.View(func(tx storage.Tx) error {
+		if headerChain.baseHash == nil {
+			if err := headerChain.setBase(tx, headers[0].PrevHash); err != nil {
+				return err
+			}
+		}
+
+		getHeader := func(hash []byte) (BlockHeader, error) {
+			if position, ok := headerChain.positions[string(hash)]; ok {
+				return headerChain.Headers[position], nil
+			}
+			return getBlockHeader(tx, hash)
+		}
+
+		for i := range headers {
+			header := &headers[i]
+			prevHash, prevHeader := headerChain.Tip()
+			bits, err := headerChain.chain.expectedBits(prevHeader, getHeader)
+			if err != nil {
+				return err
+			}
+			hash := header.Hash()
+			if err = checkHeader(header, hash, prevHash, &prevHeader, bits); err != nil {
+				return &ValidationError{Height: header.Height, Hash: hash, Err: err}
+			}
+
+			headerChain.positions[string(hash)] = len(headerChain.Headers)
+			headerChain.Hashes = append(headerChain.Hashes, hash)
+			headerChain.Headers = append(headerChain.Headers, *header)
+			headerChain.chainWork.Add(headerChain.chainWork, header.Work())
+		}
+
+		return nil
+	})
+}
+
+func (headerChain *HeaderChain) setBase(tx storage.Tx, hash []byte) error {
+	header, err := getBlockHeader(tx, hash)
+	if err != nil {
+		return ErrOrphanBlock
+	}
+	index, err := getBlockIndex(tx, hash)
+	if err != nil {
+		return err
+	}
+	if index.Status == BlockStatusInvalid {
+		return ErrInvalidParent
+	}
+
+	headerChain.baseHash = append([]byte{}, hash...)
+	headerChain.base = header
+	headerChain.chainWork = index.Work()
+
+	return nil
+}
+
+// Tip returns the last header and its hash, or the stored block the
+// headers start from if none were added yet.
+func (headerChain *HeaderChain) Tip() ([]byte, BlockHeader) {
+	if len(headerChain.Headers) == 0 {
+		return headerChain.baseHash, headerChain.base
+	}
+	last := len(headerChain.Headers) - 1
+
+	return headerChain.Hashes[last], headerChain.Headers[last]
+}
+
+func (headerChain *HeaderChain) Height() int {
+	_, tip := headerChain.Tip()
+	return tip.Height
+}
+
+// Work is the total chain work up to the last header, comparable to
+// BlockIndex.Work.
+func (headerChain *HeaderChain) Work() *big.Int {
+	if headerChain.chainWork == nil {
+		return new(big.Int)
+	}
+
+	return new(big.Int).Set(headerChain.chainWork)
+}
+
+// Position returns the index of hash in Hashes.
+func (headerChain *HeaderChain) Position(hash []byte) (int, bool) {
+	position, ok := headerChain.positions[string(hash)]
+	return position, ok
+}
+
+func (chain *Blockchain) TipWork() (*big.Int, error) {
+	index, err := chain.GetBlockIndex(chain.LastHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return index.Work(), nil
+}
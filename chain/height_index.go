@@ -0,0 +1,196 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gambim.com/blockchain/storage"
+)
+
+var (
+	heightIndexBucket = []byte("height index")
+
+	ErrBlockNotFound = errors.New("block is not found")
+	ErrAmbiguousHash = errors.New("hash prefix matches more than one block")
+)
+
+func putHeight(tx storage.Tx, height int, hash []byte) error {
+	bucket, err := tx.CreateBucketIfNotExists(heightIndexBucket)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(ToHex(int64(height)), hash)
+}
+
+func deleteHeight(tx storage.Tx, height int) error {
+	bucket := tx.Bucket(heightIndexBucket)
+	if bucket == nil {
+		return storage.ErrBucketNotFound
+	}
+
+	return bucket.Delete(ToHex(int64(height)))
+}
+
+func getHashByHeight(tx storage.Tx, height int) ([]byte, error) {
+	bucket := tx.Bucket(heightIndexBucket)
+	if bucket == nil {
+		return nil, storage.ErrBucketNotFound
+	}
+
+	hash := bucket.Get(ToHex(int64(height)))
+	if hash == nil {
+		return nil, fmt.Errorf("height %d: %w", height, ErrBlockNotFound)
+	}
+
+	return append([]byte{}, hash...), nil
+}
+
+func buildHeightIndex(tx storage.Tx, tipHash []byte) error {
+	if tx.Bucket(heightIndexBucket) != nil {
+		if err := tx.DeleteBucket(heightIndexBucket); err != nil {
+			return err
+		}
+	}
+
+	for hash := tipHash; len(hash) != 0; {
+		header, err := getBlockHeader(tx, hash)
+		if err != nil {
+			return err
+		}
+		if err = putHeight(tx, header.Height, hash); err != nil {
+			return err
+		}
+		hash = header.PrevHash
+	}
+
+	return nil
+}
+
+func (chain *Blockchain) GetBlockByHeight(height int) (Block, error) {
+	var block Block
+
+	err := chain.Database.View(func(tx storage.Tx) error {
+		hash, err := getHashByHeight(tx, height)
+		if err != nil {
+			return err
+		}
+		found, err := getBlock(tx, hash)
+		if err != nil {
+			return err
+		}
+		block = *found
+
+		return nil
+	})
+
+	return block, err
+}
+
+// Confirmations counts the blocks from the block to the tip, or returns -1
+// if the block is not on the main chain.
+func (chain *Blockchain) Confirmations(hash []byte, height int) (int, error) {
+	confirmations := -1
+
+	err := chain.Database.View(func(tx storage.Tx) error {
+		mainHash, err := getHashByHeight(tx, height)
+		if errors.Is(err, ErrBlockNotFound) || (err == nil && !bytes.Equal(mainHash, hash)) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		tip, err := getBlockHeader(tx, chain.LastHash)
+		if err != nil {
+			return err
+		}
+		confirmations = tip.Height - height + 1
+
+		return nil
+	})
+
+	return confirmations, err
+}
+
+func (chain *Blockchain) GetBlockByHash(hashPrefix string) (Block, error) {
+	var block Block
+
+	hashPrefix = strings.ToLower(hashPrefix)
+	seek, err := hex.DecodeString(hashPrefix[:len(hashPrefix)/2*2])
+	if err != nil {
+		return block, err
+	}
+
+	err = chain.Database.View(func(tx storage.Tx) error {
+		bucket := tx.Bucket(headersBucket)
+		if bucket == nil {
+			return storage.ErrBucketNotFound
+		}
+
+		var match []byte
+		cursor := bucket.Cursor()
+		for key, _ := cursor.Seek(seek); key != nil && bytes.HasPrefix(key, seek); key, _ = cursor.Next() {
+			if !strings.HasPrefix(hex.EncodeToString(key), hashPrefix) {
+				continue
+			}
+			if match != nil {
+				return fmt.Errorf("hash %s: %w", hashPrefix, ErrAmbiguousHash)
+			}
+			match = append([]byte{}, key...)
+		}
+		if match == nil {
+			return fmt.Errorf("hash %s: %w", hashPrefix, ErrBlockNotFound)
+		}
+
+		found, err := getBlock(tx, match)
+		if err != nil {
+			return err
+		}
+		block = *found
+
+		return nil
+	})
+
+	return block, err
+}
+
+type ForwardIterator struct {
+	Height   int
+	Database storage.Store
+}
+
+func (chain *Blockchain) ForwardIterator(fromHeight int) *ForwardIterator {
+	return &ForwardIterator{
+		Height:   fromHeight,
+		Database: chain.Database,
+	}
+}
+
+func (iterator *ForwardIterator) Next() (*Block, error) {
+	var block *Block
+
+	err := iterator.Database.View(func(tx storage.Tx) error {
+		hash, err := getHashByHeight(tx, iterator.Height)
+		if errors.Is(err, ErrBlockNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		block, err = getBlock(tx, hash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if block != nil {
+		iterator.Height++
+	}
+
+	return block, nil
+}
@@ -0,0 +1,121 @@
+package blockchain
+
+import (
+	"encoding/hex"
+
+	"gambim.com/blockchain/wallet"
+)
+
+// The JSON types are the stable external representation of chain data:
+// hashes, keys and signatures are hex strings and public key hashes are
+// also given as base58 addresses for the network's address version.
+
+type TxInputJSON struct {
+	TxID      string `json:"txid,omitempty"`
+	Vout      int    `json:"vout"`
+	Coinbase  string `json:"coinbase,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	PublicKey string `json:"pubkey,omitempty"`
+	Address   string `json:"address,omitempty"`
+}
+
+type TxOutputJSON struct {
+	Value         int    `json:"value"`
+	Address       string `json:"address"`
+	PublicKeyHash string `json:"pubkeyhash"`
+}
+
+type TransactionJSON struct {
+	TxID     string         `json:"txid"`
+	Size     int            `json:"size"`
+	Coinbase bool           `json:"coinbase"`
+	Inputs   []TxInputJSON  `json:"vin"`
+	Outputs  []TxOutputJSON `json:"vout"`
+}
+
+type BlockHeaderJSON struct {
+	Hash              string `json:"hash"`
+	Height            int    `json:"height"`
+	Version           int    `json:"version"`
+	Time              int64  `json:"time"`
+	Bits              int    `json:"bits"`
+	Nonce             int    `json:"nonce"`
+	MerkleRoot        string `json:"merkleroot"`
+	PreviousBlockHash string `json:"previousblockhash,omitempty"`
+}
+
+type BlockJSON struct {
+	BlockHeaderJSON
+	Transactions []TransactionJSON `json:"tx"`
+}
+
+func (input *TxInput) JSON(coinbase bool, version byte) TxInputJSON {
+	if coinbase {
+		return TxInputJSON{Vout: input.OutputIndex, Coinbase: hex.EncodeToString(input.PublicKey)}
+	}
+
+	return TxInputJSON{
+		TxID:      hex.EncodeToString(input.ID),
+		Vout:      input.OutputIndex,
+		Signature: hex.EncodeToString(input.Signature),
+		PublicKey: hex.EncodeToString(input.PublicKey),
+		Address:   string(wallet.EncodeAddress(wallet.PublicKeyHash(input.PublicKey), version)),
+	}
+}
+
+func (output *TxOutput) JSON(version byte) TxOutputJSON {
+	return TxOutputJSON{
+		Value:         output.Value,
+		Address:       string(wallet.EncodeAddress(output.PublicKeyHash, version)),
+		PublicKeyHash: hex.EncodeToString(output.PublicKeyHash),
+	}
+}
+
+func (transaction *Transaction) JSON(version byte) TransactionJSON {
+	result := TransactionJSON{
+		TxID:     hex.EncodeToString(transaction.ID),
+		Size:     transaction.Size(),
+		Coinbase: transaction.IsCoinBase(),
+		Inputs:   []TxInputJSON{},
+		Outputs:  []TxOutputJSON{},
+	}
+
+	for _, input := range transaction.Inputs {
+		result.Inputs = append(result.Inputs, input.JSON(result.Coinbase, version))
+	}
+	for _, output := range transaction.Outputs {
+		result.Outputs = append(result.Outputs, output.JSON(version))
+	}
+
+	return result
+}
+
+func (header *BlockHeader) JSON(hash []byte) BlockHeaderJSON {
+	result := BlockHeaderJSON{
+		Hash:       hex.EncodeToString(hash),
+		Height:     header.Height,
+		Version:    header.Version,
+		Time:       header.Timestamp,
+		Bits:       header.Bits,
+		Nonce:      header.Nounce,
+		MerkleRoot: hex.EncodeToString(header.MerkleRoot),
+	}
+	if len(header.PrevHash) != 0 {
+		result.PreviousBlockHash = hex.EncodeToString(header.PrevHash)
+	}
+
+	return result
+}
+
+func (block *Block) JSON(version byte) BlockJSON {
+	result := BlockJSON{
+		BlockHeaderJSON: block.BlockHeader.JSON(block.Hash),
+		Transactions:    []TransactionJSON{},
+	}
+
+	for _, transaction := range block.Transactions {
+		result.Transactions = append(result.Transactions, transaction.JSON(version))
+	}
+
+	return result
+}
@@ -0,0 +1,150 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+
+	"gambim.com/blockchain/storage"
+)
+
+const locatorDenseLength = 10
+
+func (chain *Blockchain) HasBlock(hash []byte) (bool, error) {
+	found := false
+
+	err := chain.Database.View(func(tx storage.Tx) error {
+		bucket := tx.Bucket(blocksBucket)
+		if bucket == nil {
+			return storage.ErrBucketNotFound
+		}
+		found = bucket.Get(hash) != nil
+
+		return nil
+	})
+
+	return found, err
+}
+
+func (chain *Blockchain) GenesisHash() ([]byte, error) {
+	var hash []byte
+
+	err := chain.Database.View(func(tx storage.Tx) error {
+		var err error
+		hash, err = getHashByHeight(tx, 0)
+		return err
+	})
+
+	return hash, err
+}
+
+// BlockLocator lists main chain hashes from the tip back to genesis: the
+// last few blocks one by one, then exponentially further apart, so a peer
+// can find where its chain forks from ours in few steps.
+func (chain *Blockchain) BlockLocator() ([][]byte, error) {
+	var locator [][]byte
+
+	err := chain.Database.View(func(tx storage.Tx) error {
+		tip, err := getBlockHeader(tx, chain.LastHash)
+		if err != nil {
+			return err
+		}
+
+		step := 1
+		for height := tip.Height; height > 0; height -= step {
+			hash, err := getHashByHeight(tx, height)
+			if err != nil {
+				return err
+			}
+			locator = append(locator, hash)
+			if len(locator) >= locatorDenseLength {
+				step *= 2
+			}
+		}
+
+		genesis, err := getHashByHeight(tx, 0)
+		if err != nil {
+			return err
+		}
+		locator = append(locator, genesis)
+
+		return nil
+	})
+
+	return locator, err
+}
+
+// LocateBlocks returns up to max main chain hashes following the first
+// locator entry found on our main chain, stopping after stopHash.
+func (chain *Blockchain) LocateBlocks(locator [][]byte, stopHash []byte, max int) ([][]byte, error) {
+	var hashes [][]byte
+
+	err := chain.Database.View(func(tx storage.Tx) error {
+		var err error
+		hashes, err = locate(tx, locator, stopHash, max)
+		return err
+	})
+
+	return hashes, err
+}
+
+// LocateHeaders is LocateBlocks returning the headers instead of the hashes.
+func (chain *Blockchain) LocateHeaders(locator [][]byte, stopHash []byte, max int) ([]BlockHeader, error) {
+	var headers []BlockHeader
+
+	err := chain.Database.View(func(tx storage.Tx) error {
+		hashes, err := locate(tx, locator, stopHash, max)
+		if err != nil {
+			return err
+		}
+		for _, hash := range hashes {
+			header, err := getBlockHeader(tx, hash)
+			if err != nil {
+				return err
+			}
+			headers = append(headers, header)
+		}
+
+		return nil
+	})
+
+	return headers, err
+}
+
+func locate(tx storage.Tx, locator [][]byte, stopHash []byte, max int) ([][]byte, error) {
+	var hashes [][]byte
+
+	start := 1
+	for _, hash := range locator {
+		header, err := getBlockHeader(tx, hash)
+		if err != nil {
+			continue
+		}
+		mainHash, err := getHashByHeight(tx, header.Height)
+		if errors.Is(err, ErrBlockNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(mainHash, hash) {
+			start = header.Height + 1
+			break
+		}
+	}
+
+	for height := start; len(hashes) < max; height++ {
+		hash, err := getHashByHeight(tx, height)
+		if errors.Is(err, ErrBlockNotFound) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+		if bytes.Equal(hash, stopHash) {
+			break
+		}
+	}
+
+	return hashes, nil
+}
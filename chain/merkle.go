@@ -0,0 +1,138 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+var (
+	merkleLeafPrefix = []byte{0x00}
+	merkleNodePrefix = []byte{0x01}
+
+	ErrNotInMerkleTree = errors.New("transaction is not in the merkle tree")
+)
+
+type MerkleTree struct {
+	Levels [][][]byte
+}
+
+type MerkleProofStep struct {
+	Hash []byte
+	Left bool
+}
+
+type MerkleProof struct {
+	TransactionID []byte
+	Index         int
+	Steps         []MerkleProofStep
+}
+
+func merkleLeafHash(data []byte) []byte {
+	hash := sha256.Sum256(bytes.Join([][]byte{merkleLeafPrefix, data}, []byte{}))
+	return hash[:]
+}
+
+func merkleNodeHash(left []byte, right []byte) []byte {
+	hash := sha256.Sum256(bytes.Join([][]byte{merkleNodePrefix, left, right}, []byte{}))
+	return hash[:]
+}
+
+func NewMerkleTree(data [][]byte) *MerkleTree {
+	var leaves [][]byte
+
+	for _, item := range data {
+		leaves = append(leaves, merkleLeafHash(item))
+	}
+	if len(leaves) == 0 {
+		leaves = append(leaves, merkleLeafHash([]byte{}))
+	}
+
+	tree := &MerkleTree{Levels: [][][]byte{leaves}}
+	level := leaves
+	for len(level) > 1 {
+		var nextLevel [][]byte
+		for i := 0; i < len(level); i += 2 {
+			left := level[i]
+			right := left
+			if i+1 < len(level) {
+				right = level[i+1]
+			}
+			nextLevel = append(nextLevel, merkleNodeHash(left, right))
+		}
+		tree.Levels = append(tree.Levels, nextLevel)
+		level = nextLevel
+	}
+
+	return tree
+}
+
+func (tree *MerkleTree) Root() []byte {
+	return tree.Levels[len(tree.Levels)-1][0]
+}
+
+func (tree *MerkleTree) Proof(data []byte) (*MerkleProof, error) {
+	leaf := merkleLeafHash(data)
+	index := -1
+	for i, hash := range tree.Levels[0] {
+		if bytes.Equal(hash, leaf) {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		return nil, ErrNotInMerkleTree
+	}
+
+	proof := &MerkleProof{TransactionID: data, Index: index}
+	position := index
+	for _, level := range tree.Levels[:len(tree.Levels)-1] {
+		sibling := position ^ 1
+		if sibling >= len(level) {
+			sibling = position
+		}
+		proof.Steps = append(proof.Steps, MerkleProofStep{Hash: level[sibling], Left: sibling < position})
+		position /= 2
+	}
+
+	return proof, nil
+}
+
+// Verify reports whether the proof leads from the transaction to root,
+// with the transaction at Index.
+func (proof *MerkleProof) Verify(root []byte) bool {
+	if proof.Index < 0 {
+		return false
+	}
+
+	hash := merkleLeafHash(proof.TransactionID)
+	position := proof.Index
+	for _, step := range proof.Steps {
+		// The sibling of an odd position is on its left.
+		if step.Left != (position%2 == 1) {
+			return false
+		}
+		if step.Left {
+			hash = merkleNodeHash(step.Hash, hash)
+		} else {
+			hash = merkleNodeHash(hash, step.Hash)
+		}
+		position /= 2
+	}
+
+	return position == 0 && bytes.Equal(hash, root)
+}
+
+func (block *Block) MerkleProof(transactionID []byte) (*MerkleProof, error) {
+	var txHashes [][]byte
+
+	for _, transaction := range block.Transactions {
+		txHashes = append(txHashes, transaction.ID)
+	}
+
+	return NewMerkleTree(txHashes).Proof(transactionID)
+}
+
+func (header *BlockHeader) VerifyMerkleProof(proof *MerkleProof) bool {
+	return proof.Verify(header.MerkleRoot)
+}
@@ -0,0 +1,87 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func merkleTestData(count int) [][]byte {
+	var data [][]byte
+	for i := 0; i < count; i++ {
+		data = append(data, []byte(fmt.Sprintf("transaction %d", i)))
+	}
+
+	return data
+}
+
+func TestMerkleProofs(t *testing.T) {
+	for _, count := range []int{1, 2, 3, 4, 7} {
+		data := merkleTestData(count)
+		tree := NewMerkleTree(data)
+		otherRoot := NewMerkleTree(merkleTestData(count + 1)).Root()
+
+		for i, item := range data {
+			proof, err := tree.Proof(item)
+			if err != nil {
+				t.Fatalf("%d leaves, leaf %d: %v", count, i, err)
+			}
+			if proof.Index != i {
+				t.Errorf("%d leaves, leaf %d: proof index is %d", count, i, proof.Index)
+			}
+			if !proof.Verify(tree.Root()) {
+				t.Errorf("%d leaves, leaf %d: proof does not verify", count, i)
+			}
+			if proof.Verify(otherRoot) {
+				t.Errorf("%d leaves, leaf %d: proof verifies against another root", count, i)
+			}
+
+			moved := *proof
+			moved.Index = i + 1
+			if moved.Verify(tree.Root()) {
+				t.Errorf("%d leaves, leaf %d: proof verifies at index %d", count, i, moved.Index)
+			}
+			for j := range proof.Steps {
+				tampered := *proof
+				tampered.Steps = append([]MerkleProofStep{}, proof.Steps...)
+				tampered.Steps[j].Hash = append([]byte{}, proof.Steps[j].Hash...)
+				tampered.Steps[j].Hash[0] ^= 1
+				if tampered.Verify(tree.Root()) {
+					t.Errorf("%d leaves, leaf %d: proof with step %d tampered verifies", count, i, j)
+				}
+
+				flipped := *proof
+				flipped.Steps = append([]MerkleProofStep{}, proof.Steps...)
+				flipped.Steps[j].Left = !flipped.Steps[j].Left
+				if flipped.Verify(tree.Root()) {
+					t.Errorf("%d leaves, leaf %d: proof with step %d on the wrong side verifies", count, i, j)
+				}
+			}
+		}
+
+		if _, err := tree.Proof([]byte("missing")); !errors.Is(err, ErrNotInMerkleTree) {
+			t.Errorf("%d leaves: Proof() of a missing leaf = %v, want %v", count, err, ErrNotInMerkleTree)
+		}
+	}
+}
+
+func TestBlockMerkleProof(t *testing.T) {
+	chain, wlt := newTestChain(t)
+	first := newTestBlock(t, chain, chain.LastHash,
+		newTestCoinbase(t, chain, wlt, 1, 0, "first"), newTestCoinbase(t, chain, wlt, 1, 0, "extra"))
+	second := newTestBlock(t, chain, chain.LastHash, newTestCoinbase(t, chain, wlt, 1, 0, "second"))
+
+	proof, err := first.MerkleProof(first.Transactions[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.VerifyMerkleProof(proof) {
+		t.Error("proof does not verify against its block's header")
+	}
+	if second.VerifyMerkleProof(proof) {
+		t.Error("proof verifies against the wrong header")
+	}
+	if _, err = second.MerkleProof(first.Transactions[1].ID); !errors.Is(err, ErrNotInMerkleTree) {
+		t.Errorf("MerkleProof() of a transaction from another block = %v, want %v", err, ErrNotInMerkleTree)
+	}
+}
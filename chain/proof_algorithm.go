@@ -2,63 +2,174 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
-	"log"
+	"errors"
 	"math"
 	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gambim.com/blockchain/params"
+)
+
+const (
+	MinDifficulty       = 1
+	MaxDifficulty       = 255
+	MaxAdjustmentFactor = 4
 )
 
-const Difficulty = 12
+const progressInterval = time.Second
+
+var ErrNounceSpaceExhausted = errors.New("nounce space exhausted and the block has no coinbase to roll")
 
 type ProofOfWork struct {
-	Block  *Block
-	Target *big.Int
+	Block     *Block
+	Target    *big.Int
+	Workers   int
+	MaxNounce int
+	Progress  func(hashes uint64, hashrate float64)
 }
 
 func NewProof(block *Block) *ProofOfWork {
 	target := big.NewInt(1)
-	target.Lsh(target, uint(256-Difficulty))
-	proofOfWork := &ProofOfWork{Block: block, Target: target}
+	target.Lsh(target, uint(256-block.Bits))
+	proofOfWork := &ProofOfWork{Block: block, Target: target, Workers: runtime.NumCPU(), MaxNounce: math.MaxInt64}
 
 	return proofOfWork
 }
 
 func (proofOfWork *ProofOfWork) InitData(nounce int) []byte {
+	header := proofOfWork.Block.BlockHeader
 	data := bytes.Join(
 		[][]byte{
-			proofOfWork.Block.PrevHash,
-			proofOfWork.Block.HashTransactions(),
+			ToHex(int64(header.Version)),
+			ToHex(int64(header.Height)),
+			ToHex(header.Timestamp),
+			ToHex(int64(header.Bits)),
+			header.MerkleRoot,
+			header.PrevHash,
 			ToHex(int64(nounce)),
-			ToHex(int64(Difficulty)),
 		},
 		[]byte{},
 	)
 	return data
 }
 
-func (proofOfWork *ProofOfWork) Run() (int, []byte) {
-	var intHash big.Int
-	var hash [32]byte
+func (proofOfWork *ProofOfWork) Run(ctx context.Context) (int, []byte, error) {
+	var hashes uint64
 
-	nounce := 0
+	workers := proofOfWork.Workers
+	if workers <= 0 {
+		workers = 1
+	}
 
-	for nounce < math.MaxInt64 {
-		data := proofOfWork.InitData(nounce)
-		hash = sha256.Sum256(data)
+	if proofOfWork.Progress != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go proofOfWork.reportProgress(done, &hashes)
+	}
 
-		//fmt.Printf("\r%x\n", hash)
+	var coinbaseData []byte
+	if len(proofOfWork.Block.Transactions) > 0 && proofOfWork.Block.Transactions[0].IsCoinBase() {
+		coinbaseData = proofOfWork.Block.Transactions[0].Inputs[0].PublicKey
+	}
 
-		intHash.SetBytes(hash[:])
+	for extraNounce := uint64(0); ; extraNounce++ {
+		if extraNounce > 0 {
+			if coinbaseData == nil {
+				return 0, nil, ErrNounceSpaceExhausted
+			}
+			coinbase := proofOfWork.Block.Transactions[0]
+			coinbase.Inputs[0].PublicKey = append(append([]byte{}, coinbaseData...), ToHex(int64(extraNounce))...)
+			coinbase.ID = coinbase.Hash()
+			proofOfWork.Block.MerkleRoot = proofOfWork.Block.HashTransactions()
+		}
 
-		if intHash.Cmp(proofOfWork.Target) == -1 {
-			break
-		} else {
-			nounce++
+		nounce, hash, found := proofOfWork.search(ctx, workers, &hashes)
+		if err := ctx.Err(); err != nil {
+			return 0, nil, err
+		}
+		if found {
+			return nounce, hash, nil
 		}
 	}
+}
+
+func (proofOfWork *ProofOfWork) search(ctx context.Context, workers int, hashes *uint64) (int, []byte, bool) {
+	var once sync.Once
+	var wg sync.WaitGroup
+	var found int32
+	var resultNounce int
+	var resultHash []byte
+
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(start int) {
+			defer wg.Done()
+
+			var intHash big.Int
+			var counted uint64
+			defer func() {
+				atomic.AddUint64(hashes, counted)
+			}()
+
+			for nounce := start; nounce <= proofOfWork.MaxNounce; nounce += workers {
+				if counted == 1024 {
+					atomic.AddUint64(hashes, counted)
+					counted = 0
+					if ctx.Err() != nil || atomic.LoadInt32(&found) == 1 {
+						return
+					}
+				}
+
+				hash := sha256.Sum256(proofOfWork.InitData(nounce))
+				counted++
+
+				intHash.SetBytes(hash[:])
+				if intHash.Cmp(proofOfWork.Target) == -1 {
+					once.Do(func() {
+						resultNounce = nounce
+						resultHash = hash[:]
+						atomic.StoreInt32(&found, 1)
+					})
+					return
+				}
+
+				if nounce > proofOfWork.MaxNounce-workers {
+					return
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	return resultNounce, resultHash, atomic.LoadInt32(&found) == 1
+}
+
+func (proofOfWork *ProofOfWork) reportProgress(done chan struct{}, hashes *uint64) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	start := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			total := atomic.LoadUint64(hashes)
+			proofOfWork.Progress(total, float64(total)/now.Sub(start).Seconds())
+		}
+	}
+}
 
-	return nounce, hash[:]
+func (proofOfWork *ProofOfWork) Hash() []byte {
+	hash := sha256.Sum256(proofOfWork.InitData(proofOfWork.Block.Nounce))
+
+	return hash[:]
 }
 
 func (proofOfWork *ProofOfWork) Validate() bool {
@@ -72,12 +183,49 @@ func (proofOfWork *ProofOfWork) Validate() bool {
 	return intHash.Cmp(proofOfWork.Target) == -1
 }
 
-func ToHex(num int64) []byte {
-	buffer := new(bytes.Buffer)
-	err := binary.Write(buffer, binary.BigEndian, num)
-	if err != nil {
-		log.Panic(err)
+func (header *BlockHeader) Work() *big.Int {
+	target := big.NewInt(1)
+	target.Lsh(target, uint(256-header.Bits))
+	target.Add(target, big.NewInt(1))
+
+	work := big.NewInt(1)
+	work.Lsh(work, 256)
+
+	return work.Div(work, target)
+}
+
+func CalculateNextDifficulty(chainParams *params.Params, bits int, actualTimespan int64) int {
+	if chainParams.NoRetargeting {
+		return bits
+	}
+	expectedTimespan := chainParams.TargetBlockTime * int64(chainParams.RetargetInterval-1)
+
+	if actualTimespan < expectedTimespan/MaxAdjustmentFactor {
+		actualTimespan = expectedTimespan / MaxAdjustmentFactor
+	}
+	if actualTimespan > expectedTimespan*MaxAdjustmentFactor {
+		actualTimespan = expectedTimespan * MaxAdjustmentFactor
 	}
+	if actualTimespan == 0 {
+		actualTimespan = 1
+	}
+
+	adjustment := math.Round(math.Log2(float64(expectedTimespan) / float64(actualTimespan)))
+	newBits := bits + int(adjustment)
+
+	if newBits < MinDifficulty {
+		newBits = MinDifficulty
+	}
+	if newBits > MaxDifficulty {
+		newBits = MaxDifficulty
+	}
+
+	return newBits
+}
+
+func ToHex(num int64) []byte {
+	buffer := make([]byte, 8)
+	binary.BigEndian.PutUint64(buffer, uint64(num))
 
-	return buffer.Bytes()
+	return buffer
 }
@@ -0,0 +1,69 @@
+package blockchain
+
+import (
+	"gambim.com/blockchain/params"
+)
+
+type MonetaryPolicy struct {
+	InitialSubsidy  int
+	HalvingInterval int
+	MaxSupply       int
+}
+
+func NewMonetaryPolicy(chainParams *params.Params) MonetaryPolicy {
+	return MonetaryPolicy{
+		InitialSubsidy:  chainParams.InitialSubsidy,
+		HalvingInterval: chainParams.HalvingInterval,
+		MaxSupply:       chainParams.MaxSupply,
+	}
+}
+
+func (policy MonetaryPolicy) baseSubsidy(height int) int {
+	halvings := height / policy.HalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+	return policy.InitialSubsidy >> uint(halvings)
+}
+
+func (policy MonetaryPolicy) uncappedSupply(height int) int {
+	supply := 0
+	for eraStart := 0; eraStart <= height; eraStart += policy.HalvingInterval {
+		subsidy := policy.baseSubsidy(eraStart)
+		if subsidy == 0 {
+			break
+		}
+		eraEnd := eraStart + policy.HalvingInterval - 1
+		if eraEnd > height {
+			eraEnd = height
+		}
+		supply += subsidy * (eraEnd - eraStart + 1)
+	}
+	return supply
+}
+
+func (policy MonetaryPolicy) ScheduledSupply(height int) int {
+	if height < 0 {
+		return 0
+	}
+	supply := policy.uncappedSupply(height)
+	if supply > policy.MaxSupply {
+		return policy.MaxSupply
+	}
+	return supply
+}
+
+func (policy MonetaryPolicy) SubsidyAtHeight(height int) int {
+	if height < 0 {
+		return 0
+	}
+	subsidy := policy.baseSubsidy(height)
+	remaining := policy.MaxSupply - policy.ScheduledSupply(height-1)
+	if subsidy > remaining {
+		subsidy = remaining
+	}
+	if subsidy < 0 {
+		return 0
+	}
+	return subsidy
+}
@@ -6,16 +6,20 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
 	"math/big"
 	"strings"
 
 	"gambim.com/blockchain/wallet"
 )
 
+var (
+	ErrInsufficientFunds  = errors.New("not enough funds")
+	ErrMissingTransaction = errors.New("previous transaction does not exist")
+)
+
 type Transaction struct {
 	ID      []byte
 	Inputs  []TxInput
@@ -23,49 +27,50 @@ type Transaction struct {
 }
 
 func (transaction *Transaction) SetID() {
-	var encoded bytes.Buffer
-	var hash [32]byte
-
-	encode := gob.NewEncoder(&encoded)
-	err := encode.Encode(transaction)
-	Handle(err)
-
-	hash = sha256.Sum256(encoded.Bytes())
-	transaction.ID = hash[:]
+	transaction.ID = transaction.Hash()
 }
 
-func CoinBaseTx(to string, data string) *Transaction {
+func CoinBaseTx(to string, version byte, data string, value int) (*Transaction, error) {
 	if data == "" {
 		data = fmt.Sprintf("Coins to %s", to)
 	}
 
 	txin := TxInput{ID: []byte{}, OutputIndex: -1, PublicKey: []byte(data)}
-	txout := NewTransactionOutput(100, to)
+	txout, err := NewTransactionOutput(value, to, version)
+	if err != nil {
+		return nil, err
+	}
 
 	transaction := &Transaction{ID: nil, Inputs: []TxInput{txin}, Outputs: []TxOutput{*txout}}
 	transaction.SetID()
 
-	return transaction
+	return transaction, nil
 }
 
-func NewTransaction(from string, to string, amount int, utxoSet *UTXOSet) *Transaction {
+func NewTransaction(wlt *wallet.Wallet, to string, amount int, fee int, utxoSet *UTXOSet) (*Transaction, error) {
 	var inputs []TxInput
 	var outputs []TxOutput
 
-	wallets, err := wallet.CreateWallets()
-	Handle(err)
-	wlt := wallets.GetWallet(from)
-	publicKeyHash := wallet.PublicKeyHash(wlt.PublicKey)
+	output, err := NewTransactionOutput(amount, to, utxoSet.Chain.Params.AddressVersion)
+	if err != nil {
+		return nil, err
+	}
 
-	accumulated, validOutputs := utxoSet.FindSpendableOutputs(publicKeyHash, amount)
+	publicKeyHash := wallet.PublicKeyHash(wlt.PublicKey)
 
-	if accumulated < amount {
-		log.Panic("Error: not enough funds")
+	accumulated, validOutputs, err := utxoSet.FindSpendableOutputs(publicKeyHash, amount+fee)
+	if err != nil {
+		return nil, err
+	}
+	if accumulated < amount+fee {
+		return nil, fmt.Errorf("%w: have %d, need %d", ErrInsufficientFunds, accumulated, amount+fee)
 	}
 
 	for txIndex, outs := range validOutputs {
 		txID, err := hex.DecodeString(txIndex)
-		Handle(err)
+		if err != nil {
+			return nil, err
+		}
 
 		for _, out := range outs {
 			input := TxInput{ID: txID, OutputIndex: out, PublicKey: wlt.PublicKey}
@@ -73,18 +78,19 @@ func NewTransaction(from string, to string, amount int, utxoSet *UTXOSet) *Trans
 		}
 	}
 
-	outputs = append(outputs, *NewTransactionOutput(amount, to))
+	outputs = append(outputs, *output)
 
-	if accumulated > amount {
-		outputs = append(outputs, *NewTransactionOutput(accumulated-amount, from))
+	if accumulated > amount+fee {
+		outputs = append(outputs, TxOutput{Value: accumulated - amount - fee, PublicKeyHash: publicKeyHash})
 	}
 
 	transaction := &Transaction{ID: nil, Inputs: inputs, Outputs: outputs}
 	transaction.ID = transaction.Hash()
-	utxoSet.Chain.SignTransaction(transaction, wlt.PrivateKey)
-	//transaction.SetID()
+	if err = utxoSet.Chain.SignTransaction(transaction, wlt.PrivateKey); err != nil {
+		return nil, err
+	}
 
-	return transaction
+	return transaction, nil
 }
 
 func (transaction Transaction) IsCoinBase() bool {
@@ -92,36 +98,58 @@ func (transaction Transaction) IsCoinBase() bool {
 }
 
 func (transaction *Transaction) Serialize() []byte {
-	var encoded bytes.Buffer
+	return encode(transaction)
+}
 
-	encoder := gob.NewEncoder(&encoded)
-	err := encoder.Encode(transaction)
-	if err != nil {
-		log.Panic(err)
+func DeserializeTransaction(data []byte) (*Transaction, error) {
+	var transaction Transaction
+
+	if err := decode(data, &transaction); err != nil {
+		return nil, err
 	}
 
-	return encoded.Bytes()
+	return &transaction, nil
 }
 
+// Hash commits to everything but the ID and the signatures. It uses a fixed
+// encoding because gob output depends on the order types were registered in.
 func (transaction *Transaction) Hash() []byte {
-	var hash [32]byte
+	var encoded bytes.Buffer
 
-	transactionCopy := *transaction
-	transactionCopy.ID = []byte{}
+	writeBytes := func(data []byte) {
+		encoded.Write(ToHex(int64(len(data))))
+		encoded.Write(data)
+	}
+
+	encoded.Write(ToHex(int64(len(transaction.Inputs))))
+	for _, input := range transaction.Inputs {
+		writeBytes(input.ID)
+		encoded.Write(ToHex(int64(input.OutputIndex)))
+		writeBytes(input.PublicKey)
+	}
+	encoded.Write(ToHex(int64(len(transaction.Outputs))))
+	for _, output := range transaction.Outputs {
+		encoded.Write(ToHex(int64(output.Value)))
+		writeBytes(output.PublicKeyHash)
+	}
 
-	hash = sha256.Sum256(transaction.Serialize())
+	hash := sha256.Sum256(encoded.Bytes())
 
 	return hash[:]
 }
 
-func (transaction *Transaction) Sign(privKey ecdsa.PrivateKey, prevTransactions map[string]Transaction) {
+func (transaction *Transaction) Sign(privKey ecdsa.PrivateKey, prevTransactions map[string]Transaction) error {
 	if transaction.IsCoinBase() {
-		return
+		return nil
 	}
 
 	for _, input := range transaction.Inputs {
-		if prevTransactions[hex.EncodeToString(input.ID)].ID == nil {
-			log.Panic("Error: Previous transaction is not exist")
+		prevTransaction := prevTransactions[hex.EncodeToString(input.ID)]
+		if prevTransaction.ID == nil {
+			return fmt.Errorf("transaction %x: %w", input.ID, ErrMissingTransaction)
+		}
+		if input.OutputIndex < 0 || input.OutputIndex >= len(prevTransaction.Outputs) {
+			return fmt.Errorf("output %x:%d: %w", input.ID, input.OutputIndex, ErrMissingInput)
 		}
 	}
 
@@ -135,12 +163,19 @@ func (transaction *Transaction) Sign(privKey ecdsa.PrivateKey, prevTransactions
 		transactionCopy.Inputs[inputIndex].PublicKey = nil
 
 		r, s, err := ecdsa.Sign(rand.Reader, &privKey, transactionCopy.ID)
-		Handle(err)
+		if err != nil {
+			return err
+		}
 
-		signature := append(r.Bytes(), s.Bytes()...)
+		size := (privKey.Curve.Params().BitSize + 7) / 8
+		signature := make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
 
 		transaction.Inputs[inputIndex].Signature = signature
 	}
+
+	return nil
 }
 
 func (transaction *Transaction) TrimmedCopy() Transaction {
@@ -165,19 +200,29 @@ func (transaction Transaction) Verify(prevTransactions map[string]Transaction) b
 		return true
 	}
 
+	var prevOutputs []TxOutput
 	for _, input := range transaction.Inputs {
-		if prevTransactions[hex.EncodeToString(input.ID)].ID == nil {
-			log.Panic("Error: Previous transaction is not exist")
+		prevTransaction := prevTransactions[hex.EncodeToString(input.ID)]
+		if prevTransaction.ID == nil || input.OutputIndex < 0 || input.OutputIndex >= len(prevTransaction.Outputs) {
+			return false
 		}
+		prevOutputs = append(prevOutputs, prevTransaction.Outputs[input.OutputIndex])
+	}
+
+	return transaction.VerifyOutputs(prevOutputs)
+}
+
+func (transaction Transaction) VerifyOutputs(prevOutputs []TxOutput) bool {
+	if transaction.IsCoinBase() {
+		return true
 	}
 
 	transactionCopy := transaction.TrimmedCopy()
 	curve := elliptic.P256()
 
 	for inputIndex, input := range transaction.Inputs {
-		prevTransaction := prevTransactions[hex.EncodeToString(input.ID)]
 		transactionCopy.Inputs[inputIndex].Signature = nil
-		transactionCopy.Inputs[inputIndex].PublicKey = prevTransaction.Outputs[input.OutputIndex].PublicKeyHash
+		transactionCopy.Inputs[inputIndex].PublicKey = prevOutputs[inputIndex].PublicKeyHash
 		transactionCopy.ID = transactionCopy.Hash()
 		transactionCopy.Inputs[inputIndex].PublicKey = nil
 
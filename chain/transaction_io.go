@@ -2,7 +2,6 @@ package blockchain
 
 import (
 	"bytes"
-	"encoding/gob"
 
 	"gambim.com/blockchain/wallet"
 )
@@ -14,6 +13,7 @@ type TxOutput struct {
 
 type TxOutputs struct {
 	Outputs []TxOutput
+	Indexes []int
 }
 
 type TxInput struct {
@@ -29,34 +29,68 @@ func (input *TxInput) UsesKey(publicKeyHash []byte) bool {
 	return bytes.Compare(lockingHash, publicKeyHash) == 0
 }
 
-func (output *TxOutput) Lock(address []byte) {
-	publicKeyFullHash := wallet.Base58Decode(address)
-	publicKeyHash := publicKeyFullHash[1 : len(publicKeyFullHash)-wallet.GetChecksumLength()]
+func (output *TxOutput) Lock(address string, version byte) error {
+	publicKeyHash, err := wallet.DecodeAddress(address, version)
+	if err != nil {
+		return err
+	}
 	output.PublicKeyHash = publicKeyHash
+
+	return nil
 }
 
 func (output *TxOutput) IsLockedWithKey(publicHashKey []byte) bool {
 	return bytes.Compare(output.PublicKeyHash, publicHashKey) == 0
 }
 
-func NewTransactionOutput(value int, address string) *TxOutput {
+func NewTransactionOutput(value int, address string, version byte) (*TxOutput, error) {
 	transactionOutput := &TxOutput{Value: value}
-	transactionOutput.Lock([]byte(address))
-	return transactionOutput
+	if err := transactionOutput.Lock(address, version); err != nil {
+		return nil, err
+	}
+	return transactionOutput, nil
+}
+
+func (outputs *TxOutputs) Add(index int, output TxOutput) {
+	outputs.Outputs = append(outputs.Outputs, output)
+	outputs.Indexes = append(outputs.Indexes, index)
+}
+
+func (outputs TxOutputs) Index(position int) int {
+	if outputs.Indexes == nil {
+		return position
+	}
+	return outputs.Indexes[position]
+}
+
+func (outputs TxOutputs) Find(index int) (TxOutput, bool) {
+	for position, output := range outputs.Outputs {
+		if outputs.Index(position) == index {
+			return output, true
+		}
+	}
+	return TxOutput{}, false
 }
 
 func (outputs TxOutputs) Serialize() []byte {
-	var buffer bytes.Buffer
-	encode := gob.NewEncoder(&buffer)
-	err := encode.Encode(outputs)
-	Handle(err)
-	return buffer.Bytes()
+	return encode(outputs)
 }
 
-func DeserializeOutputs(data []byte) TxOutputs {
+func DeserializeOutputs(data []byte) (TxOutputs, error) {
 	var outputs TxOutputs
-	decode := gob.NewDecoder(bytes.NewReader(data))
-	err := decode.Decode(&outputs)
-	Handle(err)
-	return outputs
+	err := decode(data, &outputs)
+	return outputs, err
+}
+
+func (outputs TxOutputs) Len() int {
+	return len(outputs.Outputs)
+}
+
+func (outputs TxOutputs) Less(i int, j int) bool {
+	return outputs.Index(i) < outputs.Index(j)
+}
+
+func (outputs TxOutputs) Swap(i int, j int) {
+	outputs.Outputs[i], outputs.Outputs[j] = outputs.Outputs[j], outputs.Outputs[i]
+	outputs.Indexes[i], outputs.Indexes[j] = outputs.Indexes[j], outputs.Indexes[i]
 }
@@ -0,0 +1,168 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+
+	"gambim.com/blockchain/storage"
+)
+
+var (
+	txIndexBucket = []byte("tx index")
+
+	ErrTransactionNotFound = errors.New("Transaction does not exist")
+)
+
+type TxLocation struct {
+	BlockHash []byte
+	Position  int
+}
+
+func (location *TxLocation) Serialize() []byte {
+	return encode(location)
+}
+
+func DeserializeTxLocation(data []byte) (*TxLocation, error) {
+	var location TxLocation
+
+	if err := decode(data, &location); err != nil {
+		return nil, err
+	}
+
+	return &location, nil
+}
+
+func indexTransactions(tx storage.Tx, block *Block) error {
+	bucket := tx.Bucket(txIndexBucket)
+	if bucket == nil {
+		return nil
+	}
+
+	for position, transaction := range block.Transactions {
+		location := &TxLocation{BlockHash: block.Hash, Position: position}
+		if err := bucket.Put(transaction.ID, location.Serialize()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func unindexTransactions(tx storage.Tx, block *Block) error {
+	bucket := tx.Bucket(txIndexBucket)
+	if bucket == nil {
+		return nil
+	}
+
+	for _, transaction := range block.Transactions {
+		if err := bucket.Delete(transaction.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func findTransaction(tx storage.Tx, tipHash []byte, ID []byte) (*Transaction, *Block, error) {
+	if bucket := tx.Bucket(txIndexBucket); bucket != nil {
+		item := bucket.Get(ID)
+		if item == nil {
+			return nil, nil, ErrTransactionNotFound
+		}
+		location, err := DeserializeTxLocation(item)
+		if err != nil {
+			return nil, nil, err
+		}
+		block, err := getBlock(tx, location.BlockHash)
+		if err != nil {
+			return nil, nil, err
+		}
+		if location.Position >= len(block.Transactions) {
+			return nil, nil, ErrTransactionNotFound
+		}
+		return block.Transactions[location.Position], block, nil
+	}
+
+	for hash := tipHash; len(hash) != 0; {
+		block, err := getBlock(tx, hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, transaction := range block.Transactions {
+			if bytes.Equal(transaction.ID, ID) {
+				return transaction, block, nil
+			}
+		}
+		hash = block.PrevHash
+	}
+
+	return nil, nil, ErrTransactionNotFound
+}
+
+func (chain *Blockchain) GetTransaction(ID []byte) (Transaction, *Block, error) {
+	var transaction Transaction
+	var block *Block
+
+	err := chain.Database.View(func(tx storage.Tx) error {
+		found, containing, err := findTransaction(tx, chain.LastHash, ID)
+		if err != nil {
+			return err
+		}
+		transaction = *found
+		block = containing
+
+		return nil
+	})
+
+	return transaction, block, err
+}
+
+func (chain *Blockchain) TxIndexEnabled() (bool, error) {
+	enabled := false
+	err := chain.Database.View(func(tx storage.Tx) error {
+		enabled = tx.Bucket(txIndexBucket) != nil
+		return nil
+	})
+
+	return enabled, err
+}
+
+func (chain *Blockchain) ReindexTransactions() (int, error) {
+	count := 0
+
+	err := chain.Database.Update(func(tx storage.Tx) error {
+		if tx.Bucket(txIndexBucket) != nil {
+			if err := tx.DeleteBucket(txIndexBucket); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.CreateBucket(txIndexBucket); err != nil {
+			return err
+		}
+
+		for hash := chain.LastHash; len(hash) != 0; {
+			block, err := getBlock(tx, hash)
+			if err != nil {
+				return err
+			}
+			if err = indexTransactions(tx, block); err != nil {
+				return err
+			}
+			count += len(block.Transactions)
+			hash = block.PrevHash
+		}
+
+		return nil
+	})
+
+	return count, err
+}
+
+func (chain *Blockchain) DropTxIndex() error {
+	return chain.Database.Update(func(tx storage.Tx) error {
+		if tx.Bucket(txIndexBucket) == nil {
+			return nil
+		}
+		return tx.DeleteBucket(txIndexBucket)
+	})
+}
@@ -0,0 +1,294 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"gambim.com/blockchain/storage"
+)
+
+var (
+	undoBucket = []byte("undo")
+
+	ErrMissingUndo = errors.New("undo data is not found")
+	ErrNotTip      = errors.New("block is not the chain tip")
+)
+
+type SpentOutput struct {
+	TransactionID []byte
+	OutputIndex   int
+	Output        TxOutput
+}
+
+type BlockUndo struct {
+	Spent []SpentOutput
+}
+
+func (undo *BlockUndo) Serialize() []byte {
+	return encode(undo)
+}
+
+func DeserializeBlockUndo(data []byte) (*BlockUndo, error) {
+	var undo BlockUndo
+
+	if err := decode(data, &undo); err != nil {
+		return nil, err
+	}
+
+	return &undo, nil
+}
+
+func getBlockUndo(tx storage.Tx, hash []byte) (*BlockUndo, error) {
+	bucket := tx.Bucket(undoBucket)
+	if bucket == nil {
+		return nil, ErrMissingUndo
+	}
+
+	item := bucket.Get(hash)
+	if item == nil {
+		return nil, fmt.Errorf("block %x: %w", hash, ErrMissingUndo)
+	}
+
+	return DeserializeBlockUndo(item)
+}
+
+func putBlockUndo(tx storage.Tx, hash []byte, undo *BlockUndo) error {
+	bucket, err := tx.CreateBucketIfNotExists(undoBucket)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(hash, undo.Serialize())
+}
+
+func deleteBlockUndo(tx storage.Tx, hash []byte) error {
+	bucket := tx.Bucket(undoBucket)
+	if bucket == nil {
+		return nil
+	}
+
+	return bucket.Delete(hash)
+}
+
+func restoreOutput(bucket storage.Bucket, spent SpentOutput) error {
+	outputs := TxOutputs{}
+	if item := bucket.Get(spent.TransactionID); item != nil {
+		existing, err := DeserializeOutputs(item)
+		if err != nil {
+			return err
+		}
+		for position, output := range existing.Outputs {
+			outputs.Add(existing.Index(position), output)
+		}
+	}
+	if _, ok := outputs.Find(spent.OutputIndex); ok {
+		return fmt.Errorf("output %x:%d is already unspent", spent.TransactionID, spent.OutputIndex)
+	}
+	outputs.Add(spent.OutputIndex, spent.Output)
+	sort.Sort(outputs)
+
+	return bucket.Put(spent.TransactionID, outputs.Serialize())
+}
+
+func disconnectUTXO(tx storage.Tx, block *Block) error {
+	bucket := tx.Bucket(utxoBucket)
+	if bucket == nil {
+		return storage.ErrBucketNotFound
+	}
+	undo, err := getBlockUndo(tx, block.Hash)
+	if err != nil {
+		return err
+	}
+
+	spent := undo.Spent
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		transaction := block.Transactions[i]
+		if err := bucket.Delete(transaction.ID); err != nil {
+			return err
+		}
+		if transaction.IsCoinBase() {
+			continue
+		}
+
+		if len(spent) < len(transaction.Inputs) {
+			return fmt.Errorf("block %x: %w", block.Hash, ErrMissingUndo)
+		}
+		for j := len(spent) - 1; j >= len(spent)-len(transaction.Inputs); j-- {
+			if err := restoreOutput(bucket, spent[j]); err != nil {
+				return err
+			}
+		}
+		spent = spent[:len(spent)-len(transaction.Inputs)]
+	}
+
+	return deleteBlockUndo(tx, block.Hash)
+}
+
+func (u *UTXOSet) Disconnect(block *Block) error {
+	return u.Chain.Database.Update(func(tx storage.Tx) error {
+		return disconnectUTXO(tx, block)
+	})
+}
+
+func disconnectBlock(tx storage.Tx, block *Block) error {
+	bucket := tx.Bucket(blocksBucket)
+	if !bytes.Equal(bucket.Get(lastHashKey), block.Hash) {
+		return fmt.Errorf("block %x: %w", block.Hash, ErrNotTip)
+	}
+
+	err := disconnectUTXO(tx, block)
+	if errors.Is(err, ErrMissingUndo) {
+		err = rebuildUTXO(tx, block.PrevHash)
+	}
+	if err != nil {
+		return err
+	}
+	if err = deleteHeight(tx, block.Height); err != nil {
+		return err
+	}
+	if err = unindexTransactions(tx, block); err != nil {
+		return err
+	}
+	if err = unindexAddresses(tx, block); err != nil {
+		return err
+	}
+
+	return bucket.Put(lastHashKey, block.PrevHash)
+}
+
+func disconnectBlocks(tx storage.Tx, hashes [][]byte) ([]*Block, error) {
+	var blocks []*Block
+
+	for i := len(hashes) - 1; i >= 0; i-- {
+		block, err := getBlock(tx, hashes[i])
+		if err != nil {
+			return nil, err
+		}
+		if err = disconnectBlock(tx, block); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+
+	return blocks, nil
+}
+
+func (chain *Blockchain) RollbackTo(height int) ([]*Block, error) {
+	var blocks []*Block
+	var newTip []byte
+
+	err := chain.Database.Update(func(tx storage.Tx) error {
+		tipHash := append([]byte{}, tx.Bucket(blocksBucket).Get(lastHashKey)...)
+		tipHeader, err := getBlockHeader(tx, tipHash)
+		if err != nil {
+			return err
+		}
+		if height < 0 || height > tipHeader.Height {
+			return fmt.Errorf("height %d is outside of the chain (tip is at %d)", height, tipHeader.Height)
+		}
+
+		hash := tipHash
+		var hashes [][]byte
+		for header := tipHeader; header.Height > height; {
+			hashes = append([][]byte{hash}, hashes...)
+			hash = header.PrevHash
+			if header, err = getBlockHeader(tx, hash); err != nil {
+				return err
+			}
+		}
+
+		blocks, err = disconnectBlocks(tx, hashes)
+		newTip = hash
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	chain.LastHash = newTip
+
+	return blocks, nil
+}
+
+// InvalidateBlock marks a block and its descendants invalid, moving the tip
+// to the valid block with the most work. It returns the blocks that left
+// the main chain, newest first.
+func (chain *Blockchain) InvalidateBlock(hash []byte) ([]*Block, error) {
+	var blocks []*Block
+	var newTip []byte
+
+	err := chain.Database.Update(func(tx storage.Tx) error {
+		header, err := getBlockHeader(tx, hash)
+		if err != nil {
+			return err
+		}
+		if len(header.PrevHash) == 0 {
+			return errors.New("genesis block can not be invalidated")
+		}
+
+		tipHash := append([]byte{}, tx.Bucket(blocksBucket).Get(lastHashKey)...)
+		fork, err := findFork(tx, tipHash, hash)
+		if err != nil {
+			return err
+		}
+		newTip = tipHash
+		if bytes.Equal(fork, hash) {
+			hashes, err := branchHashes(tx, tipHash, header.PrevHash)
+			if err != nil {
+				return err
+			}
+			if _, err = disconnectBlocks(tx, hashes); err != nil {
+				return err
+			}
+			newTip = header.PrevHash
+		}
+		if err = markInvalid(tx, hash); err != nil {
+			return err
+		}
+
+		// A side branch may now have more work than what is left of the
+		// main chain. Each failed attempt marks more blocks invalid.
+		for {
+			best, bestIndex, err := bestValidTip(tx)
+			if err != nil {
+				return err
+			}
+			tipIndex, err := getBlockIndex(tx, newTip)
+			if err != nil {
+				return err
+			}
+			if bestIndex.Work().Cmp(tipIndex.Work()) <= 0 {
+				break
+			}
+			tip, invalid, err := chain.reorganize(tx, newTip, best)
+			if err != nil {
+				return err
+			}
+			newTip = tip
+			if invalid == nil {
+				break
+			}
+		}
+
+		fork, err = findFork(tx, tipHash, newTip)
+		if err != nil {
+			return err
+		}
+		left, err := branchBlocks(tx, tipHash, fork)
+		if err != nil {
+			return err
+		}
+		for i := len(left) - 1; i >= 0; i-- {
+			blocks = append(blocks, left[i])
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	chain.LastHash = newTip
+
+	return blocks, nil
+}
@@ -0,0 +1,162 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"gambim.com/blockchain/storage"
+	"gambim.com/blockchain/wallet"
+)
+
+func utxoSnapshot(t *testing.T, chain *Blockchain) map[string]string {
+	t.Helper()
+
+	snapshot := make(map[string]string)
+	err := chain.Database.View(func(tx storage.Tx) error {
+		return tx.Bucket(utxoBucket).ForEach(func(key []byte, value []byte) error {
+			snapshot[string(key)] = string(value)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return snapshot
+}
+
+// addTestPayment adds a block paying amount from wlt to recipient.
+func addTestPayment(t *testing.T, chain *Blockchain, wlt *wallet.Wallet, recipient *wallet.Wallet, amount int) *Block {
+	t.Helper()
+
+	payment, err := NewTransaction(wlt, testAddress(recipient), amount, 1, NewUTXOSet(chain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := newTestBlock(t, chain, chain.LastHash, newTestCoinbase(t, chain, wlt, height+1, 1, "payment"), payment)
+	if err = chain.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+
+	return block
+}
+
+func TestDisconnectRestoresUTXOSet(t *testing.T) {
+	chain, wlt := newTestChain(t)
+	recipient, err := wallet.MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := utxoSnapshot(t, chain)
+
+	var blocks []*Block
+	blocks = append(blocks, addTestBranch(t, chain, wlt, chain.LastHash, 2, "connected")...)
+	blocks = append(blocks, addTestPayment(t, chain, wlt, recipient, 10))
+	blocks = append(blocks, addTestPayment(t, chain, recipient, wlt, 4))
+	if reflect.DeepEqual(utxoSnapshot(t, chain), before) {
+		t.Fatal("connecting blocks did not change the UTXO set")
+	}
+
+	utxoSet := NewUTXOSet(chain)
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if err = utxoSet.Disconnect(blocks[i]); err != nil {
+			t.Fatalf("disconnecting block %d: %v", i, err)
+		}
+	}
+	if after := utxoSnapshot(t, chain); !reflect.DeepEqual(after, before) {
+		t.Errorf("UTXO set after disconnecting %d blocks has %d entries, want the %d it started with", len(blocks), len(after), len(before))
+	}
+}
+
+func TestRollbackToRestoresChain(t *testing.T) {
+	chain, wlt := newTestChain(t)
+	recipient, err := wallet.MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := addTestBranch(t, chain, wlt, chain.LastHash, 1, "kept")
+	before := utxoSnapshot(t, chain)
+
+	rolledBack := addTestBranch(t, chain, wlt, chain.LastHash, 1, "rolled back")
+	rolledBack = append(rolledBack, addTestPayment(t, chain, wlt, recipient, 10))
+	rolledBack = append(rolledBack, addTestPayment(t, chain, recipient, wlt, 4))
+
+	blocks, err := chain.RollbackTo(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != len(rolledBack) {
+		t.Fatalf("RollbackTo() returned %d blocks, want %d", len(blocks), len(rolledBack))
+	}
+	for i, block := range blocks {
+		if want := rolledBack[len(rolledBack)-1-i]; !bytes.Equal(block.Hash, want.Hash) {
+			t.Errorf("block %d is %x, want %x, newest first", i, block.Hash, want.Hash)
+		}
+	}
+	if !bytes.Equal(chain.LastHash, kept[0].Hash) {
+		t.Errorf("tip is %x, want %x", chain.LastHash, kept[0].Hash)
+	}
+	if height, err := chain.GetBestHeight(); err != nil || height != 1 {
+		t.Errorf("best height is %d, %v, want 1", height, err)
+	}
+	if !reflect.DeepEqual(utxoSnapshot(t, chain), before) {
+		t.Error("UTXO set after the rollback differs from the one at its height")
+	}
+	if _, err = chain.FindTransaction(rolledBack[1].Transactions[1].ID); err == nil {
+		t.Error("a rolled back transaction is still indexed")
+	}
+
+	// The chain can be extended again from the rolled back tip.
+	addTestBranch(t, chain, wlt, chain.LastHash, 1, "again")
+	if err = chain.ValidateFrom(context.Background(), 0); err != nil {
+		t.Error(err)
+	}
+	if _, err = chain.RollbackTo(5); err == nil {
+		t.Error("RollbackTo() above the tip succeeded")
+	}
+}
+
+func TestInvalidateBlockMovesToBestValidTip(t *testing.T) {
+	chain, wlt := newTestChain(t)
+	genesis := chain.LastHash
+	main := addTestBranch(t, chain, wlt, genesis, 3, "main")
+	side := addTestBranch(t, chain, wlt, genesis, 2, "side")
+
+	// What is left of the main chain has as much work as the side branch.
+	blocks, err := chain.InvalidateBlock(main[2].Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(chain.LastHash, main[1].Hash) || len(blocks) != 1 {
+		t.Fatalf("tip is %x after disconnecting %d blocks, want %x after 1", chain.LastHash, len(blocks), main[1].Hash)
+	}
+
+	blocks, err = chain.InvalidateBlock(main[0].Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(chain.LastHash, side[1].Hash) {
+		t.Errorf("tip is %x, want the side branch %x", chain.LastHash, side[1].Hash)
+	}
+	if len(blocks) != 2 || !bytes.Equal(blocks[0].Hash, main[1].Hash) || !bytes.Equal(blocks[1].Hash, main[0].Hash) {
+		t.Errorf("InvalidateBlock() returned %d blocks, want the 2 left of the main chain, newest first", len(blocks))
+	}
+	if height, err := chain.GetBestHeight(); err != nil || height != 2 {
+		t.Errorf("best height is %d, %v, want 2", height, err)
+	}
+	if err = chain.ValidateFrom(context.Background(), 0); err != nil {
+		t.Error(err)
+	}
+
+	child := newTestBlock(t, chain, main[1].Hash, newTestCoinbase(t, chain, wlt, 3, 0, "child"))
+	if err = chain.AddBlock(child); !errors.Is(err, ErrInvalidParent) {
+		t.Errorf("AddBlock() on an invalidated block = %v, want %v", err, ErrInvalidParent)
+	}
+}
@@ -0,0 +1,501 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+
+	"gambim.com/blockchain/storage"
+)
+
+var (
+	ErrMissingBlock       = errors.New("block is missing from the database")
+	ErrBadBlockHash       = errors.New("block hash does not match its header")
+	ErrBadPrevHash        = errors.New("previous hash does not match the parent block")
+	ErrBadHeight          = errors.New("block height does not follow the parent block")
+	ErrBadProofOfWork     = errors.New("block hash does not satisfy the proof of work")
+	ErrBadDifficulty      = errors.New("block bits do not match the expected difficulty")
+	ErrBadMerkleRoot      = errors.New("merkle root does not match the block transactions")
+	ErrDuplicateTx        = errors.New("block contains the same transaction twice")
+	ErrTxExists           = errors.New("transaction ID already has unspent outputs")
+	ErrBadCoinbase        = errors.New("invalid coinbase transaction")
+	ErrBadTransactionID   = errors.New("transaction ID does not match its contents")
+	ErrBadOutputValue     = errors.New("transaction output value is out of range")
+	ErrBadSignature       = errors.New("invalid transaction signature")
+	ErrMissingInput       = errors.New("transaction input references an unknown output")
+	ErrDoubleSpend        = errors.New("transaction input references a spent output")
+	ErrInsufficientInputs = errors.New("transaction outputs exceed its inputs")
+	ErrUTXOMismatch       = errors.New("UTXO set does not match the chain")
+)
+
+// IsConsensusError reports whether err means a block or transaction breaks
+// the consensus rules, rather than that it could not be checked.
+func IsConsensusError(err error) bool {
+	for _, consensusErr := range []error{
+		ErrBadBlockHash, ErrBadPrevHash, ErrBadHeight, ErrBadProofOfWork, ErrBadDifficulty,
+		ErrBadMerkleRoot, ErrDuplicateTx, ErrTxExists, ErrBadCoinbase, ErrBadTransactionID, ErrBadOutputValue,
+		ErrBadSignature, ErrMissingInput, ErrDoubleSpend, ErrInsufficientInputs, ErrInvalidParent,
+	} {
+		if errors.Is(err, consensusErr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type ValidationError struct {
+	Height int
+	Hash   []byte
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("block %d (%x): %v", e.Height, e.Hash, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+type outputLookup func(input TxInput) (TxOutput, error)
+
+// outputsValue adds up the values of outputs, reporting false if the total
+// does not fit in an int.
+func outputsValue(outputs []TxOutput) (int, bool) {
+	total := 0
+	for _, output := range outputs {
+		if output.Value > math.MaxInt-total {
+			return 0, false
+		}
+		total += output.Value
+	}
+
+	return total, true
+}
+
+func checkTransaction(transaction *Transaction, lookup outputLookup) (int, error) {
+	if !bytes.Equal(transaction.ID, transaction.Hash()) {
+		return 0, fmt.Errorf("transaction %x: %w", transaction.ID, ErrBadTransactionID)
+	}
+
+	for _, output := range transaction.Outputs {
+		if output.Value <= 0 {
+			return 0, fmt.Errorf("transaction %x: %w", transaction.ID, ErrBadOutputValue)
+		}
+	}
+
+	if transaction.IsCoinBase() {
+		return 0, nil
+	}
+	outputTotal, ok := outputsValue(transaction.Outputs)
+	if !ok {
+		return 0, fmt.Errorf("transaction %x: %w", transaction.ID, ErrBadOutputValue)
+	}
+	if len(transaction.Inputs) == 0 {
+		return 0, fmt.Errorf("transaction %x: %w", transaction.ID, ErrMissingInput)
+	}
+
+	inputTotal := 0
+	seen := make(map[string]bool)
+	var prevOutputs []TxOutput
+	for _, input := range transaction.Inputs {
+		outpoint := fmt.Sprintf("%x:%d", input.ID, input.OutputIndex)
+		if seen[outpoint] {
+			return 0, fmt.Errorf("transaction %x: %w", transaction.ID, ErrDoubleSpend)
+		}
+		seen[outpoint] = true
+
+		output, err := lookup(input)
+		if err != nil {
+			return 0, fmt.Errorf("transaction %x: %w", transaction.ID, err)
+		}
+		if !input.UsesKey(output.PublicKeyHash) {
+			return 0, fmt.Errorf("transaction %x: %w", transaction.ID, ErrBadSignature)
+		}
+		inputTotal += output.Value
+		prevOutputs = append(prevOutputs, output)
+	}
+
+	if outputTotal > inputTotal {
+		return 0, fmt.Errorf("transaction %x: %w", transaction.ID, ErrInsufficientInputs)
+	}
+	if !transaction.VerifyOutputs(prevOutputs) {
+		return 0, fmt.Errorf("transaction %x: %w", transaction.ID, ErrBadSignature)
+	}
+
+	return inputTotal - outputTotal, nil
+}
+
+func checkCoinbase(transactions []*Transaction, height int, fees int, policy MonetaryPolicy) error {
+	for i, transaction := range transactions {
+		if transaction.IsCoinBase() && i != 0 {
+			return ErrBadCoinbase
+		}
+	}
+	if len(transactions) == 0 || !transactions[0].IsCoinBase() {
+		return ErrBadCoinbase
+	}
+
+	reward, ok := outputsValue(transactions[0].Outputs)
+	if !ok || reward > policy.SubsidyAtHeight(height)+fees {
+		return ErrBadCoinbase
+	}
+
+	return nil
+}
+
+func checkBlockHeader(block *Block, prevHash []byte, prevHeader *BlockHeader, expectedBits int) error {
+	if err := checkHeader(&block.BlockHeader, block.Hash, prevHash, prevHeader, expectedBits); err != nil {
+		return err
+	}
+	if !bytes.Equal(block.MerkleRoot, block.HashTransactions()) {
+		return ErrBadMerkleRoot
+	}
+
+	// The merkle tree pairs an odd transaction with itself, so repeating the
+	// last transactions gives the same root. Such a copy, or one whose
+	// transactions do not match their IDs, is a mutated version of a block
+	// that may be valid, and is rejected before anything about its hash is
+	// stored.
+	seen := make(map[string]bool)
+	for _, transaction := range block.Transactions {
+		if seen[string(transaction.ID)] {
+			return ErrDuplicateTx
+		}
+		seen[string(transaction.ID)] = true
+		if !bytes.Equal(transaction.ID, transaction.Hash()) {
+			return fmt.Errorf("transaction %x: %w", transaction.ID, ErrBadTransactionID)
+		}
+	}
+
+	return nil
+}
+
+// checkHeader checks what can be checked without the block's transactions:
+// the link to the parent, the difficulty and the proof of work.
+func checkHeader(header *BlockHeader, hash []byte, prevHash []byte, prevHeader *BlockHeader, expectedBits int) error {
+	if !bytes.Equal(header.PrevHash, prevHash) {
+		return ErrBadPrevHash
+	}
+	if prevHeader == nil && header.Height != 0 {
+		return ErrBadHeight
+	}
+	if prevHeader != nil && header.Height != prevHeader.Height+1 {
+		return ErrBadHeight
+	}
+	if header.Bits != expectedBits {
+		return ErrBadDifficulty
+	}
+
+	proofOfWork := NewProof(&Block{BlockHeader: *header})
+	if !bytes.Equal(proofOfWork.Hash(), hash) {
+		return ErrBadBlockHash
+	}
+	if !proofOfWork.Validate() {
+		return ErrBadProofOfWork
+	}
+
+	return nil
+}
+
+func (chain *Blockchain) ValidateTransaction(transaction *Transaction) error {
+	_, err := chain.ValidateTransactionFee(transaction)
+	return err
+}
+
+func (chain *Blockchain) ValidateTransactionFee(transaction *Transaction) (int, error) {
+	if transaction.IsCoinBase() {
+		return 0, fmt.Errorf("transaction %x: %w", transaction.ID, ErrBadCoinbase)
+	}
+
+	return chain.validateTransactions([]*Transaction{transaction})
+}
+
+func (chain *Blockchain) validateTransactions(transactions []*Transaction) (int, error) {
+	var fees int
+
+	err := chain.Database.View(func(tx storage.Tx) error {
+		var err error
+		fees, err = checkTransactions(tx, transactions)
+		return err
+	})
+
+	var missing *missingInputError
+	if errors.As(err, &missing) {
+		prevTransaction, findErr := chain.FindTransaction(missing.Input.ID)
+		if findErr == nil && missing.Input.OutputIndex >= 0 && missing.Input.OutputIndex < len(prevTransaction.Outputs) {
+			return 0, fmt.Errorf("transaction %x: %w", missing.Spender, ErrDoubleSpend)
+		}
+	}
+
+	return fees, err
+}
+
+type missingInputError struct {
+	Spender []byte
+	Input   TxInput
+}
+
+func (e *missingInputError) Error() string {
+	return fmt.Sprintf("transaction %x: %v", e.Spender, ErrMissingInput)
+}
+
+func (e *missingInputError) Unwrap() error {
+	return ErrMissingInput
+}
+
+func checkTransactions(tx storage.Tx, transactions []*Transaction) (int, error) {
+	fees := 0
+	spent := make(map[string]bool)
+	created := make(map[string]TxOutputs)
+
+	bucket := tx.Bucket(utxoBucket)
+	if bucket == nil {
+		return 0, storage.ErrBucketNotFound
+	}
+
+	lookup := func(input TxInput) (TxOutput, error) {
+		if spent[fmt.Sprintf("%x:%d", input.ID, input.OutputIndex)] {
+			return TxOutput{}, ErrDoubleSpend
+		}
+		if outputs, ok := created[hex.EncodeToString(input.ID)]; ok {
+			if output, ok := outputs.Find(input.OutputIndex); ok {
+				return output, nil
+			}
+		}
+		if item := bucket.Get(input.ID); item != nil {
+			outputs, err := DeserializeOutputs(item)
+			if err != nil {
+				return TxOutput{}, err
+			}
+			if output, ok := outputs.Find(input.OutputIndex); ok {
+				return output, nil
+			}
+		}
+		return TxOutput{}, ErrMissingInput
+	}
+
+	for _, transaction := range transactions {
+		// Its outputs would replace the unspent ones, and be lost when
+		// the block is disconnected.
+		if bucket.Get(transaction.ID) != nil {
+			return 0, fmt.Errorf("transaction %x: %w", transaction.ID, ErrTxExists)
+		}
+		var missing *TxInput
+		fee, err := checkTransaction(transaction, func(input TxInput) (TxOutput, error) {
+			output, err := lookup(input)
+			if errors.Is(err, ErrMissingInput) {
+				missing = &input
+			}
+			return output, err
+		})
+		if missing != nil {
+			return 0, &missingInputError{Spender: transaction.ID, Input: *missing}
+		}
+		if err != nil {
+			return 0, err
+		}
+		fees += fee
+
+		if !transaction.IsCoinBase() {
+			for _, input := range transaction.Inputs {
+				spent[fmt.Sprintf("%x:%d", input.ID, input.OutputIndex)] = true
+			}
+		}
+		outputs := TxOutputs{}
+		for outputIndex, output := range transaction.Outputs {
+			outputs.Add(outputIndex, output)
+		}
+		created[hex.EncodeToString(transaction.ID)] = outputs
+	}
+
+	return fees, nil
+}
+
+func (chain *Blockchain) mainChainHashes() ([][]byte, error) {
+	var hashes [][]byte
+
+	hash := chain.LastHash
+	for len(hash) != 0 {
+		block, err := chain.GetBlock(hash)
+		if err != nil {
+			height := -1
+			if len(hashes) > 0 {
+				header, _ := chain.GetBlockHeader(hashes[len(hashes)-1])
+				height = header.Height - 1
+			}
+			return nil, &ValidationError{Height: height, Hash: hash, Err: ErrMissingBlock}
+		}
+		hashes = append(hashes, hash)
+		hash = block.PrevHash
+	}
+
+	for i, j := 0, len(hashes)-1; i < j; i, j = i+1, j-1 {
+		hashes[i], hashes[j] = hashes[j], hashes[i]
+	}
+
+	return hashes, nil
+}
+
+func (chain *Blockchain) Validate(ctx context.Context) error {
+	return chain.ValidateFrom(ctx, 0)
+}
+
+func (chain *Blockchain) ValidateFrom(ctx context.Context, fromHeight int) error {
+	var headers []BlockHeader
+	var tip *Block
+	utxos := make(map[string]TxOutputs)
+	spent := make(map[string]bool)
+
+	lookup := func(input TxInput) (TxOutput, error) {
+		outpoint := fmt.Sprintf("%x:%d", input.ID, input.OutputIndex)
+		output, ok := utxos[hex.EncodeToString(input.ID)].Find(input.OutputIndex)
+		if ok {
+			return output, nil
+		}
+		if spent[outpoint] {
+			return TxOutput{}, ErrDoubleSpend
+		}
+		return TxOutput{}, ErrMissingInput
+	}
+
+	hashes, err := chain.mainChainHashes()
+	if err != nil {
+		return err
+	}
+
+	for height, hash := range hashes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		block, err := chain.GetBlock(hash)
+		if err != nil {
+			return &ValidationError{Height: height, Hash: hash, Err: err}
+		}
+		if !bytes.Equal(block.Hash, hash) {
+			return &ValidationError{Height: height, Hash: hash, Err: ErrBadBlockHash}
+		}
+
+		if height >= fromHeight {
+			var prevHash []byte
+			var prevHeader *BlockHeader
+			expectedBits := chain.Params.InitialDifficulty
+			if height > 0 {
+				prevHash = hashes[height-1]
+				prevHeader = &headers[height-1]
+				expectedBits = prevHeader.Bits
+				if height%chain.Params.RetargetInterval == 0 {
+					firstHeader := headers[height-chain.Params.RetargetInterval]
+					expectedBits = CalculateNextDifficulty(chain.Params, prevHeader.Bits, prevHeader.Timestamp-firstHeader.Timestamp)
+				}
+			}
+
+			if err := checkBlockHeader(&block, prevHash, prevHeader, expectedBits); err != nil {
+				return &ValidationError{Height: height, Hash: hash, Err: err}
+			}
+		}
+
+		fees := 0
+		for _, transaction := range block.Transactions {
+			if height >= fromHeight {
+				if _, exists := utxos[hex.EncodeToString(transaction.ID)]; exists {
+					return &ValidationError{Height: height, Hash: hash, Err: ErrTxExists}
+				}
+				fee, err := checkTransaction(transaction, lookup)
+				if err != nil {
+					return &ValidationError{Height: height, Hash: hash, Err: err}
+				}
+				fees += fee
+			}
+
+			if !transaction.IsCoinBase() {
+				for _, input := range transaction.Inputs {
+					transactionId := hex.EncodeToString(input.ID)
+					remaining := TxOutputs{}
+					for position, output := range utxos[transactionId].Outputs {
+						if utxos[transactionId].Index(position) != input.OutputIndex {
+							remaining.Add(utxos[transactionId].Index(position), output)
+						}
+					}
+					if len(remaining.Outputs) == 0 {
+						delete(utxos, transactionId)
+					} else {
+						utxos[transactionId] = remaining
+					}
+					spent[fmt.Sprintf("%x:%d", input.ID, input.OutputIndex)] = true
+				}
+			}
+
+			outputs := TxOutputs{}
+			for outputIndex, output := range transaction.Outputs {
+				outputs.Add(outputIndex, output)
+			}
+			utxos[hex.EncodeToString(transaction.ID)] = outputs
+		}
+
+		if height >= fromHeight {
+			if err := checkCoinbase(block.Transactions, block.Height, fees, chain.MonetaryPolicy()); err != nil {
+				return &ValidationError{Height: height, Hash: hash, Err: err}
+			}
+		}
+
+		headers = append(headers, block.BlockHeader)
+		tip = &block
+	}
+
+	if tip == nil {
+		return nil
+	}
+	if err := chain.checkUTXOSet(utxos); err != nil {
+		return &ValidationError{Height: tip.Height, Hash: tip.Hash, Err: err}
+	}
+
+	return nil
+}
+
+func (chain *Blockchain) checkUTXOSet(utxos map[string]TxOutputs) error {
+	return chain.Database.View(func(tx storage.Tx) error {
+		bucket := tx.Bucket(utxoBucket)
+		if bucket == nil {
+			return fmt.Errorf("%w: %v", ErrUTXOMismatch, storage.ErrBucketNotFound)
+		}
+
+		stored := 0
+		err := bucket.ForEach(func(key []byte, item []byte) error {
+			stored++
+			transactionId := hex.EncodeToString(key)
+			expected, ok := utxos[transactionId]
+			if !ok {
+				return fmt.Errorf("%w: unexpected outputs of transaction %s", ErrUTXOMismatch, transactionId)
+			}
+
+			outputs, err := DeserializeOutputs(item)
+			if err != nil {
+				return err
+			}
+			if len(outputs.Outputs) != len(expected.Outputs) {
+				return fmt.Errorf("%w: outputs of transaction %s differ", ErrUTXOMismatch, transactionId)
+			}
+			for position, output := range outputs.Outputs {
+				expectedOutput, ok := expected.Find(outputs.Index(position))
+				if !ok || expectedOutput.Value != output.Value || !bytes.Equal(expectedOutput.PublicKeyHash, output.PublicKeyHash) {
+					return fmt.Errorf("%w: outputs of transaction %s differ", ErrUTXOMismatch, transactionId)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if stored != len(utxos) {
+			return fmt.Errorf("%w: %d transactions stored, %d expected", ErrUTXOMismatch, stored, len(utxos))
+		}
+
+		return nil
+	})
+}
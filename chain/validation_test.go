@@ -0,0 +1,143 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"testing"
+
+	"gambim.com/blockchain/params"
+	"gambim.com/blockchain/storage"
+	"gambim.com/blockchain/wallet"
+)
+
+func testAddress(wlt *wallet.Wallet) string {
+	return string(wallet.EncodeAddress(wallet.PublicKeyHash(wlt.PublicKey), params.RegTest.AddressVersion))
+}
+
+func newTestChain(t *testing.T) (*Blockchain, *wallet.Wallet) {
+	t.Helper()
+
+	wlt, err := wallet.MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := CreateBlockchain(storage.NewMemory(), &params.RegTest, testAddress(wlt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { chain.Database.Close() })
+
+	return chain, wlt
+}
+
+// newTestCoinbase pays the subsidy at height and fees to wlt. Coinbases
+// with the same data at the same value are the same transaction.
+func newTestCoinbase(t *testing.T, chain *Blockchain, wlt *wallet.Wallet, height int, fees int, data string) *Transaction {
+	t.Helper()
+
+	coinbase, err := CoinBaseTx(testAddress(wlt), params.RegTest.AddressVersion, data, chain.MonetaryPolicy().SubsidyAtHeight(height)+fees)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return coinbase
+}
+
+// newTestBlock mines a block of transactions on prevHash, without adding
+// it to the chain.
+func newTestBlock(t *testing.T, chain *Blockchain, prevHash []byte, transactions ...*Transaction) *Block {
+	t.Helper()
+
+	prevHeader, err := chain.GetBlockHeader(prevHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bits, err := chain.NextDifficulty(prevHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := NewBlock(transactions, prevHash, prevHeader.Height+1, bits)
+	if block.Nounce, block.Hash, err = NewProof(block).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return block
+}
+
+func TestTransactionOutputsMustNotOverflow(t *testing.T) {
+	chain, wlt := newTestChain(t)
+	genesis, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase := genesis.Transactions[0]
+	publicKeyHash := wallet.PublicKeyHash(wlt.PublicKey)
+
+	// The outputs add up to 0 once the total wraps around.
+	transaction := &Transaction{
+		Inputs: []TxInput{{ID: coinbase.ID, OutputIndex: 0, PublicKey: wlt.PublicKey}},
+		Outputs: []TxOutput{
+			{Value: math.MaxInt64, PublicKeyHash: publicKeyHash},
+			{Value: math.MaxInt64, PublicKeyHash: publicKeyHash},
+			{Value: 2, PublicKeyHash: publicKeyHash},
+		},
+	}
+	transaction.SetID()
+	if err = chain.SignTransaction(transaction, wlt.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = chain.ValidateTransaction(transaction); !errors.Is(err, ErrBadOutputValue) {
+		t.Fatalf("ValidateTransaction() = %v, want %v", err, ErrBadOutputValue)
+	}
+}
+
+func TestCoinbaseOutputsMustNotOverflow(t *testing.T) {
+	chain, wlt := newTestChain(t)
+	publicKeyHash := wallet.PublicKeyHash(wlt.PublicKey)
+
+	// The reward wraps around to a negative total, below the subsidy.
+	coinbase := &Transaction{
+		Inputs: []TxInput{{ID: []byte{}, OutputIndex: -1, PublicKey: []byte("overflow")}},
+		Outputs: []TxOutput{
+			{Value: math.MaxInt64, PublicKeyHash: publicKeyHash},
+			{Value: math.MaxInt64, PublicKeyHash: publicKeyHash},
+		},
+	}
+	coinbase.SetID()
+	block := newTestBlock(t, chain, chain.LastHash, coinbase)
+
+	if err := chain.AddBlock(block); !errors.Is(err, ErrBadCoinbase) {
+		t.Fatalf("AddBlock() = %v, want %v", err, ErrBadCoinbase)
+	}
+}
+
+func TestTransactionMustNotReplaceUnspentOutputs(t *testing.T) {
+	chain, wlt := newTestChain(t)
+	first := newTestBlock(t, chain, chain.LastHash, newTestCoinbase(t, chain, wlt, 1, 0, "reused"))
+	if err := chain.AddBlock(first); err != nil {
+		t.Fatal(err)
+	}
+	before, err := NewUTXOSet(chain).TotalValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same coinbase again, byte for byte, would overwrite the first.
+	second := newTestBlock(t, chain, chain.LastHash, newTestCoinbase(t, chain, wlt, 2, 0, "reused"))
+	if err = chain.AddBlock(second); !errors.Is(err, ErrTxExists) {
+		t.Fatalf("AddBlock() = %v, want %v", err, ErrTxExists)
+	}
+	if !bytes.Equal(chain.LastHash, first.Hash) {
+		t.Errorf("tip is %x, want %x", chain.LastHash, first.Hash)
+	}
+	after, err := NewUTXOSet(chain).TotalValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after != before {
+		t.Errorf("UTXO set holds %d after the rejected block, want %d", after, before)
+	}
+}
@@ -1,220 +1,868 @@
 package client
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
 	"os"
+	"os/signal"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	blockchain "gambim.com/blockchain/chain"
+	"gambim.com/blockchain/mempool"
+	"gambim.com/blockchain/miner"
+	"gambim.com/blockchain/network"
+	"gambim.com/blockchain/params"
 	"gambim.com/blockchain/wallet"
 )
 
-type CommandLine struct{}
+type CommandLine struct {
+	DataDir string
+	Params  *params.Params
+}
 
 func (cli *CommandLine) PrintUsage() {
-	fmt.Println("Usage:")
+	fmt.Println("Usage: [-datadir DIR] [-network mainnet|testnet|regtest] COMMAND")
 	fmt.Println("getbalance -address ADDRESS - Get the balance")
-	fmt.Println("createblockchain -address ADDRESS - Creates a blockchain")
-	fmt.Println("printchain - Prints the block in the chain")
-	fmt.Println("send -from FROM -to TO -amount AMOUNT - Send amount")
+	fmt.Println("createblockchain -address ADDRESS [-txindex] - Creates a blockchain")
+	fmt.Println("printchain [-height HEIGHT | -hash HASH | -from FROM -to TO] - Prints the blocks in the chain")
+	fmt.Println("send -from FROM -to TO -amount AMOUNT -fee FEE [-nomine] [-peers HOST:PORT,...] - Send amount paying FEE to the miner, relaying it to the peers")
+	fmt.Println("mine -address ADDRESS -blocks BLOCKS -workers WORKERS - Mines blocks with mempool transactions, rewarding ADDRESS")
+	fmt.Println("history -address ADDRESS -offset OFFSET -limit LIMIT - Lists the transactions of ADDRESS, newest first")
+	fmt.Println("estimatefee -blocks BLOCKS - Estimates the fee rate from the last BLOCKS blocks")
 	fmt.Println("createwallet - Creates a new Wallet")
 	fmt.Println("listaddresses - List the addresses in our wallet file")
 	fmt.Println("reindexutxo - Rebuilds the UTXO set")
+	fmt.Println("reindextx [-drop] - Builds the transaction index (or removes it)")
+	fmt.Println("gettransaction -id ID - Prints a transaction and the block containing it")
+	fmt.Println("supply - Reports the circulating supply against the subsidy schedule")
+	fmt.Println("verifychain -from-height HEIGHT - Validates the stored chain from genesis (checks from HEIGHT)")
+	fmt.Println("rollback -height HEIGHT - Disconnects blocks above HEIGHT, returning their transactions to the mempool")
+	fmt.Println("invalidateblock -hash HASH - Marks a block and its descendants invalid and disconnects them")
+	fmt.Println("startnode -port PORT -peers HOST:PORT,... -seednodes FILE [-genesis HASH] [-mine ADDRESS -workers WORKERS] -rpcport PORT -rpcuser USER -rpcpassword PASSWORD -restport PORT - Runs a node that syncs with its peers, serving JSON-RPC and optionally REST")
+	fmt.Println("rpc -rpcport PORT -rpcuser USER -rpcpassword PASSWORD METHOD [PARAMS...] - Calls a method on a running node")
+	fmt.Println("getpeerinfo -rpcport PORT -rpcuser USER -rpcpassword PASSWORD - Lists the peers of a running node")
 }
 
-func (cli *CommandLine) ValidateArgs() {
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+// errUsage is returned by commands after they have printed their usage.
+var errUsage = errors.New("invalid arguments")
+
+func (cli *CommandLine) ValidateArgs() error {
 	if len(os.Args) < 2 {
 		cli.PrintUsage()
-		runtime.Goexit()
+		return errUsage
 	}
+
+	return nil
 }
 
-func (cli *CommandLine) listWallets() {
-	wallets, _ := wallet.CreateWallets()
+func (cli *CommandLine) parseGlobalFlags() ([]string, error) {
+	globalCmd := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	dataDir := globalCmd.String("datadir", "tmp", "Directory holding the chain and wallets")
+	network := globalCmd.String("network", params.MainNet.Name, "Network to use: mainnet, testnet or regtest")
+	err := globalCmd.Parse(os.Args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	cli.Params, err = params.ByName(*network)
+	if err != nil {
+		return nil, err
+	}
+	cli.DataDir = cli.Params.DataDir(*dataDir)
+
+	args := globalCmd.Args()
+	if len(args) < 1 {
+		cli.PrintUsage()
+		return nil, errUsage
+	}
+
+	return args, nil
+}
+
+func (cli *CommandLine) continueBlockchain() (*blockchain.Blockchain, error) {
+	return blockchain.ContinueBlockchain(cli.DataDir, cli.Params)
+}
+
+func (cli *CommandLine) validateAddress(address string) error {
+	_, err := wallet.DecodeAddress(address, cli.Params.AddressVersion)
+	return err
+}
+
+func (cli *CommandLine) publicKeyHash(address string) ([]byte, error) {
+	return wallet.DecodeAddress(address, cli.Params.AddressVersion)
+}
+
+func (cli *CommandLine) listWallets() error {
+	wallets, err := wallet.CreateWallets(cli.DataDir, cli.Params.AddressVersion)
+	if err != nil {
+		return err
+	}
 	addresses := wallets.GetAllAddresses()
 
 	for _, address := range addresses {
 		fmt.Println(address)
 	}
+
+	return nil
 }
 
-func (cli *CommandLine) reindexutxo() {
-	chain := blockchain.ContinueBlockchain("")
+func (cli *CommandLine) reindexutxo() error {
+	chain, err := cli.continueBlockchain()
+	if err != nil {
+		return err
+	}
 	defer chain.Database.Close()
 	utxoSet := blockchain.NewUTXOSet(chain)
-	utxoSet.Reindex()
+	if err = utxoSet.Reindex(); err != nil {
+		return err
+	}
 
-	count := utxoSet.CountTransactions()
+	count, err := utxoSet.CountTransactions()
+	if err != nil {
+		return err
+	}
 	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
+
+	return nil
+}
+
+func (cli *CommandLine) reindexTransactions(drop bool) error {
+	chain, err := cli.continueBlockchain()
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	if drop {
+		if err = chain.DropTxIndex(); err != nil {
+			return err
+		}
+		fmt.Println("Transaction index removed")
+		return nil
+	}
+
+	count, err := chain.ReindexTransactions()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Done! There are %d transactions in the transaction index.\n", count)
+
+	return nil
 }
 
-func (cli *CommandLine) createNewWalletCmd() {
-	wallets, _ := wallet.CreateWallets()
-	address := wallets.AddWallet()
-	wallets.SaveFile()
+func (cli *CommandLine) getTransaction(id string) error {
+	transactionId, err := hex.DecodeString(id)
+	if err != nil {
+		return fmt.Errorf("invalid transaction ID: %w", err)
+	}
+
+	chain, err := cli.continueBlockchain()
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	tx, block, err := chain.GetTransaction(transactionId)
+	if err != nil {
+		return fmt.Errorf("transaction lookup failed: %w", err)
+	}
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Block: %x (height %d, %d confirmations)\n", block.Hash, block.Height, bestHeight-block.Height+1)
+	fmt.Println(tx.String())
+
+	return nil
+}
+
+func (cli *CommandLine) verifyChain(fromHeight int) error {
+	chain, err := cli.continueBlockchain()
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err = chain.ValidateFrom(ctx, fromHeight); err != nil {
+		return fmt.Errorf("chain is invalid: %w", err)
+	}
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Chain is valid up to height %d\n", bestHeight)
+
+	return nil
+}
+
+func (cli *CommandLine) restoreTransactions(utxoSet *blockchain.UTXOSet, blocks []*blockchain.Block) error {
+	pool := mempool.New(utxoSet, mempool.DefaultConfig)
+	err := pool.Load()
+	if err != nil {
+		return err
+	}
+
+	restored := 0
+	for i := len(blocks) - 1; i >= 0; i-- {
+		for _, tx := range blocks[i].Transactions {
+			if tx.IsCoinBase() {
+				continue
+			}
+			if pool.Add(tx) == nil {
+				restored++
+			}
+		}
+	}
+
+	if err = pool.Save(); err != nil {
+		return err
+	}
+	fmt.Printf("Disconnected %d blocks, returned %d transactions to the mempool\n", len(blocks), restored)
+
+	return nil
+}
+
+func (cli *CommandLine) printTip(chain *blockchain.Blockchain) error {
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Chain tip is now at height %d\n", bestHeight)
+
+	return nil
+}
+
+func (cli *CommandLine) rollback(height int) error {
+	chain, err := cli.continueBlockchain()
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	blocks, err := chain.RollbackTo(height)
+	if err != nil {
+		return fmt.Errorf("rollback failed: %w", err)
+	}
+
+	if err = cli.restoreTransactions(blockchain.NewUTXOSet(chain), blocks); err != nil {
+		return err
+	}
+	return cli.printTip(chain)
+}
+
+func (cli *CommandLine) invalidateBlock(hash string) error {
+	blockHash, err := hex.DecodeString(hash)
+	if err != nil {
+		return fmt.Errorf("invalid block hash: %w", err)
+	}
+
+	chain, err := cli.continueBlockchain()
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	blocks, err := chain.InvalidateBlock(blockHash)
+	if err != nil {
+		return fmt.Errorf("invalidation failed: %w", err)
+	}
+
+	if err = cli.restoreTransactions(blockchain.NewUTXOSet(chain), blocks); err != nil {
+		return err
+	}
+	return cli.printTip(chain)
+}
+
+func (cli *CommandLine) supply() error {
+	chain, err := cli.continueBlockchain()
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+	utxoSet := blockchain.NewUTXOSet(chain)
+
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+	circulating, err := utxoSet.TotalValue()
+	if err != nil {
+		return err
+	}
+	policy := chain.MonetaryPolicy()
+	scheduled := policy.ScheduledSupply(height)
+
+	fmt.Printf("Network: %s\n", chain.Params.Name)
+	fmt.Printf("Height: %d\n", height)
+	fmt.Printf("Circulating supply (UTXO set): %d\n", circulating)
+	fmt.Printf("Scheduled supply: %d\n", scheduled)
+	fmt.Printf("Unclaimed: %d\n", scheduled-circulating)
+	fmt.Printf("Max supply: %d\n", policy.MaxSupply)
+	fmt.Printf("Next block subsidy: %d\n", policy.SubsidyAtHeight(height+1))
+
+	return nil
+}
+
+func (cli *CommandLine) createNewWalletCmd() error {
+	wallets, err := wallet.CreateWallets(cli.DataDir, cli.Params.AddressVersion)
+	if err != nil {
+		return err
+	}
+	address, err := wallets.AddWallet()
+	if err != nil {
+		return err
+	}
+	if err = wallets.SaveFile(); err != nil {
+		return err
+	}
 	fmt.Printf("New address is: %s\n", address)
+
+	return nil
+}
+
+func (cli *CommandLine) printBlock(block *blockchain.Block) {
+	fmt.Printf("hash:%x  prev_hash:%x\n", block.Hash, block.PrevHash)
+	fmt.Printf("version:%d  height:%d  time:%s  bits:%d  nounce:%d\n",
+		block.Version, block.Height, time.Unix(block.Timestamp, 0).Format(time.RFC3339), block.Bits, block.Nounce)
+	fmt.Printf("merkle_root:%x\n", block.MerkleRoot)
+	fmt.Printf("PoW: %s\n", strconv.FormatBool(blockchain.NewProof(block).Validate()))
+	for _, tx := range block.Transactions {
+		fmt.Println(tx.String())
+	}
+	fmt.Println()
 }
 
-func (cli *CommandLine) printChain() {
-	chain := blockchain.ContinueBlockchain("")
+func (cli *CommandLine) printChain() error {
+	chain, err := cli.continueBlockchain()
+	if err != nil {
+		return err
+	}
 	defer chain.Database.Close()
 
 	iterator := chain.Iterator()
 	for len(iterator.IteratorHash) != 0 {
-		block := iterator.Next()
-		fmt.Printf("hash:%x  prev_hash:%x\n", block.Hash, block.PrevHash)
-		for _, tx := range block.Transactions {
-			fmt.Println(tx.String())
+		block, err := iterator.Next()
+		if err != nil {
+			return err
+		}
+		cli.printBlock(block)
+	}
+
+	return nil
+}
+
+func (cli *CommandLine) printBlockAt(height int, hash string) error {
+	chain, err := cli.continueBlockchain()
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	var block blockchain.Block
+	if hash != "" {
+		block, err = chain.GetBlockByHash(hash)
+	} else {
+		block, err = chain.GetBlockByHeight(height)
+	}
+	if err != nil {
+		return fmt.Errorf("block lookup failed: %w", err)
+	}
+
+	cli.printBlock(&block)
+
+	return nil
+}
+
+func (cli *CommandLine) printChainRange(from int, to int) error {
+	chain, err := cli.continueBlockchain()
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	iterator := chain.ForwardIterator(from)
+	for {
+		block, err := iterator.Next()
+		if err != nil {
+			return err
 		}
-		fmt.Println()
+		if block == nil || (to >= 0 && block.Height > to) {
+			return nil
+		}
+		cli.printBlock(block)
 	}
 }
 
-func (cli *CommandLine) createBlockchain(address string) {
-	if !wallet.ValidateAddress(address) {
-		log.Panic("Invalid Address")
+func (cli *CommandLine) createBlockchain(address string, txIndex bool) error {
+	if err := cli.validateAddress(address); err != nil {
+		return err
 	}
 
-	chain := blockchain.InitBlockchain(address)
+	chain, err := blockchain.InitBlockchain(cli.DataDir, cli.Params, address)
+	if err != nil {
+		return err
+	}
 	defer chain.Database.Close()
 
+	if txIndex {
+		if _, err = chain.ReindexTransactions(); err != nil {
+			return err
+		}
+	}
+
 	fmt.Println("Finished!")
+
+	return nil
 }
 
-func (cli *CommandLine) getbalance(address string) {
-	if !wallet.ValidateAddress(address) {
-		log.Panic("Invalid Address")
+func (cli *CommandLine) getbalance(address string) error {
+	publicKeyHash, err := cli.publicKeyHash(address)
+	if err != nil {
+		return err
 	}
 
-	chain := blockchain.ContinueBlockchain("")
+	chain, err := cli.continueBlockchain()
+	if err != nil {
+		return err
+	}
 	defer chain.Database.Close()
 	utxoSet := blockchain.NewUTXOSet(chain)
 
 	balance := 0
-	publicKeyFullHash := wallet.Base58Decode([]byte(address))
-	publicKeyHash := publicKeyFullHash[1 : len(publicKeyFullHash)-wallet.GetChecksumLength()]
-	UTXOs := utxoSet.FindUnspentTransactionOutputs(publicKeyHash)
+	UTXOs, err := utxoSet.FindUnspentTransactionOutputs(publicKeyHash)
+	if err != nil {
+		return err
+	}
 
 	for _, out := range UTXOs {
 		balance += out.Value
 	}
 
 	fmt.Printf("Balance of %s: %d\n", address, balance)
+
+	return nil
+}
+
+func (cli *CommandLine) history(address string, offset int, limit int) error {
+	publicKeyHash, err := cli.publicKeyHash(address)
+	if err != nil {
+		return err
+	}
+
+	chain, err := cli.continueBlockchain()
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	entries, total, err := chain.AddressHistory(publicKeyHash, offset, limit)
+	if err != nil {
+		return err
+	}
+
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("History of %s: showing %d of %d transactions\n", address, len(entries), total)
+	for _, entry := range entries {
+		var counterparties []string
+		for _, counterparty := range entry.Counterparties {
+			counterparties = append(counterparties, string(wallet.EncodeAddress(counterparty, cli.Params.AddressVersion)))
+		}
+		if entry.Coinbase {
+			counterparties = append(counterparties, "coinbase")
+		}
+
+		fmt.Printf("%x height:%d confirmations:%d %+d balance:%d\n",
+			entry.TransactionID, entry.Height, bestHeight-entry.Height+1, entry.Received-entry.Sent, entry.Balance)
+		if len(counterparties) > 0 {
+			fmt.Printf("    counterparties: %s\n", strings.Join(counterparties, ", "))
+		}
+	}
+
+	return nil
 }
 
-func (cli *CommandLine) send(from string, to string, amount int) {
-	if !wallet.ValidateAddress(to) {
-		log.Panic("Invalid Address")
+func (cli *CommandLine) estimateFee(blocks int) error {
+	chain, err := cli.continueBlockchain()
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	feeRate, err := chain.EstimateFeeRate(blocks)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Fee rate: %.4f per byte\n", feeRate)
+	fmt.Printf("Fee for a 1-input 2-output transaction: %d\n", blockchain.EstimateFee(feeRate, 1, 2))
+
+	return nil
+}
+
+func (cli *CommandLine) send(from string, to string, amount int, fee int, mineNow bool, peers []string) error {
+	if err := cli.validateAddress(to); err != nil {
+		return err
+	}
+	if err := cli.validateAddress(from); err != nil {
+		return err
+	}
+
+	wallets, err := wallet.CreateWallets(cli.DataDir, cli.Params.AddressVersion)
+	if err != nil {
+		return err
 	}
-	if !wallet.ValidateAddress(from) {
-		log.Panic("Invalid Address")
+	wlt, err := wallets.GetWallet(from)
+	if err != nil {
+		return err
 	}
 
-	chain := blockchain.ContinueBlockchain(from)
+	chain, err := cli.continueBlockchain()
+	if err != nil {
+		return err
+	}
 	defer chain.Database.Close()
 	utxoSet := blockchain.NewUTXOSet(chain)
 
-	tx := blockchain.NewTransaction(from, to, amount, utxoSet)
-	block := chain.AddBlock([]*blockchain.Transaction{tx})
-	utxoSet.Update(block)
+	pool := mempool.New(utxoSet, mempool.DefaultConfig)
+	if err = pool.Load(); err != nil {
+		return err
+	}
+	utxoSet.Exclude = pool.IsSpent
+
+	tx, err := blockchain.NewTransaction(&wlt, to, amount, fee, utxoSet)
+	if err != nil {
+		return err
+	}
+	if err = pool.Add(tx); err != nil {
+		return fmt.Errorf("transaction rejected: %w", err)
+	}
+	for _, peer := range peers {
+		if err = network.SendTransaction(cli.networkConfig(), peer, chain, tx); err != nil {
+			return fmt.Errorf("sending to %s: %w", peer, err)
+		}
+		fmt.Printf("Transaction %x sent to %s\n", tx.ID, peer)
+	}
+
+	if !mineNow {
+		if err = pool.Save(); err != nil {
+			return err
+		}
+		fmt.Printf("Transaction %x added to the mempool (%d pending)\n", tx.ID, pool.Count())
+		return nil
+	}
+
+	blockMiner := miner.New(utxoSet, pool, miner.Config{RewardAddress: from})
+	if _, err = blockMiner.MineBlock(context.Background()); err != nil {
+		return fmt.Errorf("block rejected: %w", err)
+	}
+	if err = pool.Save(); err != nil {
+		return err
+	}
+
+	fmt.Println("Success!")
 
-	fmt.Printf("Success!")
+	return nil
 }
 
-func (cli *CommandLine) Run() {
-	cli.ValidateArgs()
+func (cli *CommandLine) mine(address string, blocks int, workers int) error {
+	if err := cli.validateAddress(address); err != nil {
+		return err
+	}
+
+	chain, err := cli.continueBlockchain()
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+	utxoSet := blockchain.NewUTXOSet(chain)
 
-	getBalanceCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
-	createBlockchainCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
-	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
-	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
-	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
-	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
-	reindexCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	pool := mempool.New(utxoSet, mempool.DefaultConfig)
+	if err = pool.Load(); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	blockMiner := miner.New(utxoSet, pool, miner.Config{
+		RewardAddress: address,
+		Workers:       workers,
+		Progress: func(hashes uint64, hashrate float64) {
+			fmt.Printf("\r%d hashes (%.0f H/s)", hashes, hashrate)
+		},
+	})
+	var mineErr error
+	for i := 0; i < blocks; i++ {
+		block, err := blockMiner.MineBlock(ctx)
+		if err != nil {
+			fmt.Println()
+			mineErr = fmt.Errorf("mining failed: %w", err)
+			break
+		}
+		fmt.Printf("\rMined block %d: %x (%d transactions)\n", block.Height, block.Hash, len(block.Transactions))
+	}
+
+	if err = pool.Save(); err != nil {
+		return err
+	}
+
+	return mineErr
+}
+
+// Run executes the command in os.Args and returns the process exit code.
+func (cli *CommandLine) Run() int {
+	err := cli.run()
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.Is(err, errUsage):
+		return exitUsage
+	default:
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailure
+	}
+}
+
+func (cli *CommandLine) run() error {
+	if err := cli.ValidateArgs(); err != nil {
+		return err
+	}
+	args, err := cli.parseGlobalFlags()
+	if err != nil {
+		return err
+	}
+
+	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ContinueOnError)
+	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ContinueOnError)
+	sendCmd := flag.NewFlagSet("send", flag.ContinueOnError)
+	printChainCmd := flag.NewFlagSet("printchain", flag.ContinueOnError)
+	createWalletCmd := flag.NewFlagSet("createwallet", flag.ContinueOnError)
+	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ContinueOnError)
+	reindexCmd := flag.NewFlagSet("reindexutxo", flag.ContinueOnError)
+	verifyChainCmd := flag.NewFlagSet("verifychain", flag.ContinueOnError)
+	estimateFeeCmd := flag.NewFlagSet("estimatefee", flag.ContinueOnError)
+	supplyCmd := flag.NewFlagSet("supply", flag.ContinueOnError)
+	mineCmd := flag.NewFlagSet("mine", flag.ContinueOnError)
+	rollbackCmd := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	historyCmd := flag.NewFlagSet("history", flag.ContinueOnError)
+	reindexTxCmd := flag.NewFlagSet("reindextx", flag.ContinueOnError)
+	getTransactionCmd := flag.NewFlagSet("gettransaction", flag.ContinueOnError)
+	invalidateBlockCmd := flag.NewFlagSet("invalidateblock", flag.ContinueOnError)
+	startNodeCmd := flag.NewFlagSet("startnode", flag.ContinueOnError)
+	rpcCmd := flag.NewFlagSet("rpc", flag.ContinueOnError)
+	getPeerInfoCmd := flag.NewFlagSet("getpeerinfo", flag.ContinueOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "The wallet address")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The wallet address")
+	createBlockchainTxIndex := createBlockchainCmd.Bool("txindex", false, "Maintain a transaction index")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
-
-	switch os.Args[1] {
-	case "getbalance":
-		err := getBalanceCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
+	sendFee := sendCmd.Int("fee", 0, "Fee paid to the miner")
+	sendNoMine := sendCmd.Bool("nomine", false, "Only add the transaction to the mempool")
+	sendPeers := sendCmd.String("peers", "", "Comma separated nodes to relay the transaction to")
+	estimateFeeBlocks := estimateFeeCmd.Int("blocks", blockchain.FeeEstimateBlocks, "Number of recent blocks to sample")
+	mineAddress := mineCmd.String("address", "", "The reward address")
+	mineBlocks := mineCmd.Int("blocks", 1, "Number of blocks to mine")
+	mineWorkers := mineCmd.Int("workers", runtime.NumCPU(), "Number of proof of work goroutines")
+	verifyFromHeight := verifyChainCmd.Int("from-height", 0, "Height to start checking blocks from")
+	printChainHeight := printChainCmd.Int("height", -1, "Print only the block at HEIGHT")
+	printChainHash := printChainCmd.String("hash", "", "Print only the block whose hash starts with HASH")
+	printChainFrom := printChainCmd.Int("from", -1, "Print blocks starting at height FROM, oldest first")
+	printChainTo := printChainCmd.Int("to", -1, "Stop printing at height TO")
+	reindexTxDrop := reindexTxCmd.Bool("drop", false, "Remove the transaction index")
+	getTransactionId := getTransactionCmd.String("id", "", "The transaction ID")
+	historyAddress := historyCmd.String("address", "", "The wallet address")
+	historyOffset := historyCmd.Int("offset", 0, "Number of newest transactions to skip")
+	historyLimit := historyCmd.Int("limit", 20, "Maximum number of transactions to list (0 for all)")
+	rollbackHeight := rollbackCmd.Int("height", -1, "Height of the new chain tip")
+	invalidateBlockHash := invalidateBlockCmd.String("hash", "", "Hash of the block to invalidate")
+	startNodePort := startNodeCmd.Int("port", 0, "Port for peer connections (defaults to the network's port)")
+	startNodePeers := startNodeCmd.String("peers", "", "Comma separated nodes to connect to")
+	startNodeSeedNodes := startNodeCmd.String("seednodes", "", "File of node addresses to learn at start, one per line")
+	startNodeGenesis := startNodeCmd.String("genesis", "", "Genesis block hash of the network, to fetch it from peers when there is no chain yet")
+	startNodeMine := startNodeCmd.String("mine", "", "Mine blocks rewarding ADDRESS")
+	startNodeWorkers := startNodeCmd.Int("workers", 0, "Number of mining goroutines (defaults to the number of CPUs)")
+	startNodeRPCPort := startNodeCmd.Int("rpcport", 0, "JSON-RPC port (defaults to the network's port)")
+	startNodeRPCUser := startNodeCmd.String("rpcuser", "", "Username required by the JSON-RPC server (a cookie file is generated if neither is set)")
+	startNodeRPCPassword := startNodeCmd.String("rpcpassword", "", "Password required by the JSON-RPC server")
+	startNodeRESTPort := startNodeCmd.Int("restport", 0, "Port of the read-only REST API (disabled if 0)")
+	rpcPort := rpcCmd.Int("rpcport", 0, "JSON-RPC port of the node (defaults to the network's port)")
+	rpcUser := rpcCmd.String("rpcuser", "", "JSON-RPC username (the node's cookie file is used if neither is set)")
+	rpcPassword := rpcCmd.String("rpcpassword", "", "JSON-RPC password")
+	getPeerInfoRPCPort := getPeerInfoCmd.Int("rpcport", 0, "JSON-RPC port of the node (defaults to the network's port)")
+	getPeerInfoRPCUser := getPeerInfoCmd.String("rpcuser", "", "JSON-RPC username (the node's cookie file is used if neither is set)")
+	getPeerInfoRPCPassword := getPeerInfoCmd.String("rpcpassword", "", "JSON-RPC password")
+
+	commands := []*flag.FlagSet{
+		getBalanceCmd, createBlockchainCmd, sendCmd, printChainCmd, createWalletCmd, listAddressesCmd,
+		reindexCmd, verifyChainCmd, estimateFeeCmd, supplyCmd, mineCmd, rollbackCmd, historyCmd,
+		reindexTxCmd, getTransactionCmd, invalidateBlockCmd, startNodeCmd, rpcCmd, getPeerInfoCmd,
+	}
+	var command *flag.FlagSet
+	for _, cmd := range commands {
+		if cmd.Name() == args[0] {
+			command = cmd
 		}
-	case "reindexutxo":
-		err := reindexCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
+	}
+	if command == nil {
+		cli.PrintUsage()
+		return errUsage
+	}
+	if err = command.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
 		}
-	case "createblockchain":
-		err := createBlockchainCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
+		return errUsage
+	}
+
+	switch command {
+	case reindexCmd:
+		return cli.reindexutxo()
+
+	case verifyChainCmd:
+		return cli.verifyChain(*verifyFromHeight)
+
+	case estimateFeeCmd:
+		if *estimateFeeBlocks <= 0 {
+			estimateFeeCmd.Usage()
+			return errUsage
 		}
-	case "send":
-		err := sendCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
+		return cli.estimateFee(*estimateFeeBlocks)
+
+	case supplyCmd:
+		return cli.supply()
+
+	case mineCmd:
+		if *mineAddress == "" || *mineBlocks <= 0 {
+			mineCmd.Usage()
+			return errUsage
 		}
-	case "printchain":
-		err := printChainCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
+		return cli.mine(*mineAddress, *mineBlocks, *mineWorkers)
+
+	case reindexTxCmd:
+		return cli.reindexTransactions(*reindexTxDrop)
+
+	case getTransactionCmd:
+		if *getTransactionId == "" {
+			getTransactionCmd.Usage()
+			return errUsage
 		}
-	case "createwallet":
-		err := createWalletCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
+		return cli.getTransaction(*getTransactionId)
+
+	case historyCmd:
+		if *historyAddress == "" || *historyOffset < 0 || *historyLimit < 0 {
+			historyCmd.Usage()
+			return errUsage
 		}
-	case "listaddresses":
-		err := listAddressesCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
+		return cli.history(*historyAddress, *historyOffset, *historyLimit)
+
+	case rollbackCmd:
+		if *rollbackHeight < 0 {
+			rollbackCmd.Usage()
+			return errUsage
 		}
-	}
+		return cli.rollback(*rollbackHeight)
 
-	if reindexCmd.Parsed() {
-		cli.reindexutxo()
-	}
+	case invalidateBlockCmd:
+		if *invalidateBlockHash == "" {
+			invalidateBlockCmd.Usage()
+			return errUsage
+		}
+		return cli.invalidateBlock(*invalidateBlockHash)
 
-	if getBalanceCmd.Parsed() {
+	case getBalanceCmd:
 		if *getBalanceAddress == "" {
 			getBalanceCmd.Usage()
-			runtime.Goexit()
+			return errUsage
 		}
-		cli.getbalance(*getBalanceAddress)
-	}
+		return cli.getbalance(*getBalanceAddress)
 
-	if createBlockchainCmd.Parsed() {
+	case createBlockchainCmd:
 		if *createBlockchainAddress == "" {
 			createBlockchainCmd.Usage()
-			runtime.Goexit()
+			return errUsage
 		}
-		cli.createBlockchain(*createBlockchainAddress)
-	}
+		return cli.createBlockchain(*createBlockchainAddress, *createBlockchainTxIndex)
 
-	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount == 0 {
+	case sendCmd:
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 {
 			sendCmd.Usage()
-			runtime.Goexit()
+			return errUsage
+		}
+		return cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, !*sendNoMine, cli.parsePeers(*sendPeers))
+
+	case printChainCmd:
+		switch {
+		case *printChainHeight >= 0 || *printChainHash != "":
+			return cli.printBlockAt(*printChainHeight, *printChainHash)
+		case *printChainFrom >= 0 || *printChainTo >= 0:
+			if *printChainFrom < 0 {
+				*printChainFrom = 0
+			}
+			return cli.printChainRange(*printChainFrom, *printChainTo)
+		default:
+			return cli.printChain()
 		}
-		cli.send(*sendFrom, *sendTo, *sendAmount)
-	}
 
-	if printChainCmd.Parsed() {
-		cli.printChain()
-	}
+	case startNodeCmd:
+		if *startNodePort < 0 || *startNodeRPCPort < 0 || *startNodeRESTPort < 0 || *startNodeWorkers < 0 {
+			startNodeCmd.Usage()
+			return errUsage
+		}
+		return cli.startNode(nodeOptions{
+			Port:        *startNodePort,
+			Peers:       cli.parsePeers(*startNodePeers),
+			SeedNodes:   *startNodeSeedNodes,
+			Genesis:     *startNodeGenesis,
+			MineAddress: *startNodeMine,
+			Workers:     *startNodeWorkers,
+			RPCPort:     *startNodeRPCPort,
+			RPCUser:     *startNodeRPCUser,
+			RPCPassword: *startNodeRPCPassword,
+			RESTPort:    *startNodeRESTPort,
+		})
+
+	case rpcCmd:
+		if rpcCmd.NArg() < 1 || *rpcPort < 0 {
+			rpcCmd.Usage()
+			return errUsage
+		}
+		return cli.rpcCall(*rpcPort, *rpcUser, *rpcPassword, rpcCmd.Arg(0), rpcCmd.Args()[1:])
 
-	if createWalletCmd.Parsed() {
-		cli.createNewWalletCmd()
-	}
+	case getPeerInfoCmd:
+		if *getPeerInfoRPCPort < 0 {
+			getPeerInfoCmd.Usage()
+			return errUsage
+		}
+		return cli.getPeerInfo(*getPeerInfoRPCPort, *getPeerInfoRPCUser, *getPeerInfoRPCPassword)
+
+	case createWalletCmd:
+		return cli.createNewWalletCmd()
 
-	if listAddressesCmd.Parsed() {
-		cli.listWallets()
+	case listAddressesCmd:
+		return cli.listWallets()
 	}
+
+	return nil
 }
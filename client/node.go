@@ -0,0 +1,369 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	blockchain "gambim.com/blockchain/chain"
+	"gambim.com/blockchain/mempool"
+	"gambim.com/blockchain/miner"
+	"gambim.com/blockchain/network"
+	"gambim.com/blockchain/rest"
+	"gambim.com/blockchain/rpc"
+	"gambim.com/blockchain/wallet"
+)
+
+const (
+	shutdownTimeout = 5 * time.Second
+	// saveInterval is how often the known addresses and the mempool are
+	// saved while the node runs, besides on shutdown. Bans are saved as
+	// they are made.
+	saveInterval = 15 * time.Minute
+)
+
+type nodeOptions struct {
+	Port int
+	// Peers are connected to and kept connected. A node without a chain
+	// fetches the genesis block with hash Genesis from the first of them.
+	Peers   []string
+	Genesis string
+	// SeedNodes is a file of addresses to learn at start, one per line.
+	SeedNodes   string
+	MineAddress string
+	Workers     int
+	RPCPort     int
+	RPCUser     string
+	RPCPassword string
+	// RESTPort 0 leaves the REST server disabled.
+	RESTPort int
+}
+
+func localAddress(port int) string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+}
+
+func (cli *CommandLine) rpcAddress(port int) string {
+	if port == 0 {
+		port = cli.Params.RPCPort
+	}
+
+	return localAddress(port)
+}
+
+// withDefaultPort adds the network's default port to an address without
+// one.
+func (cli *CommandLine) withDefaultPort(address string) string {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return net.JoinHostPort(address, strconv.Itoa(cli.Params.DefaultPort))
+	}
+
+	return address
+}
+
+// parsePeers splits a comma separated list of addresses.
+func (cli *CommandLine) parsePeers(list string) []string {
+	var peers []string
+	for _, address := range strings.Split(list, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		peers = append(peers, cli.withDefaultPort(address))
+	}
+
+	return peers
+}
+
+// readSeedNodes reads a file of addresses, one per line. Blank lines and
+// lines starting with # are skipped.
+func (cli *CommandLine) readSeedNodes(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var seeds []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		seeds = append(seeds, cli.withDefaultPort(line))
+	}
+
+	return seeds, nil
+}
+
+func (cli *CommandLine) networkConfig() network.Config {
+	return network.Config{Params: cli.Params}
+}
+
+// openOrBootstrap opens the chain in the data dir, or creates it from the
+// genesis block whose hash is genesis, fetched from the first of peers that
+// has it, if there is none yet.
+func (cli *CommandLine) openOrBootstrap(peers []string, genesis string) (*blockchain.Blockchain, error) {
+	chain, err := cli.continueBlockchain()
+	if !errors.Is(err, blockchain.ErrChainNotFound) || len(peers) == 0 {
+		return chain, err
+	}
+	if genesis == "" {
+		return nil, fmt.Errorf("no chain in %s: pass -genesis with the network's genesis block hash to fetch it from peers", cli.DataDir)
+	}
+	genesisHash, err := hex.DecodeString(genesis)
+	if err != nil {
+		return nil, fmt.Errorf("invalid genesis hash: %w", err)
+	}
+
+	for _, peer := range peers {
+		fmt.Printf("No chain in %s, fetching the genesis block from %s\n", cli.DataDir, peer)
+		var genesis *blockchain.Block
+		genesis, err = network.FetchGenesis(cli.networkConfig(), peer, genesisHash)
+		if err == nil {
+			return blockchain.InitBlockchainWithGenesis(cli.DataDir, cli.Params, genesis)
+		}
+		fmt.Fprintf(os.Stderr, "Fetching genesis from %s: %v\n", peer, err)
+	}
+
+	return nil, fmt.Errorf("fetching genesis: %w", err)
+}
+
+func (cli *CommandLine) startNode(options nodeOptions) error {
+	if options.MineAddress != "" {
+		if err := cli.validateAddress(options.MineAddress); err != nil {
+			return err
+		}
+	}
+
+	addresses := network.NewAddressManager(filepath.Join(cli.DataDir, network.AddressFile))
+	if err := addresses.Load(); err != nil {
+		return err
+	}
+	var seeds []string
+	if options.SeedNodes != "" {
+		var err error
+		if seeds, err = cli.readSeedNodes(options.SeedNodes); err != nil {
+			return err
+		}
+		var seedAddresses []network.NetAddress
+		for _, seed := range seeds {
+			seedAddresses = append(seedAddresses, network.NetAddress{Address: seed, LastSeen: time.Now().Unix()})
+		}
+		addresses.Add(seedAddresses, options.SeedNodes)
+	}
+	bans := network.NewBanList(filepath.Join(cli.DataDir, network.BanFile))
+	if err := bans.Load(); err != nil {
+		return err
+	}
+
+	chain, err := cli.openOrBootstrap(append(append([]string{}, options.Peers...), seeds...), options.Genesis)
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+	utxoSet := blockchain.NewUTXOSet(chain)
+
+	pool := mempool.New(utxoSet, mempool.DefaultConfig)
+	if err = pool.Load(); err != nil {
+		return err
+	}
+	utxoSet.Exclude = pool.IsSpent
+
+	wallets, err := wallet.CreateWallets(cli.DataDir, cli.Params.AddressVersion)
+	if err != nil {
+		return err
+	}
+
+	// The chain, mempool and wallets are shared by the node, the miner and
+	// both servers, which take turns using them.
+	lock := &sync.Mutex{}
+
+	port := options.Port
+	if port == 0 {
+		port = cli.Params.DefaultPort
+	}
+	config := cli.networkConfig()
+	config.ListenAddress = net.JoinHostPort("", strconv.Itoa(port))
+	config.Peers = options.Peers
+	config.Lock = lock
+	config.Addresses = addresses
+	config.Bans = bans
+	node := network.New(utxoSet, pool, config)
+	if err = node.Start(); err != nil {
+		return err
+	}
+	defer node.Stop()
+	fmt.Printf("Node started on %s, listening for peers on %s\n", cli.Params.Name, config.ListenAddress)
+
+	rpcUser, rpcPassword := options.RPCUser, options.RPCPassword
+	cookie := filepath.Join(cli.DataDir, rpc.CookieFile)
+	if rpcUser == "" && rpcPassword == "" {
+		if rpcUser, rpcPassword, err = rpc.WriteCookie(cookie); err != nil {
+			return err
+		}
+		defer os.Remove(cookie)
+	}
+	server := rpc.NewServer(utxoSet, pool, wallets, rpc.Config{
+		Address:   cli.rpcAddress(options.RPCPort),
+		Username:  rpcUser,
+		Password:  rpcPassword,
+		Lock:      lock,
+		Broadcast: node.BroadcastTransaction,
+		Peers:     node.PeerInfo,
+		Bans:      bans.Bans,
+	})
+	if err = server.Start(); err != nil {
+		return err
+	}
+	fmt.Printf("RPC listening on %s\n", server.Config.Address)
+
+	restServer := rest.NewServer(utxoSet, pool, rest.Config{Address: localAddress(options.RESTPort), Lock: lock})
+	if options.RESTPort != 0 {
+		if err = restServer.Start(); err != nil {
+			server.Stop(context.Background())
+			return err
+		}
+		fmt.Printf("REST API listening on %s\n", restServer.Config.Address)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var mining sync.WaitGroup
+	if options.MineAddress != "" {
+		blockMiner := miner.New(utxoSet, pool, miner.Config{RewardAddress: options.MineAddress, Workers: options.Workers})
+		mining.Add(1)
+		go func() {
+			defer mining.Done()
+			if err := node.Mine(ctx, blockMiner); err != nil && !errors.Is(err, context.Canceled) {
+				fmt.Fprintf(os.Stderr, "Mining stopped: %v\n", err)
+			}
+		}()
+		fmt.Printf("Mining to %s\n", options.MineAddress)
+	}
+
+	var saving sync.WaitGroup
+	saving.Add(1)
+	go func() {
+		defer saving.Done()
+		ticker := time.NewTicker(saveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := addresses.Save(); err != nil {
+				fmt.Fprintf(os.Stderr, "Saving addresses: %v\n", err)
+			}
+			if err := pool.Save(); err != nil {
+				fmt.Fprintf(os.Stderr, "Saving mempool: %v\n", err)
+			}
+		}
+	}()
+
+	<-ctx.Done()
+
+	fmt.Println("Shutting down")
+	mining.Wait()
+	saving.Wait()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err = server.Stop(shutdownCtx); err != nil {
+		return err
+	}
+	if err = restServer.Stop(shutdownCtx); err != nil {
+		return err
+	}
+	node.Stop()
+	if err = addresses.Save(); err != nil {
+		return err
+	}
+	if err = bans.Save(); err != nil {
+		return err
+	}
+
+	return pool.Save()
+}
+
+// rpcClient connects to a running node, with the credentials in its
+// cookie file if none are given.
+func (cli *CommandLine) rpcClient(rpcPort int, rpcUser string, rpcPassword string) (*rpc.Client, error) {
+	if rpcUser == "" && rpcPassword == "" {
+		var err error
+		if rpcUser, rpcPassword, err = rpc.ReadCookie(filepath.Join(cli.DataDir, rpc.CookieFile)); err != nil {
+			return nil, fmt.Errorf("no -rpcuser or -rpcpassword given: %w", err)
+		}
+	}
+
+	return rpc.NewClient("http://"+cli.rpcAddress(rpcPort), rpcUser, rpcPassword), nil
+}
+
+func (cli *CommandLine) getPeerInfo(rpcPort int, rpcUser string, rpcPassword string) error {
+	client, err := cli.rpcClient(rpcPort, rpcUser, rpcPassword)
+	if err != nil {
+		return err
+	}
+	var peers []rpc.PeerInfoResult
+	if err := client.Call("getpeerinfo", []interface{}{}, &peers); err != nil {
+		return err
+	}
+
+	fmt.Printf("%d peers connected\n", len(peers))
+	for _, peer := range peers {
+		direction := "outbound"
+		if peer.Inbound {
+			direction = "inbound"
+			if peer.ListenAddress != "" {
+				direction += ", listening on " + peer.ListenAddress
+			}
+		}
+		connected := time.Since(time.Unix(peer.ConnectedTime, 0)).Round(time.Second)
+		fmt.Printf("%s (%s) %s height:%d banscore:%d connected:%s\n", peer.Address, direction, peer.UserAgent, peer.BestHeight, peer.BanScore, connected)
+	}
+
+	return nil
+}
+
+// rpcCall sends method to a running node. Arguments that parse as JSON are
+// passed as is, anything else as a string; quote numeric strings like '"12"'.
+func (cli *CommandLine) rpcCall(rpcPort int, rpcUser string, rpcPassword string, method string, args []string) error {
+	params := []interface{}{}
+	for _, arg := range args {
+		var param interface{}
+		if json.Unmarshal([]byte(arg), &param) != nil {
+			param = arg
+		}
+		params = append(params, param)
+	}
+
+	client, err := cli.rpcClient(rpcPort, rpcUser, rpcPassword)
+	if err != nil {
+		return err
+	}
+	var result json.RawMessage
+	if err := client.Call(method, params, &result); err != nil {
+		return err
+	}
+
+	var output bytes.Buffer
+	if err := json.Indent(&output, result, "", "  "); err != nil {
+		return err
+	}
+	fmt.Println(output.String())
+
+	return nil
+}
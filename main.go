@@ -7,7 +7,6 @@ import (
 )
 
 func main() {
-	defer os.Exit(0)
 	cli := client.CommandLine{}
-	cli.Run()
+	os.Exit(cli.Run())
 }
@@ -0,0 +1,344 @@
+package mempool
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	blockchain "gambim.com/blockchain/chain"
+	"gambim.com/blockchain/storage"
+)
+
+const DefaultBlockSize = 1 << 20
+
+var (
+	mempoolBucket = []byte("mempool")
+
+	ErrAlreadyExists = errors.New("transaction is already in the mempool")
+	ErrConflict      = errors.New("transaction conflicts with a pending transaction")
+	ErrFeeTooLow     = errors.New("transaction fee rate is below the minimum")
+	ErrMempoolFull   = errors.New("mempool is full")
+)
+
+type Config struct {
+	MaxSize    int
+	MaxAge     time.Duration
+	MinFeeRate float64
+}
+
+var DefaultConfig = Config{
+	MaxSize:    8 << 20,
+	MaxAge:     72 * time.Hour,
+	MinFeeRate: blockchain.MinFeeRate,
+}
+
+type Entry struct {
+	Transaction *blockchain.Transaction
+	Fee         int
+	Size        int
+	Added       int64
+}
+
+func (entry *Entry) FeeRate() float64 {
+	return blockchain.FeeRate(entry.Fee, entry.Size)
+}
+
+type Mempool struct {
+	UTXOSet *blockchain.UTXOSet
+	Config  Config
+
+	mutex   sync.Mutex
+	entries map[string]*Entry
+	spends  map[string]string
+	size    int
+}
+
+func New(utxoSet *blockchain.UTXOSet, config Config) *Mempool {
+	return &Mempool{
+		UTXOSet: utxoSet,
+		Config:  config,
+		entries: make(map[string]*Entry),
+		spends:  make(map[string]string),
+	}
+}
+
+func outpoint(input blockchain.TxInput) string {
+	return fmt.Sprintf("%x:%d", input.ID, input.OutputIndex)
+}
+
+func (pool *Mempool) Add(transaction *blockchain.Transaction) error {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	transactionId := hex.EncodeToString(transaction.ID)
+	if _, ok := pool.entries[transactionId]; ok {
+		return ErrAlreadyExists
+	}
+	for _, input := range transaction.Inputs {
+		if _, ok := pool.spends[outpoint(input)]; ok {
+			return fmt.Errorf("transaction %s: %w", transactionId, ErrConflict)
+		}
+	}
+
+	fee, err := pool.UTXOSet.Chain.ValidateTransactionFee(transaction)
+	if err != nil {
+		return err
+	}
+
+	entry := &Entry{Transaction: transaction, Fee: fee, Size: transaction.Size(), Added: time.Now().Unix()}
+	if entry.FeeRate() < pool.Config.MinFeeRate {
+		return fmt.Errorf("transaction %s: %w", transactionId, ErrFeeTooLow)
+	}
+
+	pool.insert(entry)
+	pool.evict(time.Now())
+
+	if _, ok := pool.entries[transactionId]; !ok {
+		return fmt.Errorf("transaction %s: %w", transactionId, ErrMempoolFull)
+	}
+
+	return nil
+}
+
+func (pool *Mempool) insert(entry *Entry) {
+	transactionId := hex.EncodeToString(entry.Transaction.ID)
+	pool.entries[transactionId] = entry
+	for _, input := range entry.Transaction.Inputs {
+		pool.spends[outpoint(input)] = transactionId
+	}
+	pool.size += entry.Size
+}
+
+func (pool *Mempool) remove(transactionId string) {
+	entry, ok := pool.entries[transactionId]
+	if !ok {
+		return
+	}
+	for _, input := range entry.Transaction.Inputs {
+		delete(pool.spends, outpoint(input))
+	}
+	delete(pool.entries, transactionId)
+	pool.size -= entry.Size
+}
+
+func (pool *Mempool) evict(now time.Time) {
+	if pool.Config.MaxAge > 0 {
+		for transactionId, entry := range pool.entries {
+			if now.Sub(time.Unix(entry.Added, 0)) > pool.Config.MaxAge {
+				pool.remove(transactionId)
+			}
+		}
+	}
+
+	if pool.Config.MaxSize > 0 && pool.size > pool.Config.MaxSize {
+		entries := pool.sortedEntries()
+		for i := len(entries) - 1; i >= 0 && pool.size > pool.Config.MaxSize; i-- {
+			pool.remove(hex.EncodeToString(entries[i].Transaction.ID))
+		}
+	}
+}
+
+func (pool *Mempool) sortedEntries() []*Entry {
+	var entries []*Entry
+
+	for _, entry := range pool.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].FeeRate() != entries[j].FeeRate() {
+			return entries[i].FeeRate() > entries[j].FeeRate()
+		}
+		return entries[i].Added < entries[j].Added
+	})
+
+	return entries
+}
+
+func (pool *Mempool) Evict() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.evict(time.Now())
+}
+
+func (pool *Mempool) Remove(transactionId []byte) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.remove(hex.EncodeToString(transactionId))
+}
+
+func (pool *Mempool) RemoveConfirmed(block *blockchain.Block) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for _, transaction := range block.Transactions {
+		pool.remove(hex.EncodeToString(transaction.ID))
+		if transaction.IsCoinBase() {
+			continue
+		}
+		for _, input := range transaction.Inputs {
+			if conflicting, ok := pool.spends[outpoint(input)]; ok {
+				pool.remove(conflicting)
+			}
+		}
+	}
+}
+
+// Revalidate removes the transactions that are no longer valid on the
+// chain, such as those spending outputs of disconnected blocks.
+func (pool *Mempool) Revalidate() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for transactionId, entry := range pool.entries {
+		if err := pool.UTXOSet.Chain.ValidateTransaction(entry.Transaction); err != nil {
+			pool.remove(transactionId)
+		}
+	}
+}
+
+func (pool *Mempool) Select(maxSize int) []*blockchain.Transaction {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	var transactions []*blockchain.Transaction
+	size := 0
+	for _, entry := range pool.sortedEntries() {
+		if maxSize > 0 && size+entry.Size > maxSize {
+			continue
+		}
+		transactions = append(transactions, entry.Transaction)
+		size += entry.Size
+	}
+
+	return transactions
+}
+
+func (pool *Mempool) Entries() []*Entry {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	return pool.sortedEntries()
+}
+
+func (pool *Mempool) Get(transactionId []byte) (*Entry, bool) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	entry, ok := pool.entries[hex.EncodeToString(transactionId)]
+	return entry, ok
+}
+
+func (pool *Mempool) IsSpent(transactionId []byte, outputIndex int) bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	_, ok := pool.spends[fmt.Sprintf("%x:%d", transactionId, outputIndex)]
+	return ok
+}
+
+func (pool *Mempool) Count() int {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	return len(pool.entries)
+}
+
+func (pool *Mempool) Size() int {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	return pool.size
+}
+
+func (pool *Mempool) Load() error {
+	var entries []*Entry
+
+	err := pool.UTXOSet.Chain.Database.View(func(tx storage.Tx) error {
+		bucket := tx.Bucket(mempoolBucket)
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(key []byte, item []byte) error {
+			var entry Entry
+			decoder := gob.NewDecoder(bytes.NewReader(item))
+			if err := decoder.Decode(&entry); err != nil {
+				return err
+			}
+			entries = append(entries, &entry)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for _, entry := range entries {
+		transactionId := hex.EncodeToString(entry.Transaction.ID)
+		if _, ok := pool.entries[transactionId]; ok {
+			continue
+		}
+		conflict := false
+		for _, input := range entry.Transaction.Inputs {
+			if _, ok := pool.spends[outpoint(input)]; ok {
+				conflict = true
+			}
+		}
+		if conflict {
+			continue
+		}
+		fee, err := pool.UTXOSet.Chain.ValidateTransactionFee(entry.Transaction)
+		if err != nil {
+			continue
+		}
+		entry.Fee = fee
+		pool.insert(entry)
+	}
+	pool.evict(time.Now())
+
+	return nil
+}
+
+func (pool *Mempool) Save() error {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	return pool.UTXOSet.Chain.Database.Update(func(tx storage.Tx) error {
+		if tx.Bucket(mempoolBucket) != nil {
+			if err := tx.DeleteBucket(mempoolBucket); err != nil {
+				return err
+			}
+		}
+		bucket, err := tx.CreateBucket(mempoolBucket)
+		if err != nil {
+			return err
+		}
+
+		for transactionId, entry := range pool.entries {
+			var encoded bytes.Buffer
+			encoder := gob.NewEncoder(&encoded)
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+			key, err := hex.DecodeString(transactionId)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(key, encoded.Bytes()); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
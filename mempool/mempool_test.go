@@ -0,0 +1,248 @@
+package mempool
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	blockchain "gambim.com/blockchain/chain"
+	"gambim.com/blockchain/params"
+	"gambim.com/blockchain/storage"
+	"gambim.com/blockchain/wallet"
+)
+
+type testChain struct {
+	chain *blockchain.Blockchain
+	wlt   *wallet.Wallet
+	// coinbases pay wlt, one per block from genesis on.
+	coinbases []*blockchain.Transaction
+}
+
+func (test *testChain) address() string {
+	return string(wallet.EncodeAddress(wallet.PublicKeyHash(test.wlt.PublicKey), params.RegTest.AddressVersion))
+}
+
+// newTestChain creates a chain in memory with blocks coinbases to spend.
+func newTestChain(t *testing.T, blocks int) *testChain {
+	t.Helper()
+
+	wlt, err := wallet.MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	test := &testChain{wlt: wlt}
+	if test.chain, err = blockchain.CreateBlockchain(storage.NewMemory(), &params.RegTest, test.address()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { test.chain.Database.Close() })
+
+	genesis, err := test.chain.GetBlock(test.chain.LastHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.coinbases = append(test.coinbases, genesis.Transactions[0])
+	for height := 1; height < blocks; height++ {
+		block := test.mine(t, fmt.Sprintf("block %d", height))
+		test.coinbases = append(test.coinbases, block.Transactions[0])
+	}
+
+	return test
+}
+
+func (test *testChain) mine(t *testing.T, data string, transactions ...*blockchain.Transaction) *blockchain.Block {
+	t.Helper()
+
+	height, err := test.chain.GetBestHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase, err := blockchain.CoinBaseTx(test.address(), params.RegTest.AddressVersion, data, test.chain.MonetaryPolicy().SubsidyAtHeight(height+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := test.chain.MineBlock(context.Background(), append([]*blockchain.Transaction{coinbase}, transactions...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return block
+}
+
+// spend spends the coinbase of block paying fee, back to the same wallet.
+func (test *testChain) spend(t *testing.T, block int, fee int) *blockchain.Transaction {
+	t.Helper()
+
+	return test.split(t, block, fee, 1)
+}
+
+// split is spend with the change split into count outputs, which makes
+// the transaction larger.
+func (test *testChain) split(t *testing.T, block int, fee int, count int) *blockchain.Transaction {
+	t.Helper()
+
+	coinbase := test.coinbases[block]
+	publicKeyHash := wallet.PublicKeyHash(test.wlt.PublicKey)
+	transaction := &blockchain.Transaction{
+		Inputs: []blockchain.TxInput{{ID: coinbase.ID, OutputIndex: 0, PublicKey: test.wlt.PublicKey}},
+		Outputs: []blockchain.TxOutput{
+			{Value: coinbase.Outputs[0].Value - fee - (count - 1), PublicKeyHash: publicKeyHash},
+		},
+	}
+	for i := 1; i < count; i++ {
+		transaction.Outputs = append(transaction.Outputs, blockchain.TxOutput{Value: 1, PublicKeyHash: publicKeyHash})
+	}
+	transaction.SetID()
+	if err := test.chain.SignTransaction(transaction, test.wlt.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+
+	return transaction
+}
+
+func (test *testChain) pool(config Config) *Mempool {
+	return New(blockchain.NewUTXOSet(test.chain), config)
+}
+
+func add(t *testing.T, pool *Mempool, transactions ...*blockchain.Transaction) {
+	t.Helper()
+
+	for _, transaction := range transactions {
+		if err := pool.Add(transaction); err != nil {
+			t.Fatalf("adding %x: %v", transaction.ID, err)
+		}
+	}
+}
+
+func has(pool *Mempool, transaction *blockchain.Transaction) bool {
+	_, ok := pool.Get(transaction.ID)
+	return ok
+}
+
+func TestSelectOrdersByFeeRate(t *testing.T) {
+	test := newTestChain(t, 3)
+	pool := test.pool(DefaultConfig)
+	low, high, middle := test.spend(t, 0, 1), test.spend(t, 1, 30), test.split(t, 2, 10, 4)
+	add(t, pool, low, high, middle)
+
+	selected := pool.Select(0)
+	if len(selected) != 3 {
+		t.Fatalf("Select() returned %d transactions, want 3", len(selected))
+	}
+	for i, want := range []*blockchain.Transaction{high, middle, low} {
+		if !bytes.Equal(selected[i].ID, want.ID) {
+			t.Errorf("transaction %d is %x, want %x", i, selected[i].ID, want.ID)
+		}
+	}
+
+	// A transaction that does not fit is skipped for one that does.
+	selected = pool.Select(high.Size() + low.Size())
+	if len(selected) != 2 || !bytes.Equal(selected[0].ID, high.ID) || !bytes.Equal(selected[1].ID, low.ID) {
+		t.Errorf("Select() of two transactions' size returned %d, want the highest and lowest fee rates", len(selected))
+	}
+}
+
+func TestAddRejectsConflicts(t *testing.T) {
+	test := newTestChain(t, 1)
+	pool := test.pool(DefaultConfig)
+	first := test.spend(t, 0, 5)
+	add(t, pool, first)
+
+	if err := pool.Add(first); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("Add() of the same transaction = %v, want %v", err, ErrAlreadyExists)
+	}
+	if err := pool.Add(test.spend(t, 0, 10)); !errors.Is(err, ErrConflict) {
+		t.Errorf("Add() of a second spend = %v, want %v", err, ErrConflict)
+	}
+	if !pool.IsSpent(test.coinbases[0].ID, 0) || pool.Count() != 1 {
+		t.Errorf("pool holds %d transactions, want only the first spend", pool.Count())
+	}
+}
+
+func TestEvictionBySize(t *testing.T) {
+	test := newTestChain(t, 4)
+	low, high, middle, lowest := test.spend(t, 0, 1), test.spend(t, 1, 30), test.spend(t, 2, 10), test.spend(t, 3, 0)
+	config := DefaultConfig
+	config.MaxSize = low.Size() + high.Size() + middle.Size() - 1
+	pool := test.pool(config)
+
+	add(t, pool, low, high, middle)
+	if has(pool, low) || !has(pool, high) || !has(pool, middle) {
+		t.Errorf("a full pool kept the wrong transactions")
+	}
+	if pool.Size() > config.MaxSize {
+		t.Errorf("pool size is %d, over %d", pool.Size(), config.MaxSize)
+	}
+	if err := pool.Add(lowest); !errors.Is(err, ErrMempoolFull) {
+		t.Errorf("Add() of the lowest fee rate to a full pool = %v, want %v", err, ErrMempoolFull)
+	}
+}
+
+func TestEvictionByAge(t *testing.T) {
+	test := newTestChain(t, 2)
+	config := DefaultConfig
+	config.MaxAge = time.Hour
+	pool := test.pool(config)
+	old, recent := test.spend(t, 0, 1), test.spend(t, 1, 1)
+	add(t, pool, old, recent)
+
+	entry, _ := pool.Get(old.ID)
+	entry.Added = time.Now().Add(-2 * time.Hour).Unix()
+	pool.Evict()
+	if has(pool, old) || !has(pool, recent) {
+		t.Errorf("eviction by age kept %d transactions, want only the recent one", pool.Count())
+	}
+	if pool.IsSpent(test.coinbases[0].ID, 0) {
+		t.Error("output spent by an evicted transaction is still spent")
+	}
+}
+
+func TestRemoveConfirmed(t *testing.T) {
+	test := newTestChain(t, 3)
+	pool := test.pool(DefaultConfig)
+	pending, confirmed, kept := test.spend(t, 0, 5), test.spend(t, 1, 5), test.spend(t, 2, 5)
+	add(t, pool, pending, confirmed, kept)
+
+	// The block spends the same output as pending, which can never confirm.
+	block := test.mine(t, "confirming", test.spend(t, 0, 7), confirmed)
+	pool.RemoveConfirmed(block)
+	if has(pool, pending) || has(pool, confirmed) || !has(pool, kept) {
+		t.Errorf("pool holds %d transactions after the block, want only the unrelated one", pool.Count())
+	}
+	if pool.Size() != kept.Size() {
+		t.Errorf("pool size is %d, want %d", pool.Size(), kept.Size())
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	test := newTestChain(t, 2)
+	pool := test.pool(DefaultConfig)
+	stays, confirmed := test.spend(t, 0, 5), test.spend(t, 1, 9)
+	add(t, pool, stays, confirmed)
+	if err := pool.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := test.pool(DefaultConfig)
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Count() != 2 || loaded.Size() != pool.Size() {
+		t.Fatalf("loaded %d transactions of %d bytes, want 2 of %d", loaded.Count(), loaded.Size(), pool.Size())
+	}
+	if entry, ok := loaded.Get(confirmed.ID); !ok || entry.Fee != 9 {
+		t.Errorf("loaded entry %+v, want a fee of 9", entry)
+	}
+
+	// Transactions confirmed while the pool was saved are not loaded.
+	test.mine(t, "confirming", confirmed)
+	loaded = test.pool(DefaultConfig)
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if !has(loaded, stays) || has(loaded, confirmed) {
+		t.Errorf("loaded %d transactions, want only the unconfirmed one", loaded.Count())
+	}
+}
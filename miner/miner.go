@@ -0,0 +1,125 @@
+package miner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	blockchain "gambim.com/blockchain/chain"
+	"gambim.com/blockchain/mempool"
+	"gambim.com/blockchain/wallet"
+)
+
+var ErrInvalidRewardAddress = errors.New("invalid reward address")
+
+type Config struct {
+	RewardAddress string
+	MaxBlockSize  int
+	Workers       int
+	Progress      func(hashes uint64, hashrate float64)
+}
+
+type BlockTemplate struct {
+	Block   *blockchain.Block
+	Subsidy int
+	Fees    int
+}
+
+type Miner struct {
+	UTXOSet *blockchain.UTXOSet
+	Mempool *mempool.Mempool
+	Config  Config
+}
+
+func New(utxoSet *blockchain.UTXOSet, pool *mempool.Mempool, config Config) *Miner {
+	if config.MaxBlockSize == 0 {
+		config.MaxBlockSize = mempool.DefaultBlockSize
+	}
+
+	return &Miner{UTXOSet: utxoSet, Mempool: pool, Config: config}
+}
+
+func (miner *Miner) NewBlockTemplate() (*BlockTemplate, error) {
+	chain := miner.UTXOSet.Chain
+	if !wallet.ValidateAddress(miner.Config.RewardAddress, chain.Params.AddressVersion) {
+		return nil, ErrInvalidRewardAddress
+	}
+
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return nil, err
+	}
+	height := bestHeight + 1
+	subsidy := chain.MonetaryPolicy().SubsidyAtHeight(height)
+	data := fmt.Sprintf("Mined at height %d, %d", height, time.Now().UnixNano())
+
+	coinbase, err := blockchain.CoinBaseTx(miner.Config.RewardAddress, chain.Params.AddressVersion, data, subsidy)
+	if err != nil {
+		return nil, err
+	}
+	coinbaseSize := coinbase.Size()
+	fees := 0
+	var transactions []*blockchain.Transaction
+	for _, transaction := range miner.Mempool.Select(miner.Config.MaxBlockSize - coinbaseSize) {
+		entry, ok := miner.Mempool.Get(transaction.ID)
+		if !ok {
+			continue
+		}
+		if err := chain.ValidateTransaction(transaction); err != nil {
+			miner.Mempool.Remove(transaction.ID)
+			continue
+		}
+		transactions = append(transactions, transaction)
+		fees += entry.Fee
+	}
+
+	coinbase, err = blockchain.CoinBaseTx(miner.Config.RewardAddress, chain.Params.AddressVersion, data, subsidy+fees)
+	if err != nil {
+		return nil, err
+	}
+	block, err := chain.PrepareBlock(append([]*blockchain.Transaction{coinbase}, transactions...))
+	if err != nil {
+		return nil, err
+	}
+
+	return &BlockTemplate{Block: block, Subsidy: subsidy, Fees: fees}, nil
+}
+
+// Solve runs the proof of work for a template block, setting its hash and
+// nounce. It does not touch the chain, so callers sharing the chain with
+// other goroutines only need to lock around NewBlockTemplate and AddBlock.
+func (miner *Miner) Solve(ctx context.Context, block *blockchain.Block) error {
+	proofOfWork := blockchain.NewProof(block)
+	if miner.Config.Workers > 0 {
+		proofOfWork.Workers = miner.Config.Workers
+	}
+	proofOfWork.Progress = miner.Config.Progress
+	nounce, hash, err := proofOfWork.Run(ctx)
+	if err != nil {
+		return err
+	}
+	block.Hash = hash
+	block.Nounce = nounce
+
+	return nil
+}
+
+func (miner *Miner) MineBlock(ctx context.Context) (*blockchain.Block, error) {
+	template, err := miner.NewBlockTemplate()
+	if err != nil {
+		return nil, err
+	}
+
+	block := template.Block
+	if err = miner.Solve(ctx, block); err != nil {
+		return nil, err
+	}
+
+	if err = miner.UTXOSet.Chain.AddBlock(block); err != nil {
+		return nil, err
+	}
+	miner.Mempool.RemoveConfirmed(block)
+
+	return block, nil
+}
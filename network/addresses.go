@@ -0,0 +1,442 @@
+package network
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"math"
+	mathrand "math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	AddressFile = "peers.data"
+
+	newBucketCount   = 64
+	triedBucketCount = 16
+	bucketSize       = 64
+	// The addresses from one source group land in at most this many new
+	// buckets, and the tried addresses of one group in at most this many
+	// tried buckets, so a single network can not fill the tables.
+	newBucketsPerGroup   = 8
+	triedBucketsPerGroup = 4
+
+	// addressHorizon is how long an address that is not heard of again is
+	// kept.
+	addressHorizon = 30 * 24 * time.Hour
+	// Addresses we never connected to are dropped after maxRetries failed
+	// attempts, others after maxFailures attempts in a week without success.
+	maxRetries  = 3
+	maxFailures = 10
+	minFailDays = 7 * 24 * time.Hour
+	// retryDelay is how long an address that failed is not selected.
+	retryDelay = 10 * time.Minute
+)
+
+// KnownAddress is a peer address with what we know of its reachability.
+type KnownAddress struct {
+	Address string
+	// Source is the address of the peer that told us about it.
+	Source      string
+	LastSeen    time.Time
+	LastAttempt time.Time
+	LastSuccess time.Time
+	// Attempts counts connection attempts since the last success.
+	Attempts int
+	// Tried is set once we connected to the address.
+	Tried bool
+}
+
+// isBad reports whether the address is not worth keeping or handing out.
+// An address we are connecting to is not stale yet, but the attempts
+// count against it right away.
+func (known *KnownAddress) isBad(now time.Time) bool {
+	if now.Sub(known.LastSeen) > addressHorizon && now.Sub(known.LastAttempt) >= time.Minute {
+		return true
+	}
+	if known.LastSuccess.IsZero() && known.Attempts >= maxRetries {
+		return true
+	}
+
+	return now.Sub(known.LastSuccess) > minFailDays && known.Attempts >= maxFailures
+}
+
+// chance is the relative likelihood of selecting the address, lower for
+// addresses failing repeatedly.
+func (known *KnownAddress) chance() float64 {
+	return math.Pow(0.66, math.Min(float64(known.Attempts), 8))
+}
+
+// failedRecently reports whether the last attempt to connect was less than
+// retryDelay ago and did not succeed.
+func (known *KnownAddress) failedRecently(now time.Time) bool {
+	return now.Sub(known.LastAttempt) < retryDelay && known.LastAttempt.After(known.LastSuccess)
+}
+
+// AddressManager keeps the addresses of nodes learned from peers, in the
+// manner of Bitcoin's address manager: addresses we only heard of are kept
+// in "new" buckets and move to "tried" buckets once we connect to them.
+// Buckets are picked by a keyed hash of the address and source network
+// groups, so that peers from one network can not crowd out the rest.
+type AddressManager struct {
+	path string
+
+	mutex     sync.Mutex
+	key       [32]byte
+	random    *mathrand.Rand
+	addresses map[string]*KnownAddress
+	newTable  [newBucketCount]map[string]*KnownAddress
+	tried     [triedBucketCount]map[string]*KnownAddress
+}
+
+// NewAddressManager returns an empty address manager that is saved to and
+// loaded from path, or only kept in memory if path is empty.
+func NewAddressManager(path string) *AddressManager {
+	manager := &AddressManager{path: path, random: mathrand.New(mathrand.NewSource(time.Now().UnixNano()))}
+	rand.Read(manager.key[:])
+	manager.reset()
+
+	return manager
+}
+
+func (manager *AddressManager) reset() {
+	manager.addresses = make(map[string]*KnownAddress)
+	for i := range manager.newTable {
+		manager.newTable[i] = make(map[string]*KnownAddress)
+	}
+	for i := range manager.tried {
+		manager.tried[i] = make(map[string]*KnownAddress)
+	}
+}
+
+// addressGroup is the network an address belongs to: the /16 of an IPv4
+// address, the /32 of an IPv6 address, or the host name.
+func addressGroup(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return host
+	case ip.To4() != nil:
+		return ip.To4().Mask(net.CIDRMask(16, 32)).String()
+	default:
+		return ip.Mask(net.CIDRMask(32, 128)).String()
+	}
+}
+
+func (manager *AddressManager) hash(parts ...string) uint64 {
+	hasher := sha256.New()
+	hasher.Write(manager.key[:])
+	for _, part := range parts {
+		hasher.Write([]byte(part))
+		hasher.Write([]byte{0})
+	}
+
+	return binary.BigEndian.Uint64(hasher.Sum(nil))
+}
+
+func (manager *AddressManager) newBucket(known *KnownAddress) map[string]*KnownAddress {
+	sourceGroup := addressGroup(known.Source)
+	slot := manager.hash("new", addressGroup(known.Address), sourceGroup) % newBucketsPerGroup
+	bucket := manager.hash("new", sourceGroup, fmt.Sprint(slot)) % newBucketCount
+
+	return manager.newTable[bucket]
+}
+
+func (manager *AddressManager) triedBucket(known *KnownAddress) map[string]*KnownAddress {
+	slot := manager.hash("tried", known.Address) % triedBucketsPerGroup
+	bucket := manager.hash("tried", addressGroup(known.Address), fmt.Sprint(slot)) % triedBucketCount
+
+	return manager.tried[bucket]
+}
+
+func validAddress(address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host == "" || port == "" || port == "0" {
+		return false
+	}
+	ip := net.ParseIP(host)
+
+	return ip == nil || !ip.IsUnspecified()
+}
+
+// Add records addresses heard of from source. Known addresses only have
+// their LastSeen updated.
+func (manager *AddressManager) Add(addresses []NetAddress, source string) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	now := time.Now()
+	for _, address := range addresses {
+		if !validAddress(address.Address) {
+			continue
+		}
+		lastSeen := time.Unix(address.LastSeen, 0)
+		if lastSeen.After(now.Add(10 * time.Minute)) {
+			// Peers can not know about the future; treat it as old news.
+			lastSeen = now.Add(-5 * 24 * time.Hour)
+		}
+
+		if known, found := manager.addresses[address.Address]; found {
+			if lastSeen.After(known.LastSeen) {
+				known.LastSeen = lastSeen
+			}
+			continue
+		}
+		manager.addNew(&KnownAddress{Address: address.Address, Source: source, LastSeen: lastSeen}, now)
+	}
+}
+
+// addNew puts an address in its new bucket, making room by dropping a bad
+// or the least recently seen address if the bucket is full.
+func (manager *AddressManager) addNew(known *KnownAddress, now time.Time) {
+	bucket := manager.newBucket(known)
+	if len(bucket) >= bucketSize {
+		var oldest *KnownAddress
+		for _, other := range bucket {
+			if other.isBad(now) {
+				oldest = other
+				break
+			}
+			if oldest == nil || other.LastSeen.Before(oldest.LastSeen) {
+				oldest = other
+			}
+		}
+		delete(bucket, oldest.Address)
+		delete(manager.addresses, oldest.Address)
+	}
+
+	known.Tried = false
+	bucket[known.Address] = known
+	manager.addresses[known.Address] = known
+}
+
+// Attempt records a connection attempt to address.
+func (manager *AddressManager) Attempt(address string) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if known, found := manager.addresses[address]; found {
+		known.LastAttempt = time.Now()
+		known.Attempts++
+	}
+}
+
+// Good records a successful connection to address, moving it to the tried
+// table. An address it displaces from a full tried bucket goes back to new.
+func (manager *AddressManager) Good(address string) {
+	if !validAddress(address) {
+		return
+	}
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	now := time.Now()
+	known, found := manager.addresses[address]
+	if !found {
+		known = &KnownAddress{Address: address, Source: address}
+		manager.addNew(known, now)
+	}
+	known.LastSeen = now
+	known.LastSuccess = now
+	known.Attempts = 0
+	if known.Tried {
+		return
+	}
+
+	delete(manager.newBucket(known), address)
+	bucket := manager.triedBucket(known)
+	if len(bucket) >= bucketSize {
+		var oldest *KnownAddress
+		for _, other := range bucket {
+			if oldest == nil || other.LastSuccess.Before(oldest.LastSuccess) {
+				oldest = other
+			}
+		}
+		delete(bucket, oldest.Address)
+		delete(manager.addresses, oldest.Address)
+		manager.addNew(oldest, now)
+	}
+	known.Tried = true
+	bucket[address] = known
+}
+
+func (manager *AddressManager) Remove(address string) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	manager.remove(address)
+}
+
+func (manager *AddressManager) remove(address string) {
+	known, found := manager.addresses[address]
+	if !found {
+		return
+	}
+	if known.Tried {
+		delete(manager.triedBucket(known), address)
+	} else {
+		delete(manager.newBucket(known), address)
+	}
+	delete(manager.addresses, address)
+}
+
+// Select picks an address to connect to for which skip returns false,
+// favouring addresses that connected before and have failed least.
+func (manager *AddressManager) Select(skip func(address string) bool) (string, bool) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	now := time.Now()
+	var tried, untried []*KnownAddress
+	for _, known := range manager.addresses {
+		if known.isBad(now) || known.failedRecently(now) || skip(known.Address) {
+			continue
+		}
+		if known.Tried {
+			tried = append(tried, known)
+		} else {
+			untried = append(untried, known)
+		}
+	}
+
+	candidates := untried
+	if len(tried) > 0 && (len(untried) == 0 || manager.random.Intn(2) == 0) {
+		candidates = tried
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+	total := 0.0
+	for _, known := range candidates {
+		total += known.chance()
+	}
+	pick := manager.random.Float64() * total
+	for _, known := range candidates[:len(candidates)-1] {
+		pick -= known.chance()
+		if pick <= 0 {
+			return known.Address, true
+		}
+	}
+
+	return candidates[len(candidates)-1].Address, true
+}
+
+// Addresses returns up to max addresses that are not bad, in random order,
+// to share with a peer.
+func (manager *AddressManager) Addresses(max int) []NetAddress {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	now := time.Now()
+	var addresses []NetAddress
+	for _, known := range manager.addresses {
+		if !known.isBad(now) {
+			addresses = append(addresses, NetAddress{Address: known.Address, LastSeen: known.LastSeen.Unix()})
+		}
+	}
+	manager.random.Shuffle(len(addresses), func(i, j int) {
+		addresses[i], addresses[j] = addresses[j], addresses[i]
+	})
+	if len(addresses) > max {
+		addresses = addresses[:max]
+	}
+
+	return addresses
+}
+
+func (manager *AddressManager) Count() int {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	return len(manager.addresses)
+}
+
+// savedAddresses is the file format. Buckets are not saved: they follow
+// from the key and the addresses.
+type savedAddresses struct {
+	Key       [32]byte
+	Addresses []*KnownAddress
+}
+
+func (manager *AddressManager) Save() error {
+	if manager.path == "" {
+		return nil
+	}
+
+	manager.mutex.Lock()
+	saved := savedAddresses{Key: manager.key}
+	for _, known := range manager.addresses {
+		saved.Addresses = append(saved.Addresses, known)
+	}
+	var content bytes.Buffer
+	err := gob.NewEncoder(&content).Encode(saved)
+	manager.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(manager.path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(manager.path, content.Bytes(), 0644)
+}
+
+// Load replaces the addresses with those saved, dropping the ones that
+// went bad meanwhile. A missing file is not an error.
+func (manager *AddressManager) Load() error {
+	if manager.path == "" {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(manager.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved savedAddresses
+	if err = gob.NewDecoder(bytes.NewReader(content)).Decode(&saved); err != nil {
+		return fmt.Errorf("%s: %w", manager.path, err)
+	}
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	manager.key = saved.Key
+	manager.reset()
+	now := time.Now()
+	for _, known := range saved.Addresses {
+		if !validAddress(known.Address) || known.isBad(now) {
+			continue
+		}
+		if !known.Tried {
+			manager.addNew(known, now)
+			continue
+		}
+		bucket := manager.triedBucket(known)
+		if len(bucket) >= bucketSize {
+			manager.addNew(known, now)
+			continue
+		}
+		bucket[known.Address] = known
+		manager.addresses[known.Address] = known
+	}
+
+	return nil
+}
@@ -0,0 +1,255 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	blockchain "gambim.com/blockchain/chain"
+)
+
+const (
+	BanFile = "banlist.data"
+
+	// BanThreshold is the ban score at which a peer is banned.
+	BanThreshold       = 100
+	DefaultBanDuration = 24 * time.Hour
+)
+
+var (
+	ErrBanned       = errors.New("peer is banned")
+	ErrTooManyItems = errors.New("message has too many items")
+)
+
+// banScore is how much an error from handling a peer's message counts
+// towards banning the peer. Errors scoring 0 are not held against it.
+func banScore(err error) int {
+	switch {
+	case errors.Is(err, ErrMessageTooLarge),
+		errors.Is(err, blockchain.ErrBadBlockHash),
+		errors.Is(err, blockchain.ErrBadPrevHash),
+		errors.Is(err, blockchain.ErrBadHeight),
+		errors.Is(err, blockchain.ErrBadProofOfWork),
+		errors.Is(err, blockchain.ErrBadDifficulty),
+		errors.Is(err, blockchain.ErrBadMerkleRoot),
+		errors.Is(err, blockchain.ErrDuplicateTx),
+		errors.Is(err, blockchain.ErrTxExists),
+		errors.Is(err, blockchain.ErrInvalidParent),
+		errors.Is(err, blockchain.ErrBadCoinbase),
+		errors.Is(err, blockchain.ErrBadTransactionID),
+		errors.Is(err, blockchain.ErrBadOutputValue),
+		errors.Is(err, blockchain.ErrBadSignature),
+		errors.Is(err, blockchain.ErrMissingInput),
+		errors.Is(err, blockchain.ErrDoubleSpend),
+		errors.Is(err, blockchain.ErrInsufficientInputs):
+		return BanThreshold
+	case errors.Is(err, ErrBadPayload), errors.Is(err, blockchain.ErrBadEncoding):
+		return 50
+	case errors.Is(err, ErrTooManyItems), errors.Is(err, ErrNoHeaders):
+		return 20
+	case errors.Is(err, ErrUnknownCommand):
+		// A newer peer may send a few commands we do not know, but not
+		// a stream of them.
+		return 1
+	}
+
+	return 0
+}
+
+// transactionBanScore is banScore for a relayed transaction, which may
+// spend outputs of blocks or transactions we have not seen yet, or have
+// been confirmed since it was sent.
+func transactionBanScore(err error) int {
+	if errors.Is(err, blockchain.ErrMissingInput) || errors.Is(err, blockchain.ErrDoubleSpend) ||
+		errors.Is(err, blockchain.ErrTxExists) {
+		return 0
+	}
+
+	return banScore(err)
+}
+
+// misbehaving adds score to the peer's ban score. Once it reaches
+// BanThreshold, the peer's host is banned for Config.BanDuration and the
+// peer disconnected; misbehaving reports whether that happened. The ban
+// only keeps the host from connecting again.
+func (node *Node) misbehaving(peer *Peer, score int, reason error) bool {
+	peer.mutex.Lock()
+	peer.banScore += score
+	total := peer.banScore
+	peer.mutex.Unlock()
+
+	node.logf("peer %s: %v (ban score %d)", peer.Address, reason, total)
+	if total < BanThreshold {
+		return false
+	}
+
+	until := time.Now().Add(node.Config.BanDuration)
+	if err := node.Config.Bans.Ban(peer.Address, until); err != nil {
+		node.logf("saving bans: %v", err)
+	}
+	node.logf("peer %s: banned until %s", peer.Address, until.Format(time.RFC3339))
+	// Other peers on the same host may be honest nodes sharing it, so they
+	// are left connected.
+	peer.Close()
+
+	return true
+}
+
+// rejected logs what was wrong with something a peer sent, counting it
+// towards banning the peer if score is not 0.
+func (node *Node) rejected(peer *Peer, score int, err error) {
+	if score > 0 {
+		node.misbehaving(peer, score, err)
+		return
+	}
+	node.logf("peer %s: %v", peer.Address, err)
+}
+
+// BanList holds the hosts banned for misbehaving, by host so that a peer
+// can not come back from another port.
+type BanList struct {
+	path string
+	// saving orders writes of the file.
+	saving sync.Mutex
+
+	mutex sync.Mutex
+	bans  map[string]time.Time
+}
+
+// NewBanList returns an empty ban list that is saved to and loaded from
+// path, or only kept in memory if path is empty.
+func NewBanList(path string) *BanList {
+	return &BanList{path: path, bans: make(map[string]time.Time)}
+}
+
+func banHost(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+
+	return host
+}
+
+// Ban bans the host of address until the given time, or longer if it
+// already is. The list is saved right away, so that the ban outlives a
+// crash.
+func (bans *BanList) Ban(address string, until time.Time) error {
+	if !bans.ban(address, until) {
+		return nil
+	}
+
+	return bans.Save()
+}
+
+// ban reports whether the ban was extended.
+func (bans *BanList) ban(address string, until time.Time) bool {
+	bans.mutex.Lock()
+	defer bans.mutex.Unlock()
+
+	host := banHost(address)
+	if !until.After(bans.bans[host]) {
+		return false
+	}
+	bans.bans[host] = until
+
+	return true
+}
+
+func (bans *BanList) IsBanned(address string) bool {
+	bans.mutex.Lock()
+	defer bans.mutex.Unlock()
+
+	host := banHost(address)
+	until, found := bans.bans[host]
+	if found && !time.Now().Before(until) {
+		delete(bans.bans, host)
+		return false
+	}
+
+	return found
+}
+
+type Ban struct {
+	Host  string
+	Until time.Time
+}
+
+// Bans lists the current bans, soonest to expire first.
+func (bans *BanList) Bans() []Ban {
+	bans.mutex.Lock()
+	defer bans.mutex.Unlock()
+
+	now := time.Now()
+	var list []Ban
+	for host, until := range bans.bans {
+		if now.Before(until) {
+			list = append(list, Ban{Host: host, Until: until})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Until.Before(list[j].Until)
+	})
+
+	return list
+}
+
+func (bans *BanList) Save() error {
+	if bans.path == "" {
+		return nil
+	}
+
+	bans.saving.Lock()
+	defer bans.saving.Unlock()
+
+	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(bans.Bans()); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(bans.path), 0700); err != nil {
+		return err
+	}
+	// Replacing the file in one step leaves the old list in place if we
+	// crash while writing.
+	temporary := bans.path + ".tmp"
+	if err := ioutil.WriteFile(temporary, content.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporary, bans.path)
+}
+
+// Load adds the saved bans that have not expired. A missing file is not an
+// error.
+func (bans *BanList) Load() error {
+	if bans.path == "" {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(bans.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []Ban
+	if err = gob.NewDecoder(bytes.NewReader(content)).Decode(&saved); err != nil {
+		return fmt.Errorf("%s: %w", bans.path, err)
+	}
+
+	for _, ban := range saved {
+		bans.ban(ban.Host, ban.Until)
+	}
+
+	return nil
+}
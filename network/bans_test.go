@@ -0,0 +1,57 @@
+package network
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBansPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), BanFile)
+	bans := NewBanList(path)
+	if err := bans.Ban("10.0.0.1:8333", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	// Saved by Ban, without calling Save, as a crash would skip it.
+	loaded := NewBanList(path)
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.IsBanned("10.0.0.1:1234") {
+		t.Error("ban was not saved when it was made")
+	}
+
+	if err := bans.Ban("10.0.0.2:8333", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := bans.Ban("10.0.0.3:8333", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := bans.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded = NewBanList(path)
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Bans()) != 2 || !loaded.IsBanned("10.0.0.2:1") || loaded.IsBanned("10.0.0.3:8333") {
+		t.Errorf("loaded bans %v, want 10.0.0.1 and 10.0.0.2", loaded.Bans())
+	}
+	if loaded.IsBanned("10.0.0.4:8333") {
+		t.Error("a host that was never banned is banned")
+	}
+}
+
+func TestBanScore(t *testing.T) {
+	if score := banScore(fmt.Errorf("%s: %w", CmdBlock, ErrMessageTooLarge)); score != BanThreshold {
+		t.Errorf("oversized message scores %d, want %d", score, BanThreshold)
+	}
+	if score := banScore(fmt.Errorf("%s: %w", CmdTx, ErrBadChecksum)); score != 0 {
+		t.Errorf("bad checksum scores %d, want 0", score)
+	}
+	score := banScore(fmt.Errorf("newcommand: %w", ErrUnknownCommand))
+	if score <= 0 || score*10 >= BanThreshold {
+		t.Errorf("unknown command scores %d, want a few to be allowed", score)
+	}
+}
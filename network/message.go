@@ -0,0 +1,219 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+
+	blockchain "gambim.com/blockchain/chain"
+)
+
+const (
+	ProtocolVersion = 1
+
+	commandLength  = 12
+	checksumLength = 4
+	headerLength   = 4 + commandLength + 4 + checksumLength
+
+	// MaxBlockPayloadSize leaves room for blocks four times the size
+	// miners build by default. No transaction can be larger than a block.
+	MaxBlockPayloadSize = 4 << 20
+	MaxTxPayloadSize    = MaxBlockPayloadSize
+	// MaxInvItems bounds inv, getdata and notfound messages.
+	MaxInvItems = 500
+	// MaxHeaders is the most headers sent in reply to getheaders; a full
+	// reply means the peer has more.
+	MaxHeaders = 2000
+	// MaxAddrItems bounds addr messages.
+	MaxAddrItems = 1000
+)
+
+// maxPayloadSizes bounds the payload of each command, with room to spare
+// over the largest well-formed one.
+var maxPayloadSizes = map[string]int{
+	CmdVersion:    1 << 12,
+	CmdVerack:     0,
+	CmdInv:        MaxInvItems * 64,
+	CmdGetData:    MaxInvItems * 64,
+	CmdNotFound:   MaxInvItems * 64,
+	CmdGetHeaders: 1 << 13,
+	CmdHeaders:    MaxHeaders * 160,
+	CmdBlock:      MaxBlockPayloadSize,
+	CmdTx:         MaxTxPayloadSize,
+	CmdGetAddr:    0,
+	CmdAddr:       MaxAddrItems * 128,
+}
+
+// MaxPayloadSize is the largest payload accepted for command. It is checked
+// before a payload is read, so a peer can not make us allocate or decode
+// more than this for a single message. Commands we do not know are allowed
+// the largest size of any, and their payload is skipped without being kept.
+func MaxPayloadSize(command string) (int, bool) {
+	if size, found := maxPayloadSizes[command]; found {
+		return size, true
+	}
+
+	return MaxBlockPayloadSize, false
+}
+
+const (
+	CmdVersion    = "version"
+	CmdVerack     = "verack"
+	CmdInv        = "inv"
+	CmdGetData    = "getdata"
+	CmdNotFound   = "notfound"
+	CmdGetHeaders = "getheaders"
+	CmdHeaders    = "headers"
+	CmdBlock      = "block"
+	CmdTx         = "tx"
+	CmdGetAddr    = "getaddr"
+	CmdAddr       = "addr"
+)
+
+const (
+	InvTypeTx = iota + 1
+	InvTypeBlock
+)
+
+var (
+	ErrBadMagic        = errors.New("message does not start with the network magic")
+	ErrBadChecksum     = errors.New("message checksum does not match its payload")
+	ErrMessageTooLarge = errors.New("message payload is too large")
+	ErrBadPayload      = errors.New("message payload can not be decoded")
+	ErrUnknownCommand  = errors.New("unknown command")
+)
+
+// Message is a command and its payload. The wire format is the network
+// magic, the command padded to 12 bytes, the payload length and the first
+// four bytes of the payload's double SHA-256, followed by the payload.
+type Message struct {
+	Command string
+	Payload []byte
+}
+
+type VersionMessage struct {
+	Version int
+	Network string
+	// GenesisHash is empty for a node that has no chain yet.
+	GenesisHash   []byte
+	BestHeight    int
+	ListenAddress string
+	UserAgent     string
+	Nonce         uint64
+	Timestamp     int64
+}
+
+type InvVector struct {
+	Type int
+	Hash []byte
+}
+
+// InvMessage is the payload of inv, getdata and notfound.
+type InvMessage struct {
+	Items []InvVector
+}
+
+type GetHeadersMessage struct {
+	Locator  [][]byte
+	StopHash []byte
+}
+
+type HeadersMessage struct {
+	Headers []blockchain.BlockHeader
+}
+
+// NetAddress is a node's listening address and the unix time it was last
+// heard of.
+type NetAddress struct {
+	Address  string
+	LastSeen int64
+}
+
+type AddrMessage struct {
+	Addresses []NetAddress
+}
+
+func checksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+
+	return second[:checksumLength]
+}
+
+func WriteMessage(writer io.Writer, magic [4]byte, message Message) error {
+	if len(message.Command) > commandLength {
+		return fmt.Errorf("command %q is too long", message.Command)
+	}
+	if size, known := MaxPayloadSize(message.Command); known && len(message.Payload) > size {
+		return fmt.Errorf("%s: %w", message.Command, ErrMessageTooLarge)
+	}
+
+	header := make([]byte, headerLength)
+	copy(header, magic[:])
+	copy(header[4:], message.Command)
+	binary.BigEndian.PutUint32(header[4+commandLength:], uint32(len(message.Payload)))
+	copy(header[4+commandLength+4:], checksum(message.Payload))
+
+	_, err := writer.Write(append(header, message.Payload...))
+	return err
+}
+
+func ReadMessage(reader io.Reader, magic [4]byte) (Message, error) {
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return Message{}, err
+	}
+	if !bytes.Equal(header[:4], magic[:]) {
+		return Message{}, ErrBadMagic
+	}
+
+	command := string(bytes.TrimRight(header[4:4+commandLength], "\x00"))
+	length := binary.BigEndian.Uint32(header[4+commandLength:])
+	size, known := MaxPayloadSize(command)
+	if int64(length) > int64(size) {
+		return Message{}, fmt.Errorf("%s: %w", command, ErrMessageTooLarge)
+	}
+	if !known {
+		// A newer peer may send commands we do not know yet; they are
+		// returned without a payload.
+		if _, err := io.CopyN(io.Discard, reader, int64(length)); err != nil {
+			return Message{}, err
+		}
+		return Message{Command: command}, nil
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return Message{}, err
+	}
+	if !bytes.Equal(checksum(payload), header[4+commandLength+4:]) {
+		return Message{}, fmt.Errorf("%s: %w", command, ErrBadChecksum)
+	}
+
+	return Message{Command: command, Payload: payload}, nil
+}
+
+// NewMessage gob-encodes payload. Blocks and transactions are sent using
+// their own Serialize methods instead.
+func NewMessage(command string, payload interface{}) Message {
+	var encoded bytes.Buffer
+	if payload != nil {
+		if err := gob.NewEncoder(&encoded).Encode(payload); err != nil {
+			panic(err)
+		}
+	}
+
+	return Message{Command: command, Payload: encoded.Bytes()}
+}
+
+func (message Message) Decode(value interface{}) error {
+	if err := gob.NewDecoder(bytes.NewReader(message.Payload)).Decode(value); err != nil {
+		return fmt.Errorf("%s: %w: %v", message.Command, ErrBadPayload, err)
+	}
+
+	return nil
+}
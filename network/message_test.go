@@ -0,0 +1,93 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"gambim.com/blockchain/params"
+)
+
+var testMagic = params.RegTest.Magic
+
+// rawHeader is a message header claiming length bytes of payload, which
+// need not follow.
+func rawHeader(command string, length uint32) []byte {
+	header := make([]byte, headerLength)
+	copy(header, testMagic[:])
+	copy(header[4:], command)
+	binary.BigEndian.PutUint32(header[4+commandLength:], length)
+
+	return header
+}
+
+func TestReadMessageRejectsOversizedPayloads(t *testing.T) {
+	versionSize, _ := MaxPayloadSize(CmdVersion)
+	for _, test := range []struct {
+		command string
+		length  uint32
+	}{
+		{CmdVersion, uint32(versionSize) + 1},
+		{CmdVerack, 1},
+		{CmdBlock, MaxBlockPayloadSize + 1},
+		{"newcommand", MaxBlockPayloadSize + 1},
+		{"newcommand", 1<<32 - 1},
+	} {
+		_, err := ReadMessage(bytes.NewReader(rawHeader(test.command, test.length)), testMagic)
+		if !errors.Is(err, ErrMessageTooLarge) {
+			t.Errorf("%s of %d bytes: ReadMessage() = %v, want %v", test.command, test.length, err, ErrMessageTooLarge)
+		}
+	}
+}
+
+func TestReadMessageSkipsUnknownCommands(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(rawHeader("newcommand", 1000))
+	stream.Write(make([]byte, 1000))
+	if err := WriteMessage(&stream, testMagic, Message{Command: CmdVerack}); err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := ReadMessage(&stream, testMagic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Command != "newcommand" || len(message.Payload) != 0 {
+		t.Errorf("unknown message = %q with %d bytes, want it without its payload", message.Command, len(message.Payload))
+	}
+	if message, err = ReadMessage(&stream, testMagic); err != nil || message.Command != CmdVerack {
+		t.Errorf("message after the unknown one = %q, %v, want %q", message.Command, err, CmdVerack)
+	}
+	if _, err = ReadMessage(&stream, testMagic); !errors.Is(err, io.EOF) {
+		t.Errorf("ReadMessage() at the end = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestReadMessageChecksPayload(t *testing.T) {
+	var stream bytes.Buffer
+	if err := WriteMessage(&stream, testMagic, NewMessage(CmdGetHeaders, GetHeadersMessage{StopHash: []byte{1}})); err != nil {
+		t.Fatal(err)
+	}
+	written := stream.Bytes()
+
+	tampered := append([]byte{}, written...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := ReadMessage(bytes.NewReader(tampered), testMagic); !errors.Is(err, ErrBadChecksum) {
+		t.Errorf("tampered payload: ReadMessage() = %v, want %v", err, ErrBadChecksum)
+	}
+
+	if _, err := ReadMessage(bytes.NewReader(written), params.MainNet.Magic); !errors.Is(err, ErrBadMagic) {
+		t.Errorf("other network: ReadMessage() = %v, want %v", err, ErrBadMagic)
+	}
+
+	message, err := ReadMessage(bytes.NewReader(written), testMagic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded GetHeadersMessage
+	if err = message.Decode(&decoded); err != nil || !bytes.Equal(decoded.StopHash, []byte{1}) {
+		t.Errorf("decoded %+v, %v", decoded, err)
+	}
+}
@@ -0,0 +1,1008 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	blockchain "gambim.com/blockchain/chain"
+	"gambim.com/blockchain/mempool"
+	"gambim.com/blockchain/miner"
+	"gambim.com/blockchain/params"
+)
+
+const (
+	DefaultMaxPeers      = 32
+	DefaultMaxOutbound   = 8
+	DefaultRetryInterval = 10 * time.Second
+	DefaultStallTimeout  = 30 * time.Second
+	DefaultMessageRate   = 500
+	UserAgent            = "/gambim:0.1/"
+
+	connectInterval = time.Second
+	// maxRelayedAddresses is the largest addr message passed on to other
+	// peers; larger ones are replies to getaddr.
+	maxRelayedAddresses = 10
+	relayAddressPeers   = 2
+)
+
+var (
+	ErrWrongNetwork     = errors.New("peer is on a different network")
+	ErrWrongGenesis     = errors.New("peer has a different genesis block")
+	ErrSelfConnection   = errors.New("connected to ourselves")
+	ErrOldVersion       = errors.New("peer protocol version is too old")
+	ErrNoHandshake      = errors.New("message received before the handshake")
+	ErrTooManyPeers     = errors.New("too many peers")
+	ErrDuplicateVersion = errors.New("duplicate version message")
+)
+
+type Config struct {
+	Params *params.Params
+	// ListenAddress is not listened on if empty.
+	ListenAddress string
+	// Peers are connected to at start and reconnected when they drop.
+	Peers     []string
+	Transport Transport
+	MaxPeers  int
+	// MaxOutbound is how many outbound connections the node keeps, adding
+	// connections to addresses it learned when Peers are not enough.
+	MaxOutbound   int
+	RetryInterval time.Duration
+	// StallTimeout is how long a peer may take to finish the handshake or
+	// to send requested blocks before it is disconnected. Headers get twice
+	// as long.
+	StallTimeout time.Duration
+	// MessageRate is how many messages per second are handled from each
+	// peer, in bursts of up to a second's worth. Faster peers are slowed
+	// down.
+	MessageRate int
+	// Lock guards the chain and mempool. Share it with anything else using
+	// them, such as the RPC server.
+	Lock sync.Locker
+	// Addresses holds the addresses learned from peers. Without one they
+	// are only kept in memory.
+	Addresses *AddressManager
+	// Bans holds the hosts banned for misbehaving, for BanDuration. Without
+	// a list they are only kept in memory.
+	Bans        *BanList
+	BanDuration time.Duration
+	Logger      *log.Logger
+}
+
+type Node struct {
+	UTXOSet *blockchain.UTXOSet
+	Mempool *mempool.Mempool
+	Config  Config
+
+	nonce    uint64
+	listener net.Listener
+	quit     chan struct{}
+	wait     sync.WaitGroup
+
+	// syncMutex guards sync and is never taken while holding Config.Lock.
+	syncMutex sync.Mutex
+	sync      *syncState
+
+	mutex       sync.Mutex
+	peers       map[*Peer]bool
+	started     bool
+	stopped     bool
+	tipChanged  []chan struct{}
+	miningAbort func()
+	// ownAddresses are addresses that turned out to lead back to us.
+	ownAddresses map[string]bool
+}
+
+func New(utxoSet *blockchain.UTXOSet, pool *mempool.Mempool, config Config) *Node {
+	if config.Transport == nil {
+		config.Transport = &TCPTransport{DialTimeout: handshakeTimeout}
+	}
+	if config.MaxPeers == 0 {
+		config.MaxPeers = DefaultMaxPeers
+	}
+	if config.MaxOutbound == 0 {
+		config.MaxOutbound = DefaultMaxOutbound
+	}
+	if config.RetryInterval == 0 {
+		config.RetryInterval = DefaultRetryInterval
+	}
+	if config.StallTimeout == 0 {
+		config.StallTimeout = DefaultStallTimeout
+	}
+	if config.MessageRate == 0 {
+		config.MessageRate = DefaultMessageRate
+	}
+	if config.Lock == nil {
+		config.Lock = &sync.Mutex{}
+	}
+	if config.Addresses == nil {
+		config.Addresses = NewAddressManager("")
+	}
+	if config.Bans == nil {
+		config.Bans = NewBanList("")
+	}
+	if config.BanDuration == 0 {
+		config.BanDuration = DefaultBanDuration
+	}
+	if config.Logger == nil {
+		config.Logger = log.Default()
+	}
+
+	var nonce [8]byte
+	rand.Read(nonce[:])
+
+	return &Node{
+		UTXOSet: utxoSet,
+		Mempool: pool,
+		Config:  config,
+		nonce:   binary.BigEndian.Uint64(nonce[:]),
+		quit:    make(chan struct{}),
+		sync:    newSyncState(),
+		peers:   make(map[*Peer]bool),
+
+		ownAddresses: make(map[string]bool),
+	}
+}
+
+func (node *Node) logf(format string, args ...interface{}) {
+	node.Config.Logger.Printf(format, args...)
+}
+
+func (node *Node) chain() *blockchain.Blockchain {
+	return node.UTXOSet.Chain
+}
+
+func (node *Node) Start() error {
+	node.mutex.Lock()
+	if node.started {
+		node.mutex.Unlock()
+		return errors.New("node is already started")
+	}
+	node.started = true
+	node.mutex.Unlock()
+
+	if node.Config.ListenAddress != "" {
+		listener, err := node.Config.Transport.Listen(node.Config.ListenAddress)
+		if err != nil {
+			return err
+		}
+		node.listener = listener
+		node.wait.Add(1)
+		go node.acceptLoop()
+	}
+
+	for _, address := range node.Config.Peers {
+		node.wait.Add(1)
+		go node.maintainConnection(address)
+	}
+	node.wait.Add(2)
+	go node.connectLoop()
+	go node.syncLoop()
+
+	return nil
+}
+
+func (node *Node) Stop() {
+	node.mutex.Lock()
+	if node.stopped {
+		node.mutex.Unlock()
+		return
+	}
+	node.stopped = true
+	close(node.quit)
+	if node.listener != nil {
+		node.listener.Close()
+	}
+	for peer := range node.peers {
+		peer.Close()
+	}
+	node.mutex.Unlock()
+
+	node.wait.Wait()
+}
+
+func (node *Node) acceptLoop() {
+	defer node.wait.Done()
+
+	for {
+		conn, err := node.listener.Accept()
+		if err != nil {
+			select {
+			case <-node.quit:
+			default:
+				node.logf("accept: %v", err)
+			}
+			return
+		}
+
+		if node.Config.Bans.IsBanned(conn.RemoteAddr().String()) {
+			conn.Close()
+			continue
+		}
+		if node.PeerCount() >= node.Config.MaxPeers {
+			node.logf("peer %s: %v", conn.RemoteAddr(), ErrTooManyPeers)
+			conn.Close()
+			continue
+		}
+		node.startPeer(newPeer(node, conn, conn.RemoteAddr().String(), true))
+	}
+}
+
+// maintainConnection keeps an outbound connection to address open until
+// the node stops.
+func (node *Node) maintainConnection(address string) {
+	defer node.wait.Done()
+
+	for {
+		peer, err := node.Connect(address)
+		if err != nil {
+			node.logf("connect %s: %v", address, err)
+		} else {
+			select {
+			case <-peer.Done():
+			case <-node.quit:
+				return
+			}
+		}
+
+		select {
+		case <-time.After(node.Config.RetryInterval):
+		case <-node.quit:
+			return
+		}
+	}
+}
+
+// connectLoop opens connections to learned addresses while the node has
+// fewer than Config.MaxOutbound outbound peers.
+func (node *Node) connectLoop() {
+	defer node.wait.Done()
+
+	ticker := time.NewTicker(connectInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-node.quit:
+			return
+		}
+
+		connected := make(map[string]bool)
+		for _, address := range node.Config.Peers {
+			connected[address] = true
+		}
+		node.mutex.Lock()
+		for address := range node.ownAddresses {
+			connected[address] = true
+		}
+		node.mutex.Unlock()
+		outbound := 0
+		for _, peer := range node.Peers() {
+			if !peer.Inbound {
+				outbound++
+			}
+			connected[peer.Address] = true
+			if listenAddress := peer.ListenAddress(); listenAddress != "" {
+				connected[listenAddress] = true
+			}
+		}
+		if outbound >= node.Config.MaxOutbound {
+			continue
+		}
+
+		address, found := node.Config.Addresses.Select(func(address string) bool {
+			return connected[address] || node.Config.Bans.IsBanned(address)
+		})
+		if !found {
+			continue
+		}
+		node.Config.Addresses.Attempt(address)
+		if _, err := node.Connect(address); err != nil {
+			node.logf("connect %s: %v", address, err)
+		}
+	}
+}
+
+// Connect opens an outbound connection and starts the handshake.
+func (node *Node) Connect(address string) (*Peer, error) {
+	if node.Config.Bans.IsBanned(address) {
+		return nil, ErrBanned
+	}
+	conn, err := node.Config.Transport.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+
+	peer := newPeer(node, conn, address, false)
+	if !node.startPeer(peer) {
+		return nil, errors.New("node is stopped")
+	}
+	version, err := node.versionMessage()
+	if err != nil {
+		peer.Close()
+		return nil, err
+	}
+	peer.Send(NewMessage(CmdVersion, version))
+
+	return peer, nil
+}
+
+func (node *Node) startPeer(peer *Peer) bool {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	if node.stopped {
+		peer.Close()
+		return false
+	}
+	node.peers[peer] = true
+
+	node.wait.Add(2)
+	go func() {
+		defer node.wait.Done()
+		peer.writeLoop()
+	}()
+	go func() {
+		defer node.wait.Done()
+		peer.readLoop()
+		node.removePeer(peer)
+		node.syncPeerRemoved(peer)
+	}()
+
+	return true
+}
+
+func (node *Node) removePeer(peer *Peer) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	delete(node.peers, peer)
+}
+
+func (node *Node) Peers() []*Peer {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	var peers []*Peer
+	for peer := range node.peers {
+		peers = append(peers, peer)
+	}
+
+	return peers
+}
+
+// ConnectedCount is the number of peers that completed the handshake.
+func (node *Node) ConnectedCount() int {
+	count := 0
+	for _, peer := range node.Peers() {
+		if peer.handshakeDone() {
+			count++
+		}
+	}
+
+	return count
+}
+
+type PeerInfo struct {
+	Address string
+	Inbound bool
+	// ListenAddress is where an inbound peer accepts connections, if it
+	// told us.
+	ListenAddress  string
+	Version        int
+	UserAgent      string
+	StartingHeight int
+	BestHeight     int
+	BanScore       int
+	ConnectedAt    time.Time
+}
+
+// PeerInfo describes the peers that completed the handshake, oldest
+// connection first.
+func (node *Node) PeerInfo() []PeerInfo {
+	var infos []PeerInfo
+	for _, peer := range node.Peers() {
+		if !peer.handshakeDone() {
+			continue
+		}
+		version := peer.Version()
+		peer.mutex.Lock()
+		infos = append(infos, PeerInfo{
+			Address:        peer.Address,
+			Inbound:        peer.Inbound,
+			ListenAddress:  peer.listenAddress,
+			Version:        version.Version,
+			UserAgent:      version.UserAgent,
+			StartingHeight: version.BestHeight,
+			BestHeight:     peer.bestHeight,
+			BanScore:       peer.banScore,
+			ConnectedAt:    peer.connectedAt,
+		})
+		peer.mutex.Unlock()
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ConnectedAt.Before(infos[j].ConnectedAt)
+	})
+
+	return infos
+}
+
+func (node *Node) PeerCount() int {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	return len(node.peers)
+}
+
+func (node *Node) versionMessage() (VersionMessage, error) {
+	node.Config.Lock.Lock()
+	defer node.Config.Lock.Unlock()
+
+	chain := node.chain()
+	genesisHash, err := chain.GenesisHash()
+	if err != nil {
+		return VersionMessage{}, err
+	}
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return VersionMessage{}, err
+	}
+
+	return VersionMessage{
+		Version:       ProtocolVersion,
+		Network:       node.Config.Params.Name,
+		GenesisHash:   genesisHash,
+		BestHeight:    bestHeight,
+		ListenAddress: node.Config.ListenAddress,
+		UserAgent:     UserAgent,
+		Nonce:         node.nonce,
+		Timestamp:     time.Now().Unix(),
+	}, nil
+}
+
+// TipChanged returns a channel that receives a value whenever the chain tip
+// changes because of a block from a peer or from Mine.
+func (node *Node) TipChanged() <-chan struct{} {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	notify := make(chan struct{}, 1)
+	node.tipChanged = append(node.tipChanged, notify)
+
+	return notify
+}
+
+func (node *Node) notifyTipChanged() {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	for _, notify := range node.tipChanged {
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+	}
+	if node.miningAbort != nil {
+		node.miningAbort()
+	}
+}
+
+func (node *Node) relay(item InvVector, except *Peer) {
+	message := NewMessage(CmdInv, InvMessage{Items: []InvVector{item}})
+	for _, peer := range node.Peers() {
+		if peer == except || !peer.handshakeDone() || peer.markKnown(item.Hash) {
+			continue
+		}
+		peer.Send(message)
+	}
+}
+
+// BroadcastTransaction announces a transaction that was added to the
+// mempool outside the node, for example by the RPC server.
+func (node *Node) BroadcastTransaction(transaction *blockchain.Transaction) {
+	node.relay(InvVector{Type: InvTypeTx, Hash: transaction.ID}, nil)
+}
+
+func (node *Node) BroadcastBlock(block *blockchain.Block) {
+	node.relay(InvVector{Type: InvTypeBlock, Hash: block.Hash}, nil)
+}
+
+func (node *Node) handshakeComplete(peer *Peer) {
+	version := peer.Version()
+	node.logf("peer %s: connected (%s, height %d)", peer.Address, version.UserAgent, version.BestHeight)
+
+	node.Config.Lock.Lock()
+	bestHeight, err := node.chain().GetBestHeight()
+	node.Config.Lock.Unlock()
+	if err != nil {
+		node.logf("peer %s: %v", peer.Address, err)
+		return
+	}
+	if peer.Inbound {
+		if address := advertisedAddress(peer.Address, version.ListenAddress); address != "" {
+			peer.mutex.Lock()
+			peer.listenAddress = address
+			peer.mutex.Unlock()
+			fresh := []NetAddress{{Address: address, LastSeen: time.Now().Unix()}}
+			node.Config.Addresses.Add(fresh, peer.Address)
+			node.relayAddresses(fresh, peer)
+		}
+	} else {
+		node.Config.Addresses.Good(peer.Address)
+		peer.Send(NewMessage(CmdGetAddr, nil))
+	}
+
+	if version.BestHeight > bestHeight {
+		node.startHeaders(peer)
+	}
+	if version.BestHeight < bestHeight {
+		// Blocks found while the peer was connecting were not announced
+		// to it, so announce the tip; it catches up from there.
+		node.Config.Lock.Lock()
+		tip := node.chain().LastHash
+		node.Config.Lock.Unlock()
+		if !peer.markKnown(tip) {
+			peer.Send(NewMessage(CmdInv, InvMessage{Items: []InvVector{{Type: InvTypeBlock, Hash: tip}}}))
+		}
+	}
+}
+
+func (node *Node) handleMessage(peer *Peer, message Message) error {
+	if message.Command == CmdVersion {
+		return node.handleVersion(peer, message)
+	}
+	if message.Command == CmdVerack {
+		peer.mutex.Lock()
+		peer.verack = true
+		peer.mutex.Unlock()
+		return nil
+	}
+	if _, known := MaxPayloadSize(message.Command); !known {
+		return ErrUnknownCommand
+	}
+	if !peer.handshakeDone() {
+		return fmt.Errorf("%w: %s", ErrNoHandshake, message.Command)
+	}
+
+	switch message.Command {
+	case CmdInv:
+		return node.handleInv(peer, message)
+	case CmdGetData:
+		return node.handleGetData(peer, message)
+	case CmdNotFound:
+		return node.handleNotFound(peer, message)
+	case CmdGetHeaders:
+		return node.handleGetHeaders(peer, message)
+	case CmdHeaders:
+		return node.handleHeaders(peer, message)
+	case CmdBlock:
+		return node.handleBlock(peer, message)
+	case CmdTx:
+		return node.handleTx(peer, message)
+	case CmdGetAddr:
+		return node.handleGetAddr(peer)
+	case CmdAddr:
+		return node.handleAddr(peer, message)
+	}
+
+	return nil
+}
+
+func (node *Node) handleVersion(peer *Peer, message Message) error {
+	var version VersionMessage
+	if err := message.Decode(&version); err != nil {
+		return err
+	}
+	if peer.Version() != nil {
+		return ErrDuplicateVersion
+	}
+	if version.Version < ProtocolVersion {
+		return ErrOldVersion
+	}
+	if version.Network != node.Config.Params.Name {
+		return fmt.Errorf("%w: %s", ErrWrongNetwork, version.Network)
+	}
+	if version.Nonce == node.nonce {
+		node.selfConnected(peer)
+		return ErrSelfConnection
+	}
+
+	ours, err := node.versionMessage()
+	if err != nil {
+		return err
+	}
+	if len(version.GenesisHash) != 0 && !bytes.Equal(version.GenesisHash, ours.GenesisHash) {
+		return ErrWrongGenesis
+	}
+
+	peer.mutex.Lock()
+	peer.version = &version
+	peer.bestHeight = version.BestHeight
+	peer.mutex.Unlock()
+
+	if peer.Inbound {
+		peer.Send(NewMessage(CmdVersion, ours))
+	}
+	peer.Send(NewMessage(CmdVerack, nil))
+
+	return nil
+}
+
+// selfConnected forgets the address through which we connected to
+// ourselves. The inbound end, which is the one to notice, finds it from the
+// outbound peer whose local address is the inbound peer's remote address.
+func (node *Node) selfConnected(peer *Peer) {
+	address := peer.Address
+	if peer.Inbound {
+		address = ""
+		for _, other := range node.Peers() {
+			if !other.Inbound && other.conn.LocalAddr().String() == peer.conn.RemoteAddr().String() {
+				address = other.Address
+			}
+		}
+	}
+	if address == "" {
+		return
+	}
+
+	node.mutex.Lock()
+	node.ownAddresses[address] = true
+	node.mutex.Unlock()
+	node.Config.Addresses.Remove(address)
+}
+
+func (node *Node) handleInv(peer *Peer, message Message) error {
+	var inv InvMessage
+	if err := message.Decode(&inv); err != nil {
+		return err
+	}
+	if len(inv.Items) > MaxInvItems {
+		return fmt.Errorf("%w: %d", ErrTooManyItems, len(inv.Items))
+	}
+
+	// While syncing, new blocks are left to the header download.
+	syncing := node.SyncStatus().Syncing
+
+	var wanted []InvVector
+	node.Config.Lock.Lock()
+	for _, item := range inv.Items {
+		peer.markKnown(item.Hash)
+		switch item.Type {
+		case InvTypeBlock:
+			if syncing {
+				continue
+			}
+			found, err := node.chain().HasBlock(item.Hash)
+			if err != nil {
+				node.Config.Lock.Unlock()
+				return err
+			}
+			if !found {
+				wanted = append(wanted, item)
+			}
+		case InvTypeTx:
+			if _, found := node.Mempool.Get(item.Hash); !found {
+				wanted = append(wanted, item)
+			}
+		}
+	}
+	node.Config.Lock.Unlock()
+
+	if len(wanted) > 0 {
+		peer.Send(NewMessage(CmdGetData, InvMessage{Items: wanted}))
+	}
+
+	return nil
+}
+
+func (node *Node) handleGetData(peer *Peer, message Message) error {
+	var getData InvMessage
+	if err := message.Decode(&getData); err != nil {
+		return err
+	}
+	if len(getData.Items) > MaxInvItems {
+		return fmt.Errorf("%w: %d", ErrTooManyItems, len(getData.Items))
+	}
+
+	var notFound []InvVector
+	for _, item := range getData.Items {
+		switch item.Type {
+		case InvTypeBlock:
+			node.Config.Lock.Lock()
+			block, err := node.chain().GetBlock(item.Hash)
+			node.Config.Lock.Unlock()
+			if err != nil {
+				notFound = append(notFound, item)
+				continue
+			}
+			peer.markKnown(item.Hash)
+			peer.Send(Message{Command: CmdBlock, Payload: block.Serialize()})
+		case InvTypeTx:
+			if entry, found := node.Mempool.Get(item.Hash); found {
+				peer.markKnown(item.Hash)
+				peer.Send(Message{Command: CmdTx, Payload: entry.Transaction.Serialize()})
+			}
+		}
+	}
+	// Only blocks are reported, so the sync can ask someone else for them.
+	if len(notFound) > 0 {
+		peer.Send(NewMessage(CmdNotFound, InvMessage{Items: notFound}))
+	}
+
+	return nil
+}
+
+func (node *Node) handleBlock(peer *Peer, message Message) error {
+	block, err := blockchain.Deserialize(message.Payload)
+	if err != nil {
+		return err
+	}
+	peer.markKnown(block.Hash)
+	if node.blockDownloaded(peer, block) {
+		return nil
+	}
+
+	// Only blocks that check out tell us how far the peer's chain goes.
+	connected, err := node.processBlock(block)
+	switch {
+	case errors.Is(err, blockchain.ErrBlockExists):
+		peer.setBestHeight(block.Height)
+	case errors.Is(err, blockchain.ErrOrphanBlock):
+		node.startHeaders(peer)
+	case err != nil:
+		node.rejected(peer, banScore(err), fmt.Errorf("rejected block %x: %w", block.Hash, err))
+	default:
+		peer.setBestHeight(block.Height)
+		if connected {
+			node.logf("new tip %x at height %d", block.Hash, block.Height)
+			node.relay(InvVector{Type: InvTypeBlock, Hash: block.Hash}, peer)
+		}
+	}
+
+	return nil
+}
+
+// SubmitBlock adds a block found outside the node, such as by a separate
+// miner, and announces it if it becomes the new tip.
+func (node *Node) SubmitBlock(block *blockchain.Block) error {
+	connected, err := node.processBlock(block)
+	if err != nil {
+		return err
+	}
+	if connected {
+		node.BroadcastBlock(block)
+	}
+
+	return nil
+}
+
+// processBlock adds a block to the chain and reports whether it became
+// the new tip.
+func (node *Node) processBlock(block *blockchain.Block) (bool, error) {
+	node.Config.Lock.Lock()
+	chain := node.chain()
+	oldTip := chain.LastHash
+	err := chain.AddBlock(block)
+	tipChanged := !bytes.Equal(oldTip, chain.LastHash)
+	if tipChanged {
+		node.updateMempool(oldTip)
+	}
+	connected := tipChanged && bytes.Equal(chain.LastHash, block.Hash)
+	node.Config.Lock.Unlock()
+
+	if tipChanged {
+		node.notifyTipChanged()
+	}
+
+	return connected, err
+}
+
+// updateMempool removes the transactions the chain now confirms from the
+// mempool after the tip moved from oldTip. On a reorganization, the
+// transactions of the disconnected blocks go back to the mempool, and those
+// no longer valid on the new branch are dropped. Config.Lock must be held.
+func (node *Node) updateMempool(oldTip []byte) {
+	chain := node.chain()
+	disconnected, connected, err := chain.ForkBranches(oldTip, chain.LastHash)
+	if err != nil {
+		node.logf("mempool: %v", err)
+		return
+	}
+
+	for _, block := range connected {
+		node.Mempool.RemoveConfirmed(block)
+	}
+	if len(disconnected) == 0 {
+		return
+	}
+	for _, block := range disconnected {
+		for _, transaction := range block.Transactions {
+			if !transaction.IsCoinBase() {
+				node.Mempool.Add(transaction)
+			}
+		}
+	}
+	node.Mempool.Revalidate()
+}
+
+func (node *Node) handleTx(peer *Peer, message Message) error {
+	transaction, err := blockchain.DeserializeTransaction(message.Payload)
+	if err != nil {
+		return err
+	}
+	peer.markKnown(transaction.ID)
+
+	node.Config.Lock.Lock()
+	err = node.Mempool.Add(transaction)
+	node.Config.Lock.Unlock()
+	if errors.Is(err, mempool.ErrAlreadyExists) {
+		return nil
+	}
+	if err != nil {
+		node.rejected(peer, transactionBanScore(err), fmt.Errorf("rejected transaction %x: %w", transaction.ID, err))
+		return nil
+	}
+
+	node.relay(InvVector{Type: InvTypeTx, Hash: transaction.ID}, peer)
+	return nil
+}
+
+// advertisedAddress is where a peer that connected to us listens: its
+// listen address, with the host it connected from if that is unspecified.
+func advertisedAddress(remoteAddress string, listenAddress string) string {
+	host, port, err := net.SplitHostPort(listenAddress)
+	if err != nil || port == "0" {
+		return ""
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		if host, _, err = net.SplitHostPort(remoteAddress); err != nil {
+			return ""
+		}
+	}
+
+	return net.JoinHostPort(host, port)
+}
+
+// addressKey is how addresses are marked known to a peer, apart from the
+// block and transaction hashes.
+func addressKey(address string) []byte {
+	return []byte("addr " + address)
+}
+
+// handleGetAddr answers inbound peers once per connection: nodes ask the
+// peers they connect to, and a peer gains nothing from asking again.
+func (node *Node) handleGetAddr(peer *Peer) error {
+	peer.mutex.Lock()
+	answered := peer.sentAddresses
+	peer.sentAddresses = true
+	peer.mutex.Unlock()
+	if !peer.Inbound || answered {
+		return nil
+	}
+
+	addresses := node.Config.Addresses.Addresses(MaxAddrItems)
+	for _, address := range addresses {
+		peer.markKnown(addressKey(address.Address))
+	}
+	peer.Send(NewMessage(CmdAddr, AddrMessage{Addresses: addresses}))
+
+	return nil
+}
+
+func (node *Node) handleAddr(peer *Peer, message Message) error {
+	var addr AddrMessage
+	if err := message.Decode(&addr); err != nil {
+		return err
+	}
+	if len(addr.Addresses) > MaxAddrItems {
+		return fmt.Errorf("%w: %d", ErrTooManyItems, len(addr.Addresses))
+	}
+
+	for _, address := range addr.Addresses {
+		peer.markKnown(addressKey(address.Address))
+	}
+	node.Config.Addresses.Add(addr.Addresses, peer.Address)
+
+	// Announcements of new nodes are passed on so that they become known
+	// across the network; replies to getaddr are not.
+	if len(addr.Addresses) > maxRelayedAddresses {
+		return nil
+	}
+	var fresh []NetAddress
+	for _, address := range addr.Addresses {
+		if time.Since(time.Unix(address.LastSeen, 0)) < 10*time.Minute {
+			fresh = append(fresh, address)
+		}
+	}
+	node.relayAddresses(fresh, peer)
+
+	return nil
+}
+
+// relayAddresses sends addresses to a few random peers other than except
+// that have not seen them yet.
+func (node *Node) relayAddresses(addresses []NetAddress, except *Peer) {
+	if len(addresses) == 0 {
+		return
+	}
+
+	var peers []*Peer
+	for _, peer := range node.Peers() {
+		if peer != except && peer.handshakeDone() {
+			peers = append(peers, peer)
+		}
+	}
+	mathrand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	if len(peers) > relayAddressPeers {
+		peers = peers[:relayAddressPeers]
+	}
+
+	for _, peer := range peers {
+		var unknown []NetAddress
+		for _, address := range addresses {
+			if !peer.markKnown(addressKey(address.Address)) {
+				unknown = append(unknown, address)
+			}
+		}
+		if len(unknown) > 0 {
+			peer.Send(NewMessage(CmdAddr, AddrMessage{Addresses: unknown}))
+		}
+	}
+}
+
+// Mine mines blocks on top of the current tip until ctx is done, starting
+// a new template whenever the tip changes, and announces every block it
+// finds.
+func (node *Node) Mine(ctx context.Context, blockMiner *miner.Miner) error {
+	for {
+		// The abort is installed before the lock is released, so that a
+		// tip change right after the template is built is not missed.
+		round, cancel := context.WithCancel(ctx)
+		node.Config.Lock.Lock()
+		template, err := blockMiner.NewBlockTemplate()
+		if err == nil {
+			node.mutex.Lock()
+			node.miningAbort = cancel
+			node.mutex.Unlock()
+		}
+		node.Config.Lock.Unlock()
+		if err != nil {
+			cancel()
+			return err
+		}
+
+		block := template.Block
+		err = blockMiner.Solve(round, block)
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, context.Canceled) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		connected, err := node.processBlock(block)
+		if err != nil {
+			node.logf("mined block %x rejected: %v", block.Hash, err)
+			continue
+		}
+		if connected {
+			node.logf("mined block %x at height %d", block.Hash, block.Height)
+			node.BroadcastBlock(block)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	sendQueueSize    = 256
+	handshakeTimeout = 30 * time.Second
+	writeTimeout     = 30 * time.Second
+	maxKnownItems    = 10000
+)
+
+var ErrSendQueueFull = errors.New("peer send queue is full")
+
+type Peer struct {
+	Address string
+	Inbound bool
+
+	node      *Node
+	conn      net.Conn
+	send      chan Message
+	quit      chan struct{}
+	closeOnce sync.Once
+
+	mutex       sync.Mutex
+	version     *VersionMessage
+	verack      bool
+	known       map[string]bool
+	bestHeight  int
+	connectedAt time.Time
+	// listenAddress is where an inbound peer accepts connections.
+	listenAddress string
+	sentAddresses bool
+	banScore      int
+}
+
+func newPeer(node *Node, conn net.Conn, address string, inbound bool) *Peer {
+	return &Peer{
+		Address:     address,
+		Inbound:     inbound,
+		node:        node,
+		conn:        conn,
+		send:        make(chan Message, sendQueueSize),
+		quit:        make(chan struct{}),
+		known:       make(map[string]bool),
+		connectedAt: time.Now(),
+	}
+}
+
+// Send queues a message without blocking. A peer that does not keep up
+// with its queue is disconnected.
+func (peer *Peer) Send(message Message) {
+	select {
+	case peer.send <- message:
+	case <-peer.quit:
+	default:
+		peer.node.logf("peer %s: %v", peer.Address, ErrSendQueueFull)
+		peer.Close()
+	}
+}
+
+func (peer *Peer) Close() {
+	peer.closeOnce.Do(func() {
+		close(peer.quit)
+		peer.conn.Close()
+	})
+}
+
+func (peer *Peer) Done() <-chan struct{} {
+	return peer.quit
+}
+
+func (peer *Peer) Version() *VersionMessage {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	return peer.version
+}
+
+func (peer *Peer) BestHeight() int {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	return peer.bestHeight
+}
+
+func (peer *Peer) setBestHeight(height int) {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	if height > peer.bestHeight {
+		peer.bestHeight = height
+	}
+}
+
+// limitBestHeight lowers the best height of a peer that claimed more than
+// it has.
+func (peer *Peer) limitBestHeight(height int) {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	if height < peer.bestHeight {
+		peer.bestHeight = height
+	}
+}
+
+// ListenAddress is where an inbound peer accepts connections, or empty if
+// it did not say.
+func (peer *Peer) ListenAddress() string {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	return peer.listenAddress
+}
+
+func (peer *Peer) handshakeDone() bool {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	return peer.version != nil && peer.verack
+}
+
+// markKnown records that the peer has an item and reports whether it
+// already did.
+func (peer *Peer) markKnown(hash []byte) bool {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	key := string(hash)
+	if peer.known[key] {
+		return true
+	}
+	if len(peer.known) >= maxKnownItems {
+		peer.known = make(map[string]bool)
+	}
+	peer.known[key] = true
+
+	return false
+}
+
+func (peer *Peer) writeLoop() {
+	magic := peer.node.Config.Params.Magic
+	for {
+		select {
+		case message := <-peer.send:
+			peer.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := WriteMessage(peer.conn, magic, message); err != nil {
+				peer.node.logf("peer %s: %v", peer.Address, err)
+				peer.Close()
+				return
+			}
+		case <-peer.quit:
+			return
+		}
+	}
+}
+
+func (peer *Peer) readLoop() {
+	defer peer.Close()
+
+	node := peer.node
+	magic := node.Config.Params.Magic
+	limiter := newRateLimiter(node.Config.MessageRate)
+	peer.conn.SetReadDeadline(time.Now().Add(node.Config.StallTimeout))
+	for {
+		message, err := ReadMessage(peer.conn, magic)
+		if err != nil {
+			select {
+			case <-peer.quit:
+			default:
+				if errors.Is(err, io.EOF) {
+					node.logf("peer %s: disconnected", peer.Address)
+				} else {
+					node.rejected(peer, banScore(err), err)
+				}
+			}
+			return
+		}
+		if !limiter.wait(peer.quit) {
+			return
+		}
+
+		// Errors the peer is to blame for add to its ban score, the others
+		// end the connection.
+		wasDone := peer.handshakeDone()
+		if err = node.handleMessage(peer, message); err != nil {
+			err = fmt.Errorf("%s: %w", message.Command, err)
+			if score := banScore(err); score > 0 {
+				if node.misbehaving(peer, score, err) {
+					return
+				}
+				continue
+			}
+			node.logf("peer %s: %v", peer.Address, err)
+			return
+		}
+		if !wasDone && peer.handshakeDone() {
+			peer.conn.SetReadDeadline(time.Time{})
+			peer.node.handshakeComplete(peer)
+		}
+	}
+}
+
+// rateLimiter is a token bucket refilled at rate tokens per second, holding
+// up to a second's worth.
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait takes a token, sleeping until there is one. It reports false if
+// quit is closed first.
+func (limiter *rateLimiter) wait(quit <-chan struct{}) bool {
+	now := time.Now()
+	limiter.tokens = math.Min(limiter.rate, limiter.tokens+now.Sub(limiter.last).Seconds()*limiter.rate)
+	limiter.last = now
+
+	limiter.tokens--
+	if limiter.tokens >= 0 {
+		return true
+	}
+	select {
+	case <-time.After(time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))):
+		return true
+	case <-quit:
+		return false
+	}
+}
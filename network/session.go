@@ -0,0 +1,159 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	blockchain "gambim.com/blockchain/chain"
+)
+
+var (
+	ErrUnexpectedMessage = errors.New("unexpected message")
+	ErrNoGenesisHash     = errors.New("the expected genesis hash is required")
+)
+
+// session is a short-lived, synchronous connection to a single node, used
+// by commands that need something from the network without running a
+// node of their own.
+type session struct {
+	conn    net.Conn
+	magic   [4]byte
+	version *VersionMessage
+}
+
+// openSession connects to address and completes the handshake, announcing
+// genesisHash and bestHeight as our own chain.
+func openSession(config Config, address string, genesisHash []byte, bestHeight int) (*session, error) {
+	if config.Transport == nil {
+		config.Transport = &TCPTransport{DialTimeout: handshakeTimeout}
+	}
+
+	conn, err := config.Transport.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	session := &session{conn: conn, magic: config.Params.Magic}
+	version := VersionMessage{
+		Version:     ProtocolVersion,
+		Network:     config.Params.Name,
+		GenesisHash: genesisHash,
+		BestHeight:  bestHeight,
+		UserAgent:   UserAgent,
+		Timestamp:   time.Now().Unix(),
+	}
+	if err = session.send(NewMessage(CmdVersion, version)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	verack := false
+	for session.version == nil || !verack {
+		message, err := session.receive()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		switch message.Command {
+		case CmdVersion:
+			var remote VersionMessage
+			if err = message.Decode(&remote); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			if remote.Network != config.Params.Name {
+				conn.Close()
+				return nil, fmt.Errorf("%w: %s", ErrWrongNetwork, remote.Network)
+			}
+			if len(genesisHash) != 0 && !bytes.Equal(remote.GenesisHash, genesisHash) {
+				conn.Close()
+				return nil, ErrWrongGenesis
+			}
+			session.version = &remote
+			if err = session.send(NewMessage(CmdVerack, nil)); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		case CmdVerack:
+			verack = true
+		}
+	}
+
+	return session, nil
+}
+
+func (session *session) send(message Message) error {
+	return WriteMessage(session.conn, session.magic, message)
+}
+
+func (session *session) receive() (Message, error) {
+	return ReadMessage(session.conn, session.magic)
+}
+
+func (session *session) Close() error {
+	return session.conn.Close()
+}
+
+// FetchGenesis asks the node at address for the genesis block with
+// genesisHash, so a new node can create its chain before syncing the rest
+// from its peers. The hash must come from somewhere we trust, not the peer.
+func FetchGenesis(config Config, address string, genesisHash []byte) (*blockchain.Block, error) {
+	if len(genesisHash) == 0 {
+		return nil, ErrNoGenesisHash
+	}
+	session, err := openSession(config, address, genesisHash, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	request := InvMessage{Items: []InvVector{{Type: InvTypeBlock, Hash: genesisHash}}}
+	if err = session.send(NewMessage(CmdGetData, request)); err != nil {
+		return nil, err
+	}
+
+	for {
+		message, err := session.receive()
+		if err != nil {
+			return nil, err
+		}
+		if message.Command != CmdBlock {
+			continue
+		}
+
+		block, err := blockchain.Deserialize(message.Payload)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(block.Hash, genesisHash) || block.Height != 0 {
+			return nil, fmt.Errorf("%w: block %x is not the genesis block", ErrUnexpectedMessage, block.Hash)
+		}
+
+		return block, nil
+	}
+}
+
+// SendTransaction hands a transaction to the node at address, which relays
+// it to its own peers if it accepts it.
+func SendTransaction(config Config, address string, chain *blockchain.Blockchain, transaction *blockchain.Transaction) error {
+	genesisHash, err := chain.GenesisHash()
+	if err != nil {
+		return err
+	}
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	session, err := openSession(config, address, genesisHash, bestHeight)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	return session.send(Message{Command: CmdTx, Payload: transaction.Serialize()})
+}
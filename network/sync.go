@@ -0,0 +1,472 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	blockchain "gambim.com/blockchain/chain"
+)
+
+const (
+	// downloadWindow bounds how far past the next block to connect bodies
+	// are requested, and so how many blocks wait in memory.
+	downloadWindow    = 1024
+	maxBlocksInFlight = 16
+	progressInterval  = 10 * time.Second
+)
+
+var ErrNoHeaders = errors.New("peer has no headers past our chain")
+
+type blockRequest struct {
+	peer      *Peer
+	requested time.Time
+}
+
+type downloadedBlock struct {
+	block *blockchain.Block
+	peer  *Peer
+}
+
+// syncState tracks the headers-first block download: the header chain is
+// fetched and checked from one peer, then the bodies are requested in
+// parallel from every peer that has them and connected in order as they
+// arrive.
+type syncState struct {
+	headerPeer       *Peer
+	headersRequested time.Time
+	headers          *blockchain.HeaderChain
+	// next is the position in headers.Hashes of the next block to connect.
+	next       int
+	requests   map[string]*blockRequest
+	inFlight   map[*Peer]int
+	downloaded map[string]downloadedBlock
+	// missing is the lowest height of a header chain block each peer said
+	// it does not have, as a peer on another branch will.
+	missing    map[*Peer]int
+	lastReport time.Time
+}
+
+type SyncStatus struct {
+	Syncing bool
+	Height  int
+	// HeaderHeight is the height of the best header, which the node is
+	// downloading blocks up to.
+	HeaderHeight int
+}
+
+func (status SyncStatus) Progress() float64 {
+	if status.HeaderHeight <= 0 || status.Height >= status.HeaderHeight {
+		return 100
+	}
+
+	return 100 * float64(status.Height) / float64(status.HeaderHeight)
+}
+
+func newSyncState() *syncState {
+	state := &syncState{}
+	state.reset()
+
+	return state
+}
+
+func (state *syncState) reset() {
+	state.headerPeer = nil
+	state.headers = nil
+	state.next = 0
+	state.requests = make(map[string]*blockRequest)
+	state.inFlight = make(map[*Peer]int)
+	state.downloaded = make(map[string]downloadedBlock)
+	state.missing = make(map[*Peer]int)
+}
+
+func (node *Node) SyncStatus() SyncStatus {
+	node.syncMutex.Lock()
+	defer node.syncMutex.Unlock()
+
+	node.Config.Lock.Lock()
+	height, _ := node.chain().GetBestHeight()
+	node.Config.Lock.Unlock()
+
+	status := SyncStatus{Height: height, HeaderHeight: height}
+	if node.sync.headers != nil {
+		status.Syncing = true
+		if headerHeight := node.sync.headers.Height(); headerHeight > height {
+			status.HeaderHeight = headerHeight
+		}
+	}
+
+	return status
+}
+
+// startHeaders starts downloading headers from peer, unless headers are
+// already being downloaded.
+func (node *Node) startHeaders(peer *Peer) {
+	node.syncMutex.Lock()
+	defer node.syncMutex.Unlock()
+
+	if node.sync.headerPeer != nil {
+		return
+	}
+	if node.sync.headers == nil {
+		node.sync.headers = node.chain().NewHeaderChain()
+		node.sync.lastReport = time.Now()
+	}
+	node.requestHeaders(peer)
+}
+
+func (node *Node) requestHeaders(peer *Peer) {
+	node.Config.Lock.Lock()
+	locator, err := node.chain().BlockLocator()
+	node.Config.Lock.Unlock()
+	if err != nil {
+		node.logf("peer %s: %v", peer.Address, err)
+		return
+	}
+	if tipHash, _ := node.sync.headers.Tip(); tipHash != nil {
+		locator = append([][]byte{tipHash}, locator...)
+	}
+
+	node.sync.headerPeer = peer
+	node.sync.headersRequested = time.Now()
+	peer.Send(NewMessage(CmdGetHeaders, GetHeadersMessage{Locator: locator}))
+}
+
+func (node *Node) handleGetHeaders(peer *Peer, message Message) error {
+	var getHeaders GetHeadersMessage
+	if err := message.Decode(&getHeaders); err != nil {
+		return err
+	}
+
+	node.Config.Lock.Lock()
+	headers, err := node.chain().LocateHeaders(getHeaders.Locator, getHeaders.StopHash, MaxHeaders)
+	node.Config.Lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	peer.Send(NewMessage(CmdHeaders, HeadersMessage{Headers: headers}))
+	return nil
+}
+
+func (node *Node) handleHeaders(peer *Peer, message Message) error {
+	var headers HeadersMessage
+	if err := message.Decode(&headers); err != nil {
+		return err
+	}
+	if len(headers.Headers) > MaxHeaders {
+		return fmt.Errorf("%w: %d", ErrTooManyItems, len(headers.Headers))
+	}
+
+	node.syncMutex.Lock()
+	defer node.syncMutex.Unlock()
+
+	state := node.sync
+	if peer != state.headerPeer {
+		return nil
+	}
+
+	node.Config.Lock.Lock()
+	err := state.headers.Add(headers.Headers)
+	node.Config.Lock.Unlock()
+	if errors.Is(err, blockchain.ErrOrphanBlock) && len(state.headers.Hashes) > 0 {
+		// The peer reorganized past the headers we had from it.
+		node.logf("peer %s: headers do not extend our header chain, restarting", peer.Address)
+		node.finishSync()
+		return nil
+	}
+	if err != nil {
+		node.finishSync()
+		return err
+	}
+	if len(headers.Headers) == 0 {
+		// We only ask peers that claim to be ahead of us, so the claim was
+		// false. Believing it would have us ask again forever.
+		height := state.headers.Height()
+		if len(state.headers.Hashes) == 0 {
+			node.Config.Lock.Lock()
+			height, err = node.chain().GetBestHeight()
+			node.Config.Lock.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+		if peer.BestHeight() > height {
+			err = fmt.Errorf("%w: claimed height %d, have %d", ErrNoHeaders, peer.BestHeight(), height)
+			peer.limitBestHeight(height)
+			node.misbehaving(peer, banScore(err), err)
+		}
+	}
+	peer.setBestHeight(state.headers.Height())
+
+	if len(headers.Headers) == MaxHeaders {
+		node.requestHeaders(peer)
+	} else {
+		state.headerPeer = nil
+		node.logf("headers synced to height %d", state.headers.Height())
+	}
+
+	node.scheduleDownloads()
+	node.connectDownloaded()
+
+	return nil
+}
+
+// scheduleDownloads requests the bodies in the download window that are
+// neither downloaded nor requested yet, spreading them over the peers.
+func (node *Node) scheduleDownloads() {
+	state := node.sync
+	if state.headers == nil {
+		return
+	}
+
+	peers := node.Peers()
+	batches := make(map[*Peer][]InvVector)
+	end := state.next + downloadWindow
+	if end > len(state.headers.Hashes) {
+		end = len(state.headers.Hashes)
+	}
+	for position := state.next; position < end; position++ {
+		hash := state.headers.Hashes[position]
+		if _, found := state.downloaded[string(hash)]; found {
+			continue
+		}
+		if _, found := state.requests[string(hash)]; found {
+			continue
+		}
+
+		peer := node.downloadPeer(peers, state.headers.Headers[position].Height)
+		if peer == nil {
+			break
+		}
+		state.requests[string(hash)] = &blockRequest{peer: peer, requested: time.Now()}
+		state.inFlight[peer]++
+		batches[peer] = append(batches[peer], InvVector{Type: InvTypeBlock, Hash: hash})
+	}
+
+	for peer, items := range batches {
+		peer.Send(NewMessage(CmdGetData, InvMessage{Items: items}))
+	}
+}
+
+// downloadPeer picks the least busy peer that has the block at height.
+func (node *Node) downloadPeer(peers []*Peer, height int) *Peer {
+	var best *Peer
+	for _, peer := range peers {
+		inFlight := node.sync.inFlight[peer]
+		if !peer.handshakeDone() || peer.BestHeight() < height || inFlight >= maxBlocksInFlight {
+			continue
+		}
+		if missing, found := node.sync.missing[peer]; found && height >= missing {
+			continue
+		}
+		if best == nil || inFlight < node.sync.inFlight[best] {
+			best = peer
+		}
+	}
+
+	return best
+}
+
+// blockDownloaded takes a block requested by the sync, reporting false for
+// blocks it did not ask for.
+func (node *Node) blockDownloaded(peer *Peer, block *blockchain.Block) bool {
+	node.syncMutex.Lock()
+	defer node.syncMutex.Unlock()
+
+	state := node.sync
+	request, found := state.requests[string(block.Hash)]
+	if !found {
+		return false
+	}
+	delete(state.requests, string(block.Hash))
+	state.inFlight[request.peer]--
+	state.downloaded[string(block.Hash)] = downloadedBlock{block: block, peer: peer}
+
+	node.connectDownloaded()
+	node.scheduleDownloads()
+
+	return true
+}
+
+// handleNotFound drops the requests for blocks the peer does not have and
+// requests them from other peers.
+func (node *Node) handleNotFound(peer *Peer, message Message) error {
+	var notFound InvMessage
+	if err := message.Decode(&notFound); err != nil {
+		return err
+	}
+	if len(notFound.Items) > MaxInvItems {
+		return fmt.Errorf("%w: %d", ErrTooManyItems, len(notFound.Items))
+	}
+
+	node.syncMutex.Lock()
+	defer node.syncMutex.Unlock()
+
+	state := node.sync
+	for _, item := range notFound.Items {
+		request, found := state.requests[string(item.Hash)]
+		if item.Type != InvTypeBlock || !found || request.peer != peer {
+			continue
+		}
+		delete(state.requests, string(item.Hash))
+		state.inFlight[peer]--
+
+		position, _ := state.headers.Position(item.Hash)
+		height := state.headers.Headers[position].Height
+		if missing, found := state.missing[peer]; !found || height < missing {
+			state.missing[peer] = height
+		}
+	}
+	node.scheduleDownloads()
+
+	return nil
+}
+
+// connectDownloaded adds the downloaded blocks that follow the last one
+// connected to the chain.
+func (node *Node) connectDownloaded() {
+	state := node.sync
+	for state.headers != nil && state.next < len(state.headers.Hashes) {
+		hash := state.headers.Hashes[state.next]
+		downloaded, found := state.downloaded[string(hash)]
+		if !found {
+			break
+		}
+		delete(state.downloaded, string(hash))
+
+		_, err := node.processBlock(downloaded.block)
+		if err != nil && !errors.Is(err, blockchain.ErrBlockExists) {
+			node.rejected(downloaded.peer, banScore(err), fmt.Errorf("block %x: %w", hash, err))
+			downloaded.peer.Close()
+			if errors.Is(err, blockchain.ErrBadMerkleRoot) || errors.Is(err, blockchain.ErrBadBlockHash) ||
+				errors.Is(err, blockchain.ErrDuplicateTx) || errors.Is(err, blockchain.ErrBadTransactionID) {
+				// The header is fine, so only the peer's copy is bad;
+				// the block is requested again from someone else.
+				continue
+			}
+			node.finishSync()
+			return
+		}
+		state.next++
+		node.reportProgress(false)
+	}
+
+	if state.headers != nil && state.headerPeer == nil && state.next == len(state.headers.Hashes) {
+		if state.next > 0 {
+			node.reportProgress(true)
+		}
+		node.finishSync()
+	}
+}
+
+func (node *Node) reportProgress(force bool) {
+	state := node.sync
+	if !force && time.Since(state.lastReport) < progressInterval {
+		return
+	}
+	state.lastReport = time.Now()
+
+	headerHeight := state.headers.Height()
+	height := headerHeight
+	if state.next < len(state.headers.Headers) {
+		height = state.headers.Headers[state.next].Height - 1
+	}
+	status := SyncStatus{Syncing: true, Height: height, HeaderHeight: headerHeight}
+	node.logf("synced to height %d of %d (%.1f%%)", status.Height, status.HeaderHeight, status.Progress())
+}
+
+// finishSync drops the header chain and starts over with the best peer
+// that is still ahead of us, if any.
+func (node *Node) finishSync() {
+	node.sync.reset()
+
+	node.Config.Lock.Lock()
+	height, err := node.chain().GetBestHeight()
+	node.Config.Lock.Unlock()
+	if err != nil {
+		node.logf("sync: %v", err)
+		return
+	}
+
+	var best *Peer
+	for _, peer := range node.Peers() {
+		if peer.handshakeDone() && peer.BestHeight() > height && (best == nil || peer.BestHeight() > best.BestHeight()) {
+			best = peer
+		}
+	}
+	if best != nil {
+		node.sync.headers = node.chain().NewHeaderChain()
+		node.sync.lastReport = time.Now()
+		node.requestHeaders(best)
+	}
+}
+
+// syncPeerRemoved hands the requests of a disconnected peer to others.
+func (node *Node) syncPeerRemoved(peer *Peer) {
+	node.syncMutex.Lock()
+	defer node.syncMutex.Unlock()
+
+	state := node.sync
+	for hash, request := range state.requests {
+		if request.peer == peer {
+			delete(state.requests, hash)
+		}
+	}
+	delete(state.inFlight, peer)
+	delete(state.missing, peer)
+
+	if state.headerPeer == peer {
+		state.headerPeer = nil
+		if state.next == 0 && len(state.downloaded) == 0 && len(state.requests) == 0 {
+			node.finishSync()
+			return
+		}
+		for _, other := range node.Peers() {
+			if other.handshakeDone() && other.BestHeight() > state.headers.Height() {
+				node.requestHeaders(other)
+				break
+			}
+		}
+	}
+	node.scheduleDownloads()
+	node.connectDownloaded()
+}
+
+// checkStalls disconnects peers that sit on requests for too long, so
+// their blocks are requested elsewhere.
+func (node *Node) checkStalls() {
+	node.syncMutex.Lock()
+	defer node.syncMutex.Unlock()
+
+	state := node.sync
+	now := time.Now()
+	if state.headerPeer != nil && now.Sub(state.headersRequested) > 2*node.Config.StallTimeout {
+		node.logf("peer %s: timed out sending headers", state.headerPeer.Address)
+		state.headerPeer.Close()
+	}
+	for _, request := range state.requests {
+		if now.Sub(request.requested) > node.Config.StallTimeout {
+			node.logf("peer %s: timed out sending blocks", request.peer.Address)
+			request.peer.Close()
+		}
+	}
+}
+
+func (node *Node) syncLoop() {
+	defer node.wait.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			node.checkStalls()
+			node.syncMutex.Lock()
+			node.scheduleDownloads()
+			node.syncMutex.Unlock()
+		case <-node.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package network
+
+import (
+	"net"
+	"time"
+)
+
+// Transport creates the connections between nodes, so they can run over
+// TCP or over an in-memory network.
+type Transport interface {
+	Listen(address string) (net.Listener, error)
+	Dial(address string) (net.Conn, error)
+}
+
+type TCPTransport struct {
+	DialTimeout time.Duration
+}
+
+func (transport *TCPTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+func (transport *TCPTransport) Dial(address string) (net.Conn, error) {
+	return net.DialTimeout("tcp", address, transport.DialTimeout)
+}
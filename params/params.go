@@ -0,0 +1,100 @@
+package params
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+type Params struct {
+	Name string
+	// DataDirName is the sub directory of the data directory holding this
+	// network's chain and wallets. Mainnet uses the data directory itself.
+	DataDirName    string
+	GenesisMessage string
+	AddressVersion byte
+	// Magic starts every network message so nodes of different networks,
+	// Bitcoin's included, can not talk to each other.
+	Magic       [4]byte
+	DefaultPort int
+	RPCPort     int
+
+	InitialDifficulty int
+	RetargetInterval  int
+	TargetBlockTime   int64
+	NoRetargeting     bool
+
+	InitialSubsidy  int
+	HalvingInterval int
+	MaxSupply       int
+}
+
+var MainNet = Params{
+	Name:           "mainnet",
+	DataDirName:    "",
+	GenesisMessage: "First Transaction from Genesis",
+	AddressVersion: 0x00,
+	Magic:          [4]byte{0xc7, 0x62, 0x6d, 0xe1},
+	DefaultPort:    8433,
+	RPCPort:        8432,
+
+	InitialDifficulty: 12,
+	RetargetInterval:  10,
+	TargetBlockTime:   10,
+
+	InitialSubsidy:  100,
+	HalvingInterval: 210,
+	MaxSupply:       42000,
+}
+
+var TestNet = Params{
+	Name:           "testnet",
+	DataDirName:    "testnet",
+	GenesisMessage: "First Transaction from Testnet Genesis",
+	AddressVersion: 0x6f,
+	Magic:          [4]byte{0xc7, 0x62, 0x6d, 0x7e},
+	DefaultPort:    18433,
+	RPCPort:        18432,
+
+	InitialDifficulty: 8,
+	RetargetInterval:  10,
+	TargetBlockTime:   10,
+
+	InitialSubsidy:  100,
+	HalvingInterval: 210,
+	MaxSupply:       42000,
+}
+
+var RegTest = Params{
+	Name:           "regtest",
+	DataDirName:    "regtest",
+	GenesisMessage: "First Transaction from Regtest Genesis",
+	AddressVersion: 0x6f,
+	Magic:          [4]byte{0xc7, 0x62, 0x6d, 0xfe},
+	DefaultPort:    18544,
+	RPCPort:        18543,
+
+	InitialDifficulty: 1,
+	RetargetInterval:  10,
+	TargetBlockTime:   10,
+	NoRetargeting:     true,
+
+	InitialSubsidy:  50,
+	HalvingInterval: 150,
+	MaxSupply:       15000,
+}
+
+var networks = []*Params{&MainNet, &TestNet, &RegTest}
+
+func ByName(name string) (*Params, error) {
+	for _, network := range networks {
+		if network.Name == name {
+			return network, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown network %q", name)
+}
+
+func (params *Params) DataDir(baseDir string) string {
+	return filepath.Join(baseDir, params.DataDirName)
+}
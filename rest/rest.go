@@ -0,0 +1,54 @@
+package rest
+
+import (
+	blockchain "gambim.com/blockchain/chain"
+)
+
+type ErrorResult struct {
+	Error string `json:"error"`
+}
+
+type BlockResult struct {
+	blockchain.BlockJSON
+	Confirmations int `json:"confirmations"`
+}
+
+type TransactionResult struct {
+	blockchain.TransactionJSON
+	BlockHash     string `json:"blockhash,omitempty"`
+	Height        int    `json:"height,omitempty"`
+	Confirmations int    `json:"confirmations"`
+}
+
+type TipResult struct {
+	blockchain.BlockHeaderJSON
+	ChainWork string `json:"chainwork"`
+}
+
+type UnspentResult struct {
+	TxID    string `json:"txid"`
+	Vout    int    `json:"vout"`
+	Value   int    `json:"value"`
+	Address string `json:"address"`
+	// Pending is set for outputs spent by a mempool transaction.
+	Pending bool `json:"pending"`
+}
+
+type HistoryEntryResult struct {
+	TxID           string   `json:"txid"`
+	BlockHash      string   `json:"blockhash"`
+	Height         int      `json:"height"`
+	Confirmations  int      `json:"confirmations"`
+	Received       int      `json:"received"`
+	Sent           int      `json:"sent"`
+	Balance        int      `json:"balance"`
+	Coinbase       bool     `json:"coinbase"`
+	Counterparties []string `json:"counterparties"`
+}
+
+type HistoryResult struct {
+	Address string               `json:"address"`
+	Total   int                  `json:"total"`
+	Offset  int                  `json:"offset"`
+	Entries []HistoryEntryResult `json:"entries"`
+}
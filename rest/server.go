@@ -0,0 +1,295 @@
+package rest
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	blockchain "gambim.com/blockchain/chain"
+	"gambim.com/blockchain/mempool"
+	"gambim.com/blockchain/wallet"
+)
+
+const defaultHistoryLimit = 20
+
+var errNotFound = errors.New("not found")
+
+type Config struct {
+	Address string
+	// Lock is held while serving a request. Share it with anything else
+	// using the chain.
+	Lock sync.Locker
+}
+
+// Server serves read-only JSON views of the chain:
+//
+//	GET /tip
+//	GET /blocks/{hash|height}
+//	GET /tx/{id}
+//	GET /address/{address}/utxos
+//	GET /address/{address}/history?offset=N&limit=N
+type Server struct {
+	UTXOSet *blockchain.UTXOSet
+	Mempool *mempool.Mempool
+	Config  Config
+
+	httpServer *http.Server
+}
+
+func NewServer(utxoSet *blockchain.UTXOSet, pool *mempool.Mempool, config Config) *Server {
+	if config.Lock == nil {
+		config.Lock = &sync.Mutex{}
+	}
+
+	return &Server{UTXOSet: utxoSet, Mempool: pool, Config: config}
+}
+
+func (server *Server) Start() error {
+	listener, err := net.Listen("tcp", server.Config.Address)
+	if err != nil {
+		return err
+	}
+
+	server.httpServer = &http.Server{Handler: server}
+	go server.httpServer.Serve(listener)
+
+	return nil
+}
+
+func (server *Server) Stop(ctx context.Context) error {
+	if server.httpServer == nil {
+		return nil
+	}
+
+	return server.httpServer.Shutdown(ctx)
+}
+
+func (server *Server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		writer.Header().Set("Allow", http.MethodGet)
+		writeJSON(writer, http.StatusMethodNotAllowed, ErrorResult{Error: "method not allowed"})
+		return
+	}
+
+	server.Config.Lock.Lock()
+	result, err := server.route(request)
+	server.Config.Lock.Unlock()
+	if err != nil {
+		writeJSON(writer, statusCode(err), ErrorResult{Error: err.Error()})
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, result)
+}
+
+func (server *Server) route(request *http.Request) (interface{}, error) {
+	parts := strings.Split(strings.Trim(request.URL.Path, "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "tip":
+		return server.tip()
+	case len(parts) == 2 && parts[0] == "blocks":
+		return server.block(parts[1])
+	case len(parts) == 2 && parts[0] == "tx":
+		return server.transaction(parts[1])
+	case len(parts) == 3 && parts[0] == "address" && parts[2] == "utxos":
+		return server.unspentOutputs(parts[1])
+	case len(parts) == 3 && parts[0] == "address" && parts[2] == "history":
+		return server.history(parts[1], request.URL.Query())
+	}
+
+	return nil, errNotFound
+}
+
+func writeJSON(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(value)
+}
+
+type badRequestError struct {
+	err error
+}
+
+func (err badRequestError) Error() string {
+	return err.err.Error()
+}
+
+func (err badRequestError) Unwrap() error {
+	return err.err
+}
+
+func statusCode(err error) int {
+	var badRequest badRequestError
+	switch {
+	case errors.As(err, &badRequest), errors.Is(err, wallet.ErrInvalidAddress), errors.Is(err, blockchain.ErrAmbiguousHash):
+		return http.StatusBadRequest
+	case errors.Is(err, errNotFound), errors.Is(err, blockchain.ErrBlockNotFound), errors.Is(err, blockchain.ErrTransactionNotFound):
+		return http.StatusNotFound
+	}
+
+	return http.StatusInternalServerError
+}
+
+func (server *Server) version() byte {
+	return server.UTXOSet.Chain.Params.AddressVersion
+}
+
+func (server *Server) tip() (interface{}, error) {
+	chain := server.UTXOSet.Chain
+
+	header, err := chain.GetBlockHeader(chain.LastHash)
+	if err != nil {
+		return nil, err
+	}
+	index, err := chain.GetBlockIndex(chain.LastHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return TipResult{BlockHeaderJSON: header.JSON(chain.LastHash), ChainWork: index.Work().Text(16)}, nil
+}
+
+// block treats decimal ids shorter than a hash as heights and anything else
+// as a (prefix of a) hex block hash.
+func (server *Server) block(id string) (interface{}, error) {
+	chain := server.UTXOSet.Chain
+
+	var block blockchain.Block
+	var err error
+	if height, parseErr := strconv.Atoi(id); parseErr == nil && len(id) < 2*len(chain.LastHash) {
+		block, err = chain.GetBlockByHeight(height)
+	} else {
+		block, err = chain.GetBlockByHash(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	confirmations, err := chain.Confirmations(block.Hash, block.Height)
+	if err != nil {
+		return nil, err
+	}
+
+	return BlockResult{BlockJSON: block.JSON(server.version()), Confirmations: confirmations}, nil
+}
+
+func (server *Server) transaction(id string) (interface{}, error) {
+	transactionId, err := hex.DecodeString(id)
+	if err != nil {
+		return nil, badRequestError{err: err}
+	}
+
+	if entry, ok := server.Mempool.Get(transactionId); ok {
+		return TransactionResult{TransactionJSON: entry.Transaction.JSON(server.version())}, nil
+	}
+
+	chain := server.UTXOSet.Chain
+	transaction, block, err := chain.GetTransaction(transactionId)
+	if err != nil {
+		return nil, err
+	}
+	confirmations, err := chain.Confirmations(block.Hash, block.Height)
+	if err != nil {
+		return nil, err
+	}
+
+	return TransactionResult{
+		TransactionJSON: transaction.JSON(server.version()),
+		BlockHash:       hex.EncodeToString(block.Hash),
+		Height:          block.Height,
+		Confirmations:   confirmations,
+	}, nil
+}
+
+func (server *Server) unspentOutputs(address string) (interface{}, error) {
+	publicKeyHash, err := wallet.DecodeAddress(address, server.version())
+	if err != nil {
+		return nil, err
+	}
+
+	unspentOutputs, err := server.UTXOSet.FindUnspentOutputs(publicKeyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []UnspentResult{}
+	for _, unspent := range unspentOutputs {
+		results = append(results, UnspentResult{
+			TxID:    hex.EncodeToString(unspent.TransactionID),
+			Vout:    unspent.OutputIndex,
+			Value:   unspent.Output.Value,
+			Address: address,
+			Pending: server.Mempool.IsSpent(unspent.TransactionID, unspent.OutputIndex),
+		})
+	}
+
+	return results, nil
+}
+
+func queryInt(query url.Values, name string, fallback int) (int, error) {
+	if query.Get(name) == "" {
+		return fallback, nil
+	}
+
+	value, err := strconv.Atoi(query.Get(name))
+	if err != nil || value < 0 {
+		return 0, badRequestError{err: errors.New(name + " must be a non-negative integer")}
+	}
+
+	return value, nil
+}
+
+func (server *Server) history(address string, query url.Values) (interface{}, error) {
+	version := server.version()
+	publicKeyHash, err := wallet.DecodeAddress(address, version)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := queryInt(query, "offset", 0)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := queryInt(query, "limit", defaultHistoryLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := server.UTXOSet.Chain
+	entries, total, err := chain.AddressHistory(publicKeyHash, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return nil, err
+	}
+
+	result := HistoryResult{Address: address, Total: total, Offset: offset, Entries: []HistoryEntryResult{}}
+	for _, entry := range entries {
+		counterparties := []string{}
+		for _, counterparty := range entry.Counterparties {
+			counterparties = append(counterparties, string(wallet.EncodeAddress(counterparty, version)))
+		}
+		result.Entries = append(result.Entries, HistoryEntryResult{
+			TxID:           hex.EncodeToString(entry.TransactionID),
+			BlockHash:      hex.EncodeToString(entry.BlockHash),
+			Height:         entry.Height,
+			Confirmations:  bestHeight - entry.Height + 1,
+			Received:       entry.Received,
+			Sent:           entry.Sent,
+			Balance:        entry.Balance,
+			Coinbase:       entry.Coinbase,
+			Counterparties: counterparties,
+		})
+	}
+
+	return result, nil
+}
@@ -0,0 +1,186 @@
+package rest
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	blockchain "gambim.com/blockchain/chain"
+	"gambim.com/blockchain/mempool"
+	"gambim.com/blockchain/params"
+	"gambim.com/blockchain/storage"
+	"gambim.com/blockchain/wallet"
+)
+
+type testServer struct {
+	server  *Server
+	address string
+	// blocks are the main chain, genesis first.
+	blocks []blockchain.Block
+}
+
+// newTestServer serves a chain in memory of at least count blocks, more if
+// needed for two of their hashes to share an ambiguousPrefix.
+func newTestServer(t *testing.T, count int) *testServer {
+	t.Helper()
+
+	wlt, err := wallet.MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	test := &testServer{address: string(wallet.EncodeAddress(wallet.PublicKeyHash(wlt.PublicKey), params.RegTest.AddressVersion))}
+	chain, err := blockchain.CreateBlockchain(storage.NewMemory(), &params.RegTest, test.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { chain.Database.Close() })
+	genesis, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.blocks = append(test.blocks, genesis)
+
+	for len(test.blocks) < count || test.ambiguousPrefix() == "" {
+		height := len(test.blocks)
+		if height > count+100 {
+			t.Fatal("no two block hashes share a prefix")
+		}
+		coinbase, err := blockchain.CoinBaseTx(test.address, params.RegTest.AddressVersion, fmt.Sprintf("block %d", height), chain.MonetaryPolicy().SubsidyAtHeight(height))
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, err := chain.MineBlock(context.Background(), []*blockchain.Transaction{coinbase})
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.blocks = append(test.blocks, *block)
+	}
+
+	utxoSet := blockchain.NewUTXOSet(chain)
+	test.server = NewServer(utxoSet, mempool.New(utxoSet, mempool.DefaultConfig), Config{})
+
+	return test
+}
+
+// ambiguousPrefix starts more than one block hash. It runs up to the first
+// letter, so that it is not taken for a height.
+func (test *testServer) ambiguousPrefix() string {
+	seen := make(map[string]bool)
+	for _, block := range test.blocks {
+		hash := hex.EncodeToString(block.Hash)
+		prefix := hash[:strings.IndexAny(hash, "abcdef")+1]
+		if prefix == "" {
+			continue
+		}
+		if seen[prefix] {
+			return prefix
+		}
+		seen[prefix] = true
+	}
+
+	return ""
+}
+
+func (test *testServer) get(t *testing.T, path string, result interface{}) int {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	test.server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("GET %s: content type %q", path, contentType)
+	}
+	if result != nil {
+		if err := json.NewDecoder(recorder.Body).Decode(result); err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+	}
+
+	return recorder.Code
+}
+
+func TestBlockByHeightOrHash(t *testing.T) {
+	test := newTestServer(t, 3)
+	tip := len(test.blocks) - 1
+
+	for _, id := range []string{
+		"2",
+		hex.EncodeToString(test.blocks[2].Hash),
+		hex.EncodeToString(test.blocks[2].Hash)[:63],
+		strings.ToUpper(hex.EncodeToString(test.blocks[2].Hash)),
+	} {
+		var result BlockResult
+		if status := test.get(t, "/blocks/"+id, &result); status != http.StatusOK {
+			t.Errorf("GET /blocks/%s: status %d", id, status)
+			continue
+		}
+		if result.Hash != hex.EncodeToString(test.blocks[2].Hash) || result.Height != 2 {
+			t.Errorf("GET /blocks/%s = block %s at %d, want block 2", id, result.Hash, result.Height)
+		}
+		if result.Confirmations != tip-1 {
+			t.Errorf("GET /blocks/%s: %d confirmations, want %d", id, result.Confirmations, tip-1)
+		}
+	}
+
+	var tipResult TipResult
+	if status := test.get(t, "/tip", &tipResult); status != http.StatusOK || tipResult.Height != tip {
+		t.Errorf("GET /tip = %d at height %d, want %d", status, tipResult.Height, tip)
+	}
+}
+
+func TestBadRequests(t *testing.T) {
+	test := newTestServer(t, 1)
+	history := "/address/" + test.address + "/history"
+
+	for _, path := range []string{
+		"/blocks/" + test.ambiguousPrefix(),
+		history + "?offset=-1",
+		history + "?limit=-1",
+		history + "?limit=ten",
+		"/address/notanaddress/utxos",
+		"/tx/nothex",
+	} {
+		var result ErrorResult
+		if status := test.get(t, path, &result); status != http.StatusBadRequest || result.Error == "" {
+			t.Errorf("GET %s: status %d, error %q, want %d", path, status, result.Error, http.StatusBadRequest)
+		}
+	}
+
+	var result HistoryResult
+	if status := test.get(t, history+"?offset=1&limit=2", &result); status != http.StatusOK {
+		t.Errorf("GET %s: status %d", history, status)
+	} else if result.Offset != 1 || len(result.Entries) != 2 || result.Total != len(test.blocks) {
+		t.Errorf("history has %d of %d entries from %d, want 2 of %d from 1", len(result.Entries), result.Total, result.Offset, len(test.blocks))
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	test := newTestServer(t, 1)
+	missing := strings.Repeat("0", 64)
+
+	for _, path := range []string{
+		"/",
+		"/nothing",
+		"/blocks",
+		"/blocks/1/more",
+		fmt.Sprintf("/blocks/%d", len(test.blocks)),
+		"/blocks/-1",
+		"/blocks/" + missing,
+		"/tx/" + missing,
+	} {
+		var result ErrorResult
+		if status := test.get(t, path, &result); status != http.StatusNotFound || result.Error == "" {
+			t.Errorf("GET %s: status %d, error %q, want %d", path, status, result.Error, http.StatusNotFound)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	test.server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/tip", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /tip: status %d, want %d", recorder.Code, http.StatusMethodNotAllowed)
+	}
+}
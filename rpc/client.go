@@ -0,0 +1,82 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type Client struct {
+	URL      string
+	Username string
+	Password string
+
+	httpClient *http.Client
+	lastID     int64
+}
+
+func NewClient(url string, username string, password string) *Client {
+	return &Client{
+		URL:        url,
+		Username:   username,
+		Password:   password,
+		httpClient: &http.Client{Timeout: time.Minute},
+	}
+}
+
+// Call invokes method with positional params and decodes the result into
+// result unless it is nil. Errors returned by the server are *Error values.
+func (client *Client) Call(method string, params []interface{}, result interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	encodedParams, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	id, err := json.Marshal(atomic.AddInt64(&client.lastID, 1))
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(Request{JSONRPC: Version, Method: method, Params: encodedParams, ID: id})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, client.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if client.Username != "" || client.Password != "" {
+		request.SetBasicAuth(client.Username, client.Password)
+	}
+
+	httpResponse, err := client.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(httpResponse.Body, 512))
+		return fmt.Errorf("rpc server returned %s: %s", httpResponse.Status, bytes.TrimSpace(message))
+	}
+
+	var response Response
+	if err = json.NewDecoder(httpResponse.Body).Decode(&response); err != nil {
+		return err
+	}
+	if response.Error != nil {
+		return response.Error
+	}
+	if result == nil {
+		return nil
+	}
+
+	return json.Unmarshal(response.Result, result)
+}
@@ -0,0 +1,48 @@
+package rpc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// CookieFile holds generated credentials for a node started without
+	// a username and password, readable only by the user running it.
+	CookieFile = ".cookie"
+	CookieUser = "__cookie__"
+)
+
+// WriteCookie generates a random password and saves it to path.
+func WriteCookie(path string) (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	password := hex.EncodeToString(secret)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(path, []byte(CookieUser+":"+password), 0600); err != nil {
+		return "", "", err
+	}
+
+	return CookieUser, password, nil
+}
+
+func ReadCookie(path string) (string, string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	username, password, found := strings.Cut(strings.TrimSpace(string(content)), ":")
+	if !found {
+		return "", "", fmt.Errorf("%s: malformed cookie", path)
+	}
+
+	return username, password, nil
+}
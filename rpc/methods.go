@@ -0,0 +1,297 @@
+package rpc
+
+import (
+	"encoding/hex"
+	"encoding/json"
+
+	blockchain "gambim.com/blockchain/chain"
+	"gambim.com/blockchain/wallet"
+)
+
+type handler func(server *Server, params json.RawMessage) (interface{}, error)
+
+var handlers = map[string]handler{
+	"getblock":        getBlock,
+	"getblockcount":   getBlockCount,
+	"gettransaction":  getTransaction,
+	"getbalance":      getBalance,
+	"sendtoaddress":   sendToAddress,
+	"listunspent":     listUnspent,
+	"getnewaddress":   getNewAddress,
+	"validateaddress": validateAddress,
+	"getpeerinfo":     getPeerInfo,
+	"listbanned":      listBanned,
+}
+
+// parseParams decodes positional params into targets, of which the first
+// required ones must be present.
+func parseParams(raw json.RawMessage, required int, targets ...interface{}) error {
+	var params []json.RawMessage
+	if len(raw) != 0 && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return NewError(ErrCodeInvalidParams, "params must be an array")
+		}
+	}
+	if len(params) < required || len(params) > len(targets) {
+		return NewError(ErrCodeInvalidParams, "expected %d to %d params, got %d", required, len(targets), len(params))
+	}
+
+	for i, param := range params {
+		if err := json.Unmarshal(param, targets[i]); err != nil {
+			return NewError(ErrCodeInvalidParams, "param %d: %v", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+func (server *Server) version() byte {
+	return server.UTXOSet.Chain.Params.AddressVersion
+}
+
+func (server *Server) publicKeyHash(address string) ([]byte, error) {
+	return wallet.DecodeAddress(address, server.version())
+}
+
+func getBlockCount(server *Server, params json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+
+	return server.UTXOSet.Chain.GetBestHeight()
+}
+
+// getBlock takes either a height or a (prefix of a) hex block hash.
+func getBlock(server *Server, params json.RawMessage) (interface{}, error) {
+	var id json.RawMessage
+	if err := parseParams(params, 1, &id); err != nil {
+		return nil, err
+	}
+
+	chain := server.UTXOSet.Chain
+	var block blockchain.Block
+	var height int
+	var hash string
+	var err error
+	if json.Unmarshal(id, &height) == nil {
+		block, err = chain.GetBlockByHeight(height)
+	} else if json.Unmarshal(id, &hash) == nil {
+		block, err = chain.GetBlockByHash(hash)
+	} else {
+		return nil, NewError(ErrCodeInvalidParams, "param 1 must be a height or a block hash")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	confirmations, err := server.UTXOSet.Chain.Confirmations(block.Hash, block.Height)
+	if err != nil {
+		return nil, err
+	}
+
+	result := BlockResult{
+		BlockHeaderJSON: block.BlockHeader.JSON(block.Hash),
+		Confirmations:   confirmations,
+		Transactions:    []string{},
+	}
+	for _, transaction := range block.Transactions {
+		result.Transactions = append(result.Transactions, hex.EncodeToString(transaction.ID))
+	}
+
+	return result, nil
+}
+
+// getTransaction also finds transactions waiting in the mempool, which have
+// no confirmations.
+func getTransaction(server *Server, params json.RawMessage) (interface{}, error) {
+	var id string
+	if err := parseParams(params, 1, &id); err != nil {
+		return nil, err
+	}
+	transactionId, err := hex.DecodeString(id)
+	if err != nil {
+		return nil, NewError(ErrCodeInvalidParams, "invalid transaction ID: %v", err)
+	}
+
+	if entry, ok := server.Mempool.Get(transactionId); ok {
+		return TransactionResult{TransactionJSON: entry.Transaction.JSON(server.version())}, nil
+	}
+
+	transaction, block, err := server.UTXOSet.Chain.GetTransaction(transactionId)
+	if err != nil {
+		return nil, err
+	}
+	confirmations, err := server.UTXOSet.Chain.Confirmations(block.Hash, block.Height)
+	if err != nil {
+		return nil, err
+	}
+
+	return TransactionResult{
+		TransactionJSON: transaction.JSON(server.version()),
+		BlockHash:       hex.EncodeToString(block.Hash),
+		Height:          block.Height,
+		Confirmations:   confirmations,
+	}, nil
+}
+
+func getBalance(server *Server, params json.RawMessage) (interface{}, error) {
+	var address string
+	if err := parseParams(params, 1, &address); err != nil {
+		return nil, err
+	}
+	publicKeyHash, err := server.publicKeyHash(address)
+	if err != nil {
+		return nil, err
+	}
+
+	outputs, err := server.UTXOSet.FindUnspentTransactionOutputs(publicKeyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	balance := 0
+	for _, output := range outputs {
+		balance += output.Value
+	}
+
+	return balance, nil
+}
+
+func listUnspent(server *Server, params json.RawMessage) (interface{}, error) {
+	var address string
+	if err := parseParams(params, 1, &address); err != nil {
+		return nil, err
+	}
+	publicKeyHash, err := server.publicKeyHash(address)
+	if err != nil {
+		return nil, err
+	}
+
+	unspentOutputs, err := server.UTXOSet.FindUnspentOutputs(publicKeyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []UnspentResult{}
+	for _, unspent := range unspentOutputs {
+		if server.Mempool.IsSpent(unspent.TransactionID, unspent.OutputIndex) {
+			continue
+		}
+		results = append(results, UnspentResult{
+			TxID:    hex.EncodeToString(unspent.TransactionID),
+			Vout:    unspent.OutputIndex,
+			Address: address,
+			Amount:  unspent.Output.Value,
+		})
+	}
+
+	return results, nil
+}
+
+// sendToAddress takes [from, to, amount, fee]; the fee defaults to 0.
+func sendToAddress(server *Server, params json.RawMessage) (interface{}, error) {
+	var from, to string
+	var amount, fee int
+	if err := parseParams(params, 3, &from, &to, &amount, &fee); err != nil {
+		return nil, err
+	}
+	if amount <= 0 || fee < 0 {
+		return nil, NewError(ErrCodeInvalidParams, "amount must be positive and fee must not be negative")
+	}
+	if _, err := server.publicKeyHash(from); err != nil {
+		return nil, err
+	}
+
+	wlt, err := server.Wallets.GetWallet(from)
+	if err != nil {
+		return nil, err
+	}
+
+	transaction, err := blockchain.NewTransaction(&wlt, to, amount, fee, server.UTXOSet)
+	if err != nil {
+		return nil, err
+	}
+	if err = server.Mempool.Add(transaction); err != nil {
+		return nil, NewError(ErrCodeRejected, "transaction rejected: %v", err)
+	}
+	if err = server.Mempool.Save(); err != nil {
+		return nil, err
+	}
+	if server.Config.Broadcast != nil {
+		server.Config.Broadcast(transaction)
+	}
+
+	return hex.EncodeToString(transaction.ID), nil
+}
+
+func getNewAddress(server *Server, params json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+
+	address, err := server.Wallets.AddWallet()
+	if err != nil {
+		return nil, err
+	}
+	if err = server.Wallets.SaveFile(); err != nil {
+		return nil, err
+	}
+
+	return address, nil
+}
+
+func validateAddress(server *Server, params json.RawMessage) (interface{}, error) {
+	var address string
+	if err := parseParams(params, 1, &address); err != nil {
+		return nil, err
+	}
+
+	if _, err := server.publicKeyHash(address); err != nil {
+		return ValidateAddressResult{IsValid: false}, nil
+	}
+	_, isMine := server.Wallets.Wallets[address]
+
+	return ValidateAddressResult{IsValid: true, Address: address, IsMine: isMine}, nil
+}
+
+func getPeerInfo(server *Server, params json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	if server.Config.Peers == nil {
+		return nil, NewError(ErrCodeP2PDisabled, "not connected to a network")
+	}
+
+	results := []PeerInfoResult{}
+	for _, peer := range server.Config.Peers() {
+		results = append(results, PeerInfoResult{
+			Address:        peer.Address,
+			ListenAddress:  peer.ListenAddress,
+			Inbound:        peer.Inbound,
+			Version:        peer.Version,
+			UserAgent:      peer.UserAgent,
+			StartingHeight: peer.StartingHeight,
+			BestHeight:     peer.BestHeight,
+			BanScore:       peer.BanScore,
+			ConnectedTime:  peer.ConnectedAt.Unix(),
+		})
+	}
+
+	return results, nil
+}
+
+func listBanned(server *Server, params json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	if server.Config.Bans == nil {
+		return nil, NewError(ErrCodeP2PDisabled, "not connected to a network")
+	}
+
+	results := []BannedResult{}
+	for _, ban := range server.Config.Bans() {
+		results = append(results, BannedResult{Address: ban.Host, BannedUntil: ban.Until.Unix()})
+	}
+
+	return results, nil
+}
@@ -0,0 +1,94 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+
+	blockchain "gambim.com/blockchain/chain"
+)
+
+const Version = "2.0"
+
+const (
+	ErrCodeParse          = -32700
+	ErrCodeInvalidRequest = -32600
+	ErrCodeMethodNotFound = -32601
+	ErrCodeInvalidParams  = -32602
+	ErrCodeInternal       = -32603
+
+	ErrCodeWallet            = -4
+	ErrCodeInvalidAddressKey = -5
+	ErrCodeInsufficientFunds = -6
+	ErrCodeRejected          = -26
+	ErrCodeP2PDisabled       = -31
+)
+
+type Request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+type Response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("%s (code %d)", err.Message, err.Code)
+}
+
+func NewError(code int, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+type BlockResult struct {
+	blockchain.BlockHeaderJSON
+	Confirmations int      `json:"confirmations"`
+	Transactions  []string `json:"tx"`
+}
+
+type TransactionResult struct {
+	blockchain.TransactionJSON
+	BlockHash     string `json:"blockhash,omitempty"`
+	Height        int    `json:"height,omitempty"`
+	Confirmations int    `json:"confirmations"`
+}
+
+type UnspentResult struct {
+	TxID    string `json:"txid"`
+	Vout    int    `json:"vout"`
+	Address string `json:"address"`
+	Amount  int    `json:"amount"`
+}
+
+type PeerInfoResult struct {
+	Address        string `json:"addr"`
+	ListenAddress  string `json:"addrlisten,omitempty"`
+	Inbound        bool   `json:"inbound"`
+	Version        int    `json:"version"`
+	UserAgent      string `json:"subver"`
+	StartingHeight int    `json:"startingheight"`
+	BestHeight     int    `json:"bestheight"`
+	BanScore       int    `json:"banscore"`
+	ConnectedTime  int64  `json:"conntime"`
+}
+
+type BannedResult struct {
+	Address     string `json:"address"`
+	BannedUntil int64  `json:"banned_until"`
+}
+
+type ValidateAddressResult struct {
+	IsValid bool   `json:"isvalid"`
+	Address string `json:"address,omitempty"`
+	IsMine  bool   `json:"ismine"`
+}
@@ -0,0 +1,196 @@
+package rpc
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"sync"
+
+	blockchain "gambim.com/blockchain/chain"
+	"gambim.com/blockchain/mempool"
+	"gambim.com/blockchain/network"
+	"gambim.com/blockchain/wallet"
+)
+
+const maxRequestSize = 1 << 20
+
+var ErrNoCredentials = errors.New("a JSON-RPC username or password is required")
+
+type Config struct {
+	Address string
+	// Username and Password are required from every request; they can not
+	// both be empty. See WriteCookie.
+	Username string
+	Password string
+	// Lock serializes calls: Blockchain.LastHash and Wallets are not safe
+	// for concurrent use. Share it with anything else using the chain.
+	Lock sync.Locker
+	// Broadcast, if set, is called with every transaction sendtoaddress
+	// adds to the mempool.
+	Broadcast func(*blockchain.Transaction)
+	// Peers, if set, describes the connected peers for getpeerinfo.
+	Peers func() []network.PeerInfo
+	// Bans, if set, lists the banned hosts for listbanned.
+	Bans func() []network.Ban
+}
+
+type Server struct {
+	UTXOSet *blockchain.UTXOSet
+	Mempool *mempool.Mempool
+	Wallets *wallet.Wallets
+	Config  Config
+
+	httpServer *http.Server
+}
+
+func NewServer(utxoSet *blockchain.UTXOSet, pool *mempool.Mempool, wallets *wallet.Wallets, config Config) *Server {
+	if config.Lock == nil {
+		config.Lock = &sync.Mutex{}
+	}
+
+	return &Server{UTXOSet: utxoSet, Mempool: pool, Wallets: wallets, Config: config}
+}
+
+// Start listens on Config.Address and serves requests in the background.
+func (server *Server) Start() error {
+	if server.Config.Username == "" && server.Config.Password == "" {
+		return ErrNoCredentials
+	}
+	listener, err := net.Listen("tcp", server.Config.Address)
+	if err != nil {
+		return err
+	}
+
+	server.httpServer = &http.Server{Handler: server}
+	go server.httpServer.Serve(listener)
+
+	return nil
+}
+
+func (server *Server) Stop(ctx context.Context) error {
+	if server.httpServer == nil {
+		return nil
+	}
+
+	return server.httpServer.Shutdown(ctx)
+}
+
+func (server *Server) authorized(request *http.Request) bool {
+	username, password, ok := request.BasicAuth()
+	if !ok {
+		return false
+	}
+	validUser := subtle.ConstantTimeCompare([]byte(username), []byte(server.Config.Username))
+	validPassword := subtle.ConstantTimeCompare([]byte(password), []byte(server.Config.Password))
+
+	return validUser&validPassword == 1
+}
+
+func (server *Server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		http.Error(writer, "JSON-RPC requests must use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !server.authorized(request) {
+		writer.Header().Set("WWW-Authenticate", `Basic realm="jsonrpc"`)
+		http.Error(writer, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// Browsers can not send this content type cross-site without a CORS
+	// preflight, which is never answered, so web pages can not call us.
+	if mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		http.Error(writer, "JSON-RPC requests must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(request.Body, maxRequestSize))
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response := server.handle(body)
+	if response == nil {
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(response)
+}
+
+// handle returns nil for notifications, which get no response.
+func (server *Server) handle(body []byte) *Response {
+	response := &Response{JSONRPC: Version, ID: json.RawMessage("null")}
+
+	var request Request
+	if err := json.Unmarshal(body, &request); err != nil {
+		response.Error = NewError(ErrCodeParse, "parse error: %v", err)
+		return response
+	}
+	if request.ID != nil {
+		response.ID = request.ID
+	}
+	if request.JSONRPC != Version || request.Method == "" {
+		response.Error = NewError(ErrCodeInvalidRequest, "invalid request")
+		return response
+	}
+
+	result, err := server.call(request.Method, request.Params)
+	if request.ID == nil {
+		return nil
+	}
+	if err != nil {
+		response.Error = toError(err)
+		return response
+	}
+
+	response.Result, err = json.Marshal(result)
+	if err != nil {
+		response.Error = toError(err)
+	}
+
+	return response
+}
+
+func (server *Server) call(method string, params json.RawMessage) (interface{}, error) {
+	handler, ok := handlers[method]
+	if !ok {
+		return nil, NewError(ErrCodeMethodNotFound, "method %q not found", method)
+	}
+
+	server.Config.Lock.Lock()
+	defer server.Config.Lock.Unlock()
+
+	return handler(server, params)
+}
+
+func toError(err error) *Error {
+	var rpcErr *Error
+	switch {
+	case errors.As(err, &rpcErr):
+		return rpcErr
+	case errors.Is(err, wallet.ErrInvalidAddress),
+		errors.Is(err, blockchain.ErrBlockNotFound),
+		errors.Is(err, blockchain.ErrAmbiguousHash),
+		errors.Is(err, blockchain.ErrTransactionNotFound):
+		return NewError(ErrCodeInvalidAddressKey, "%v", err)
+	case errors.Is(err, wallet.ErrWalletNotFound):
+		return NewError(ErrCodeWallet, "%v", err)
+	case errors.Is(err, blockchain.ErrInsufficientFunds):
+		return NewError(ErrCodeInsufficientFunds, "%v", err)
+	case errors.Is(err, mempool.ErrAlreadyExists),
+		errors.Is(err, mempool.ErrConflict),
+		errors.Is(err, mempool.ErrFeeTooLow),
+		errors.Is(err, mempool.ErrMempoolFull):
+		return NewError(ErrCodeRejected, "%v", err)
+	}
+
+	return NewError(ErrCodeInternal, "%v", err)
+}
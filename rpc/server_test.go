@@ -0,0 +1,143 @@
+package rpc
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	blockchain "gambim.com/blockchain/chain"
+	"gambim.com/blockchain/mempool"
+	"gambim.com/blockchain/params"
+	"gambim.com/blockchain/storage"
+	"gambim.com/blockchain/wallet"
+)
+
+const (
+	testUser     = "user"
+	testPassword = "password"
+)
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+
+	wallets, err := wallet.CreateWallets(t.TempDir(), params.RegTest.AddressVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, err := wallets.AddWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := blockchain.CreateBlockchain(storage.NewMemory(), &params.RegTest, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { chain.Database.Close() })
+	utxoSet := blockchain.NewUTXOSet(chain)
+
+	return NewServer(utxoSet, mempool.New(utxoSet, mempool.DefaultConfig), wallets, Config{Username: testUser, Password: testPassword})
+}
+
+func serve(server *Server, method string, contentType string, user string, password string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, "/", strings.NewReader(`{"jsonrpc":"2.0","method":"getblockcount","id":1}`))
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	if user != "" || password != "" {
+		request.SetBasicAuth(user, password)
+	}
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+
+	return recorder
+}
+
+func TestServerRejectsBadRequests(t *testing.T) {
+	server := newTestServer(t)
+
+	for _, test := range []struct {
+		name        string
+		method      string
+		contentType string
+		user        string
+		password    string
+		status      int
+	}{
+		{"no credentials", http.MethodPost, "application/json", "", "", http.StatusUnauthorized},
+		{"wrong password", http.MethodPost, "application/json", testUser, "wrong", http.StatusUnauthorized},
+		{"wrong user", http.MethodPost, "application/json", "other", testPassword, http.StatusUnauthorized},
+		{"GET", http.MethodGet, "application/json", testUser, testPassword, http.StatusMethodNotAllowed},
+		{"no content type", http.MethodPost, "", testUser, testPassword, http.StatusUnsupportedMediaType},
+		{"form", http.MethodPost, "application/x-www-form-urlencoded", testUser, testPassword, http.StatusUnsupportedMediaType},
+		{"text", http.MethodPost, "text/plain", testUser, testPassword, http.StatusUnsupportedMediaType},
+		{"json with charset", http.MethodPost, "application/json; charset=utf-8", testUser, testPassword, http.StatusOK},
+	} {
+		recorder := serve(server, test.method, test.contentType, test.user, test.password)
+		if recorder.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.name, recorder.Code, test.status)
+		}
+	}
+
+	if recorder := serve(server, http.MethodPost, "application/json", "", ""); recorder.Header().Get("WWW-Authenticate") == "" {
+		t.Error("unauthorized response does not ask for credentials")
+	}
+}
+
+func TestServerNeedsCredentials(t *testing.T) {
+	server := newTestServer(t)
+	server.Config.Username, server.Config.Password = "", ""
+	server.Config.Address = "127.0.0.1:0"
+
+	if err := server.Start(); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("Start() without credentials = %v, want %v", err, ErrNoCredentials)
+	}
+}
+
+func TestClientCallsServer(t *testing.T) {
+	server := newTestServer(t)
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	var height int
+	if err := NewClient(httpServer.URL, testUser, testPassword).Call("getblockcount", nil, &height); err != nil {
+		t.Fatal(err)
+	}
+	if height != 0 {
+		t.Errorf("getblockcount = %d, want 0", height)
+	}
+
+	var rpcErr *Error
+	err := NewClient(httpServer.URL, testUser, testPassword).Call("nosuchmethod", nil, nil)
+	if !errors.As(err, &rpcErr) || rpcErr.Code != ErrCodeMethodNotFound {
+		t.Errorf("unknown method = %v, want code %d", err, ErrCodeMethodNotFound)
+	}
+	if err = NewClient(httpServer.URL, testUser, "wrong").Call("getblockcount", nil, &height); err == nil {
+		t.Error("call with the wrong password succeeded")
+	}
+}
+
+func TestCookie(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", CookieFile)
+	user, password, err := WriteCookie(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != CookieUser || len(password) != 64 {
+		t.Errorf("WriteCookie() = %q, %q", user, password)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("cookie file mode is %v, want it readable only by its owner", info.Mode())
+	}
+	readUser, readPassword, err := ReadCookie(path)
+	if err != nil || readUser != user || readPassword != password {
+		t.Errorf("ReadCookie() = %q, %q, %v, want what was written", readUser, readPassword, err)
+	}
+}
@@ -0,0 +1,359 @@
+// Package simnet runs networks of nodes inside one process, over an
+// in-memory transport with configurable latency, message loss and
+// partitions, with every chain kept in an in-memory store. Nodes only mine
+// when told to, and with Config.Manual messages are only delivered while
+// the harness waits for something, in the order they were sent, so
+// scenarios read as a sequence of steps:
+//
+//	harness, err := simnet.New(simnet.Config{Nodes: 4, Manual: true})
+//	if err != nil {
+//		return err
+//	}
+//	defer harness.Stop()
+//
+//	harness.Partition([]int{0, 1}, []int{2, 3})
+//	harness.Nodes[0].MineBlocks(10)
+//	harness.Nodes[2].MineBlocks(5)
+//	harness.Heal()
+//	if err := harness.WaitForConvergence(10 * time.Second); err != nil {
+//		return err
+//	}
+package simnet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	blockchain "gambim.com/blockchain/chain"
+	"gambim.com/blockchain/mempool"
+	"gambim.com/blockchain/miner"
+	"gambim.com/blockchain/network"
+	"gambim.com/blockchain/params"
+	"gambim.com/blockchain/storage"
+	"gambim.com/blockchain/wallet"
+)
+
+const (
+	DefaultRetryInterval = 200 * time.Millisecond
+	DefaultStallTimeout  = 2 * time.Second
+	port                 = 8433
+	pollInterval         = 10 * time.Millisecond
+)
+
+var ErrTimeout = errors.New("timed out waiting for the network")
+
+type Config struct {
+	Nodes int
+	// Params defaults to RegTest, whose difficulty keeps mining instant.
+	Params   *params.Params
+	Latency  time.Duration
+	LossRate float64
+	// Seed makes message loss repeatable.
+	Seed int64
+	// Manual leaves the network's clock to the test: messages are only
+	// delivered by Network.Step and Network.Advance, or by the Wait
+	// methods, which step the network until their condition holds.
+	// Otherwise the clock runs in real time.
+	Manual bool
+	// RetryInterval is how soon dropped connections are redialled.
+	RetryInterval time.Duration
+	// StallTimeout is how soon nodes give up on a peer that does not answer,
+	// which is how they recover from lost messages.
+	StallTimeout time.Duration
+	// Logger receives the logs of every node, prefixed with its name.
+	// They are discarded if it is nil.
+	Logger *log.Logger
+}
+
+type Harness struct {
+	Config  Config
+	Network *Network
+	Nodes   []*Node
+	Genesis *blockchain.Block
+}
+
+// Node is one simulated node with a wallet that receives its mining
+// rewards.
+type Node struct {
+	Name          string
+	Address       string
+	Wallet        *wallet.Wallet
+	RewardAddress string
+	UTXOSet       *blockchain.UTXOSet
+	Mempool       *mempool.Mempool
+	Server        *network.Node
+	Miner         *miner.Miner
+}
+
+// New starts Config.Nodes nodes sharing a genesis block, each connecting
+// to every node started before it.
+func New(config Config) (*Harness, error) {
+	if config.Params == nil {
+		config.Params = &params.RegTest
+	}
+	if config.RetryInterval == 0 {
+		config.RetryInterval = DefaultRetryInterval
+	}
+	if config.StallTimeout == 0 {
+		config.StallTimeout = DefaultStallTimeout
+	}
+	if config.Logger == nil {
+		config.Logger = log.New(io.Discard, "", 0)
+	}
+
+	harness := &Harness{Config: config, Network: NewNetwork(config.Latency, config.LossRate, config.Seed)}
+	if !config.Manual {
+		harness.Network.Start()
+	}
+
+	var addresses []string
+	for i := 0; i < config.Nodes; i++ {
+		node, err := harness.newNode(fmt.Sprintf("node%d", i), addresses)
+		if err != nil {
+			harness.Stop()
+			return nil, err
+		}
+		harness.Nodes = append(harness.Nodes, node)
+		addresses = append(addresses, node.Address)
+	}
+
+	return harness, nil
+}
+
+func (harness *Harness) newNode(name string, peers []string) (*Node, error) {
+	chainParams := harness.Config.Params
+	nodeWallet, err := wallet.MakeWallet()
+	if err != nil {
+		return nil, err
+	}
+	rewardAddress := string(wallet.EncodeAddress(wallet.PublicKeyHash(nodeWallet.PublicKey), chainParams.AddressVersion))
+
+	store := storage.NewMemory()
+	var chain *blockchain.Blockchain
+	if harness.Genesis == nil {
+		chain, err = blockchain.CreateBlockchain(store, chainParams, rewardAddress)
+		if err == nil {
+			genesis, genesisErr := chain.GetBlock(chain.LastHash)
+			harness.Genesis, err = &genesis, genesisErr
+		}
+	} else {
+		chain, err = blockchain.CreateBlockchainWithGenesis(store, chainParams, harness.Genesis)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	utxoSet := blockchain.NewUTXOSet(chain)
+	pool := mempool.New(utxoSet, mempool.DefaultConfig)
+	utxoSet.Exclude = pool.IsSpent
+
+	address := fmt.Sprintf("%s:%d", name, port)
+	logger := harness.Config.Logger
+	server := network.New(utxoSet, pool, network.Config{
+		Params:        chainParams,
+		ListenAddress: address,
+		Peers:         peers,
+		Transport:     harness.Network.Transport(name),
+		RetryInterval: harness.Config.RetryInterval,
+		StallTimeout:  harness.Config.StallTimeout,
+		Lock:          &sync.Mutex{},
+		Logger:        log.New(logger.Writer(), name+" "+logger.Prefix(), logger.Flags()),
+	})
+	if err = server.Start(); err != nil {
+		chain.Database.Close()
+		return nil, err
+	}
+
+	return &Node{
+		Name:          name,
+		Address:       address,
+		Wallet:        nodeWallet,
+		RewardAddress: rewardAddress,
+		UTXOSet:       utxoSet,
+		Mempool:       pool,
+		Server:        server,
+		Miner:         miner.New(utxoSet, pool, miner.Config{RewardAddress: rewardAddress, Workers: 1}),
+	}, nil
+}
+
+func (harness *Harness) Stop() {
+	for _, node := range harness.Nodes {
+		node.Server.Stop()
+		node.UTXOSet.Chain.Database.Close()
+	}
+	harness.Network.Stop()
+}
+
+// Partition splits the nodes into groups by index; nodes left out of
+// every group are isolated.
+func (harness *Harness) Partition(groups ...[]int) {
+	var hosts [][]string
+	for _, group := range groups {
+		var names []string
+		for _, index := range group {
+			names = append(names, harness.Nodes[index].Name)
+		}
+		hosts = append(hosts, names)
+	}
+
+	harness.Network.Partition(hosts...)
+}
+
+func (harness *Harness) Heal() {
+	harness.Network.Heal()
+}
+
+// WaitFor polls condition until it holds or timeout passes, stepping the
+// network in between if it is manual. The nodes' own timers, such as for
+// redialling, still run in real time, as does timeout.
+func (harness *Harness) WaitFor(timeout time.Duration, condition func() bool) error {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return ErrTimeout
+		}
+		if !harness.Config.Manual || !harness.Network.Step() {
+			time.Sleep(pollInterval)
+		}
+	}
+
+	return nil
+}
+
+// Converged reports whether every node has the same tip.
+func (harness *Harness) Converged() bool {
+	var tip []byte
+	for i, node := range harness.Nodes {
+		nodeTip, _, err := node.Tip()
+		if err != nil {
+			return false
+		}
+		if i > 0 && !bytes.Equal(nodeTip, tip) {
+			return false
+		}
+		tip = nodeTip
+	}
+
+	return true
+}
+
+func (harness *Harness) WaitForConvergence(timeout time.Duration) error {
+	if err := harness.WaitFor(timeout, harness.Converged); err != nil {
+		return fmt.Errorf("%w: tips are %s", err, harness.tips())
+	}
+
+	return nil
+}
+
+// WaitForConnections waits until every node completed the handshake with
+// at least count peers.
+func (harness *Harness) WaitForConnections(timeout time.Duration, count int) error {
+	return harness.WaitFor(timeout, func() bool {
+		for _, node := range harness.Nodes {
+			if node.Server.ConnectedCount() < count {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func (harness *Harness) WaitForHeight(timeout time.Duration, height int) error {
+	return harness.WaitFor(timeout, func() bool {
+		for _, node := range harness.Nodes {
+			if _, nodeHeight, err := node.Tip(); err != nil || nodeHeight < height {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func (harness *Harness) tips() string {
+	var tips bytes.Buffer
+	for i, node := range harness.Nodes {
+		if i > 0 {
+			tips.WriteString(", ")
+		}
+		tip, height, err := node.Tip()
+		if err != nil {
+			fmt.Fprintf(&tips, "%s: %v", node.Name, err)
+			continue
+		}
+		fmt.Fprintf(&tips, "%s: %d %x", node.Name, height, tip)
+	}
+
+	return tips.String()
+}
+
+// Tip returns the hash and height of the node's best block.
+func (node *Node) Tip() ([]byte, int, error) {
+	lock := node.Server.Config.Lock
+	lock.Lock()
+	defer lock.Unlock()
+
+	chain := node.UTXOSet.Chain
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return append([]byte{}, chain.LastHash...), height, nil
+}
+
+// MineBlocks mines count blocks on the node's tip with the transactions
+// in its mempool and announces them.
+func (node *Node) MineBlocks(count int) ([]*blockchain.Block, error) {
+	lock := node.Server.Config.Lock
+
+	var blocks []*blockchain.Block
+	for i := 0; i < count; i++ {
+		lock.Lock()
+		template, err := node.Miner.NewBlockTemplate()
+		lock.Unlock()
+		if err != nil {
+			return blocks, err
+		}
+
+		block := template.Block
+		if err = node.Miner.Solve(context.Background(), block); err != nil {
+			return blocks, err
+		}
+		if err = node.Server.SubmitBlock(block); err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, block)
+	}
+
+	return blocks, nil
+}
+
+// Send pays amount to the reward address of another node and relays the
+// transaction.
+func (node *Node) Send(to *Node, amount int, fee int) (*blockchain.Transaction, error) {
+	lock := node.Server.Config.Lock
+	lock.Lock()
+	transaction, err := blockchain.NewTransaction(node.Wallet, to.RewardAddress, amount, fee, node.UTXOSet)
+	if err == nil {
+		err = node.Mempool.Add(transaction)
+	}
+	lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	node.Server.BroadcastTransaction(transaction)
+
+	return transaction, nil
+}
+
+// HasTransaction reports whether a transaction is in the node's mempool.
+func (node *Node) HasTransaction(transactionId []byte) bool {
+	_, found := node.Mempool.Get(transactionId)
+	return found
+}
@@ -0,0 +1,103 @@
+package simnet
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+const waitTimeout = 30 * time.Second
+
+func heights(harness *Harness) []int {
+	var heights []int
+	for _, node := range harness.Nodes {
+		_, height, _ := node.Tip()
+		heights = append(heights, height)
+	}
+
+	return heights
+}
+
+func TestPartitionThenHealConverges(t *testing.T) {
+	harness, err := New(Config{Nodes: 4, Manual: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer harness.Stop()
+
+	if err = harness.WaitForConnections(waitTimeout, 3); err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+	if _, err = harness.Nodes[0].MineBlocks(3); err != nil {
+		t.Fatal(err)
+	}
+	if err = harness.WaitForConvergence(waitTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	harness.Partition([]int{0, 1}, []int{2, 3})
+	longer, err := harness.Nodes[0].MineBlocks(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = harness.Nodes[2].MineBlocks(5); err != nil {
+		t.Fatal(err)
+	}
+	err = harness.WaitFor(waitTimeout, func() bool {
+		current := heights(harness)
+		return current[0] == 13 && current[1] == 13 && current[2] == 8 && current[3] == 8
+	})
+	if err != nil {
+		t.Fatalf("partitioned heights are %v, want [13 13 8 8]", heights(harness))
+	}
+
+	harness.Heal()
+	if err = harness.WaitForConvergence(waitTimeout); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range harness.Nodes {
+		tip, height, err := node.Tip()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if height != 13 || !bytes.Equal(tip, longer[len(longer)-1].Hash) {
+			t.Errorf("%s is at %d %x, want the longer branch", node.Name, height, tip)
+		}
+	}
+}
+
+func TestManualNetworkOnlyDeliversWhenStepped(t *testing.T) {
+	harness, err := New(Config{Nodes: 2, Manual: true, Latency: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer harness.Stop()
+
+	// A node dials the other and sends its version, which waits in the
+	// queue until the clock moves.
+	deadline := time.Now().Add(waitTimeout)
+	for harness.Network.Pending() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no version was sent")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if now := harness.Network.Now(); now != 0 {
+		t.Fatalf("network clock moved to %v without being stepped", now)
+	}
+
+	pending := harness.Network.Pending()
+	harness.Network.Advance(500 * time.Millisecond)
+	if left := harness.Network.Pending(); left < pending {
+		t.Fatalf("%d of %d packets delivered before the latency passed", pending-left, pending)
+	}
+	if count := harness.Nodes[1].Server.ConnectedCount(); count != 0 {
+		t.Fatalf("%d peers connected before the latency passed", count)
+	}
+	if err = harness.WaitForConnections(waitTimeout, 1); err != nil {
+		t.Fatal(err)
+	}
+	if now := harness.Network.Now(); now < 2*time.Second {
+		t.Errorf("handshake done after %v on the network's clock, want at least 2s", now)
+	}
+}
@@ -0,0 +1,614 @@
+package simnet
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"gambim.com/blockchain/network"
+)
+
+const (
+	queueSize = 1024
+	// Step waits until the nodes have been quiet for quietPeriod, or
+	// settleTimeout at most, so their replies are queued before the next
+	// step.
+	quietPeriod   = 5 * time.Millisecond
+	settleTimeout = time.Second
+)
+
+var (
+	ErrUnreachable = errors.New("address is unreachable")
+	ErrAddressUsed = errors.New("address is already in use")
+)
+
+// Network connects the transports of simulated nodes in memory. Every
+// write on a connection is a packet, delivered whole after Latency on the
+// network's clock or dropped with probability LossRate, so with the
+// network package's one write per message a lost write is a lost message
+// rather than a corrupt stream.
+//
+// The clock only moves when Step or Advance is called, so the test decides
+// when packets arrive and they arrive in the order they were sent. Start
+// runs the clock in real time instead.
+type Network struct {
+	Latency  time.Duration
+	LossRate float64
+
+	mutex     sync.Mutex
+	random    *rand.Rand
+	listeners map[string]*listener
+	conns     map[*conn]bool
+	groups    map[string]int
+	nextPort  int
+
+	now          time.Duration
+	started      time.Time
+	sequence     uint64
+	queue        packetQueue
+	lastActivity time.Time
+	wake         chan struct{}
+	stop         chan struct{}
+	stopped      chan struct{}
+}
+
+func NewNetwork(latency time.Duration, lossRate float64, seed int64) *Network {
+	return &Network{
+		Latency:   latency,
+		LossRate:  lossRate,
+		random:    rand.New(rand.NewSource(seed)),
+		listeners: make(map[string]*listener),
+		conns:     make(map[*conn]bool),
+		nextPort:  40000,
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// Now is the time on the network's clock since it was created.
+func (simNetwork *Network) Now() time.Duration {
+	simNetwork.mutex.Lock()
+	defer simNetwork.mutex.Unlock()
+
+	return simNetwork.clock()
+}
+
+// Pending counts the packets sent but not delivered yet.
+func (simNetwork *Network) Pending() int {
+	simNetwork.mutex.Lock()
+	defer simNetwork.mutex.Unlock()
+
+	return len(simNetwork.queue)
+}
+
+func (simNetwork *Network) clock() time.Duration {
+	if simNetwork.stop != nil {
+		return time.Since(simNetwork.started)
+	}
+
+	return simNetwork.now
+}
+
+// Start runs the clock in real time, delivering packets as they fall due,
+// until Stop.
+func (simNetwork *Network) Start() {
+	simNetwork.mutex.Lock()
+	defer simNetwork.mutex.Unlock()
+
+	if simNetwork.stop != nil {
+		return
+	}
+	simNetwork.started = time.Now().Add(-simNetwork.now)
+	simNetwork.stop = make(chan struct{})
+	simNetwork.stopped = make(chan struct{})
+	go simNetwork.run(simNetwork.stop, simNetwork.stopped)
+}
+
+// Stop stops the clock, leaving it to Step and Advance again.
+func (simNetwork *Network) Stop() {
+	simNetwork.mutex.Lock()
+	stop, stopped := simNetwork.stop, simNetwork.stopped
+	simNetwork.mutex.Unlock()
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	<-stopped
+
+	simNetwork.mutex.Lock()
+	simNetwork.now = time.Since(simNetwork.started)
+	simNetwork.stop = nil
+	simNetwork.mutex.Unlock()
+}
+
+func (simNetwork *Network) run(stop chan struct{}, stopped chan struct{}) {
+	defer close(stopped)
+
+	for {
+		simNetwork.mutex.Lock()
+		wait := time.Hour
+		if len(simNetwork.queue) > 0 {
+			wait = simNetwork.queue[0].deliverAt - simNetwork.clock()
+		}
+		simNetwork.mutex.Unlock()
+
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-simNetwork.wake:
+			case <-stop:
+				timer.Stop()
+				return
+			}
+			timer.Stop()
+		}
+
+		simNetwork.mutex.Lock()
+		simNetwork.deliver(simNetwork.clock())
+		simNetwork.mutex.Unlock()
+	}
+}
+
+// Step moves the clock to when the next packets fall due, delivers them and
+// waits for the nodes to handle them. It reports false if nothing was
+// queued.
+func (simNetwork *Network) Step() bool {
+	return simNetwork.step(-1)
+}
+
+// Advance steps through the packets falling due in the next d, including
+// those sent in reply along the way, and then moves the clock to its end.
+func (simNetwork *Network) Advance(d time.Duration) {
+	simNetwork.mutex.Lock()
+	end := simNetwork.clock() + d
+	simNetwork.mutex.Unlock()
+
+	for simNetwork.step(end) {
+	}
+
+	simNetwork.mutex.Lock()
+	if simNetwork.stop == nil && simNetwork.now < end {
+		simNetwork.now = end
+	}
+	simNetwork.mutex.Unlock()
+}
+
+// step delivers the packets due first if they are due by end, or at all if
+// end is negative.
+func (simNetwork *Network) step(end time.Duration) bool {
+	simNetwork.mutex.Lock()
+	if simNetwork.stop != nil || len(simNetwork.queue) == 0 {
+		simNetwork.mutex.Unlock()
+		return false
+	}
+	due := simNetwork.queue[0].deliverAt
+	if end >= 0 && due > end {
+		simNetwork.mutex.Unlock()
+		return false
+	}
+	if due > simNetwork.now {
+		simNetwork.now = due
+	}
+	simNetwork.deliver(due)
+	simNetwork.mutex.Unlock()
+
+	simNetwork.settle()
+	return true
+}
+
+// deliver hands the packets due by now to their connections, in the order
+// they were sent.
+func (simNetwork *Network) deliver(now time.Duration) {
+	for len(simNetwork.queue) > 0 && simNetwork.queue[0].deliverAt <= now {
+		packet := heap.Pop(&simNetwork.queue).(*packet)
+		if simNetwork.conns[packet.from] && simNetwork.conns[packet.from.peer] {
+			packet.from.peer.receive(packet.data)
+		}
+	}
+}
+
+// settle waits until every delivered packet was read and the nodes stopped
+// writing.
+func (simNetwork *Network) settle() {
+	deadline := time.Now().Add(settleTimeout)
+	for time.Now().Before(deadline) {
+		simNetwork.mutex.Lock()
+		quiet := time.Since(simNetwork.lastActivity) >= quietPeriod
+		for c := range simNetwork.conns {
+			if quiet && !c.drained() {
+				quiet = false
+			}
+		}
+		simNetwork.mutex.Unlock()
+		if quiet {
+			return
+		}
+		time.Sleep(quietPeriod / 5)
+	}
+}
+
+func (simNetwork *Network) send(from *conn, data []byte) {
+	simNetwork.mutex.Lock()
+	simNetwork.lastActivity = time.Now()
+	if simNetwork.LossRate > 0 && simNetwork.random.Float64() < simNetwork.LossRate {
+		simNetwork.mutex.Unlock()
+		return
+	}
+	simNetwork.sequence++
+	heap.Push(&simNetwork.queue, &packet{
+		from:      from,
+		data:      append([]byte{}, data...),
+		deliverAt: simNetwork.clock() + simNetwork.Latency,
+		sequence:  simNetwork.sequence,
+	})
+	simNetwork.mutex.Unlock()
+
+	select {
+	case simNetwork.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (simNetwork *Network) touch() {
+	simNetwork.mutex.Lock()
+	simNetwork.lastActivity = time.Now()
+	simNetwork.mutex.Unlock()
+}
+
+// Transport returns the transport of the node named host. Its outbound
+// connections come from host, so partitions apply to them.
+func (simNetwork *Network) Transport(host string) network.Transport {
+	return &transport{network: simNetwork, host: host}
+}
+
+// Partition splits the network into groups of hosts that can only reach
+// each other. Connections between groups are closed and new ones refused
+// until Heal. Hosts in no group are cut off from every other host.
+func (simNetwork *Network) Partition(groups ...[]string) {
+	simNetwork.mutex.Lock()
+	simNetwork.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, host := range group {
+			simNetwork.groups[host] = i + 1
+		}
+	}
+
+	var cut []*conn
+	for c := range simNetwork.conns {
+		if !simNetwork.reachable(c.local.host(), c.remote.host()) {
+			cut = append(cut, c)
+		}
+	}
+	simNetwork.mutex.Unlock()
+
+	for _, c := range cut {
+		c.Close()
+	}
+}
+
+// Heal removes the partition. Nodes reconnect on their own.
+func (simNetwork *Network) Heal() {
+	simNetwork.mutex.Lock()
+	defer simNetwork.mutex.Unlock()
+
+	simNetwork.groups = nil
+}
+
+func (simNetwork *Network) reachable(from string, to string) bool {
+	if simNetwork.groups == nil || from == to {
+		return true
+	}
+	group := simNetwork.groups[from]
+
+	return group != 0 && group == simNetwork.groups[to]
+}
+
+type address string
+
+func (addr address) Network() string {
+	return "simnet"
+}
+
+func (addr address) String() string {
+	return string(addr)
+}
+
+func (addr address) host() string {
+	host, _, err := net.SplitHostPort(string(addr))
+	if err != nil {
+		return string(addr)
+	}
+
+	return host
+}
+
+type transport struct {
+	network *Network
+	host    string
+}
+
+func (transport *transport) Listen(addr string) (net.Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		host = transport.host
+	}
+	addr = net.JoinHostPort(host, port)
+
+	simNetwork := transport.network
+	simNetwork.mutex.Lock()
+	defer simNetwork.mutex.Unlock()
+
+	if _, found := simNetwork.listeners[addr]; found {
+		return nil, fmt.Errorf("%s: %w", addr, ErrAddressUsed)
+	}
+	listener := &listener{
+		network: simNetwork,
+		addr:    address(addr),
+		accept:  make(chan net.Conn, queueSize),
+		closed:  make(chan struct{}),
+	}
+	simNetwork.listeners[addr] = listener
+
+	return listener, nil
+}
+
+func (transport *transport) Dial(addr string) (net.Conn, error) {
+	simNetwork := transport.network
+	simNetwork.mutex.Lock()
+	listener, found := simNetwork.listeners[addr]
+	if !found || !simNetwork.reachable(transport.host, address(addr).host()) {
+		simNetwork.mutex.Unlock()
+		return nil, fmt.Errorf("dial %s: %w", addr, ErrUnreachable)
+	}
+	simNetwork.nextPort++
+	local := address(net.JoinHostPort(transport.host, fmt.Sprint(simNetwork.nextPort)))
+	dialer, accepted := newConnPair(simNetwork, local, listener.addr)
+	simNetwork.conns[dialer] = true
+	simNetwork.conns[accepted] = true
+	simNetwork.mutex.Unlock()
+
+	select {
+	case listener.accept <- accepted:
+		return dialer, nil
+	case <-listener.closed:
+		dialer.Close()
+		return nil, fmt.Errorf("dial %s: %w", addr, ErrUnreachable)
+	}
+}
+
+type listener struct {
+	network   *Network
+	addr      address
+	accept    chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (listener *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.accept:
+		return conn, nil
+	case <-listener.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (listener *listener) Close() error {
+	listener.closeOnce.Do(func() {
+		close(listener.closed)
+
+		listener.network.mutex.Lock()
+		delete(listener.network.listeners, string(listener.addr))
+		listener.network.mutex.Unlock()
+	})
+
+	return nil
+}
+
+func (listener *listener) Addr() net.Addr {
+	return listener.addr
+}
+
+type packet struct {
+	from      *conn
+	data      []byte
+	deliverAt time.Duration
+	sequence  uint64
+}
+
+// packetQueue orders packets by when they fall due, then by when they were
+// sent.
+type packetQueue []*packet
+
+func (queue packetQueue) Len() int {
+	return len(queue)
+}
+
+func (queue packetQueue) Less(i int, j int) bool {
+	if queue[i].deliverAt != queue[j].deliverAt {
+		return queue[i].deliverAt < queue[j].deliverAt
+	}
+	return queue[i].sequence < queue[j].sequence
+}
+
+func (queue packetQueue) Swap(i int, j int) {
+	queue[i], queue[j] = queue[j], queue[i]
+}
+
+func (queue *packetQueue) Push(item interface{}) {
+	*queue = append(*queue, item.(*packet))
+}
+
+func (queue *packetQueue) Pop() interface{} {
+	old := *queue
+	item := old[len(old)-1]
+	*queue = old[:len(old)-1]
+
+	return item
+}
+
+// conn is one end of an in-memory connection. Writes go to the network's
+// queue, which hands them to the other end when they fall due. Once one
+// end is closed, the other reads io.EOF after what was delivered.
+type conn struct {
+	network *Network
+	local   address
+	remote  address
+	peer    *conn
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	readable  chan struct{}
+
+	mutex        sync.Mutex
+	incoming     [][]byte
+	pending      []byte
+	hungUp       bool
+	readDeadline time.Time
+}
+
+func newConnPair(simNetwork *Network, local address, remote address) (*conn, *conn) {
+	first := &conn{network: simNetwork, local: local, remote: remote}
+	second := &conn{network: simNetwork, local: remote, remote: local}
+	for _, c := range []*conn{first, second} {
+		c.closed = make(chan struct{})
+		c.readable = make(chan struct{}, 1)
+	}
+	first.peer = second
+	second.peer = first
+
+	return first, second
+}
+
+func (c *conn) receive(data []byte) {
+	c.mutex.Lock()
+	c.incoming = append(c.incoming, data)
+	c.mutex.Unlock()
+
+	c.signal()
+}
+
+func (c *conn) hangUp() {
+	c.mutex.Lock()
+	c.hungUp = true
+	c.mutex.Unlock()
+
+	c.signal()
+}
+
+func (c *conn) signal() {
+	select {
+	case c.readable <- struct{}{}:
+	default:
+	}
+}
+
+// drained reports whether everything delivered to c was read.
+func (c *conn) drained() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return len(c.incoming) == 0 && len(c.pending) == 0
+}
+
+func (c *conn) Read(buffer []byte) (int, error) {
+	for {
+		c.mutex.Lock()
+		if len(c.pending) == 0 && len(c.incoming) > 0 {
+			c.pending, c.incoming = c.incoming[0], c.incoming[1:]
+		}
+		if len(c.pending) > 0 {
+			n := copy(buffer, c.pending)
+			c.pending = c.pending[n:]
+			c.mutex.Unlock()
+			c.network.touch()
+			return n, nil
+		}
+		hungUp, deadline := c.hungUp, c.readDeadline
+		c.mutex.Unlock()
+		if hungUp {
+			return 0, io.EOF
+		}
+
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+
+		var err error
+		select {
+		case <-c.readable:
+		case <-c.closed:
+			err = net.ErrClosed
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *conn) Write(data []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	c.network.send(c, data)
+	return len(data), nil
+}
+
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.peer.hangUp()
+
+		c.network.mutex.Lock()
+		delete(c.network.conns, c)
+		c.network.mutex.Unlock()
+	})
+
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *conn) SetDeadline(deadline time.Time) error {
+	return c.SetReadDeadline(deadline)
+}
+
+func (c *conn) SetReadDeadline(deadline time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.readDeadline = deadline
+	return nil
+}
+
+// SetWriteDeadline is a no-op: writes never block.
+func (c *conn) SetWriteDeadline(deadline time.Time) error {
+	return nil
+}
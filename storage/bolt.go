@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// openTimeout bounds how long OpenBolt waits for the file lock held by a
+// running node.
+const openTimeout = time.Second
+
+type BoltStore struct {
+	DB *bbolt.DB
+}
+
+func OpenBolt(path string) (*BoltStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: openTimeout})
+	if errors.Is(err, bbolt.ErrTimeout) {
+		return nil, ErrLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &BoltStore{DB: db}, nil
+}
+
+func (store *BoltStore) View(fn func(tx Tx) error) error {
+	return store.DB.View(func(tx *bbolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (store *BoltStore) Update(fn func(tx Tx) error) error {
+	return store.DB.Update(func(tx *bbolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (store *BoltStore) Close() error {
+	return store.DB.Close()
+}
+
+type boltTx struct {
+	tx *bbolt.Tx
+}
+
+func boltError(err error) error {
+	switch {
+	case errors.Is(err, bbolt.ErrBucketNotFound):
+		return ErrBucketNotFound
+	case errors.Is(err, bbolt.ErrBucketExists):
+		return ErrBucketExists
+	case errors.Is(err, bbolt.ErrTxNotWritable):
+		return ErrTxNotWritable
+	}
+	return err
+}
+
+func (tx *boltTx) Bucket(name []byte) Bucket {
+	bucket := tx.tx.Bucket(name)
+	if bucket == nil {
+		return nil
+	}
+	return &boltBucket{bucket: bucket}
+}
+
+func (tx *boltTx) CreateBucket(name []byte) (Bucket, error) {
+	bucket, err := tx.tx.CreateBucket(name)
+	if err != nil {
+		return nil, boltError(err)
+	}
+	return &boltBucket{bucket: bucket}, nil
+}
+
+func (tx *boltTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	bucket, err := tx.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, boltError(err)
+	}
+	return &boltBucket{bucket: bucket}, nil
+}
+
+func (tx *boltTx) DeleteBucket(name []byte) error {
+	return boltError(tx.tx.DeleteBucket(name))
+}
+
+type boltBucket struct {
+	bucket *bbolt.Bucket
+}
+
+func (bucket *boltBucket) Get(key []byte) []byte {
+	return bucket.bucket.Get(key)
+}
+
+func (bucket *boltBucket) Put(key []byte, value []byte) error {
+	return boltError(bucket.bucket.Put(key, value))
+}
+
+func (bucket *boltBucket) Delete(key []byte) error {
+	return boltError(bucket.bucket.Delete(key))
+}
+
+func (bucket *boltBucket) ForEach(fn func(key []byte, value []byte) error) error {
+	return bucket.bucket.ForEach(fn)
+}
+
+func (bucket *boltBucket) Cursor() Cursor {
+	return bucket.bucket.Cursor()
+}
@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// MemoryStore keeps every bucket in maps. Writers hold an exclusive lock and
+// record how to undo each change, so a failed Update leaves no trace.
+type MemoryStore struct {
+	mutex   sync.RWMutex
+	buckets map[string]*memoryBucket
+	closed  bool
+}
+
+func NewMemory() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*memoryBucket)}
+}
+
+func (store *MemoryStore) View(fn func(tx Tx) error) error {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	if store.closed {
+		return ErrClosed
+	}
+	return fn(&memoryTx{store: store})
+}
+
+func (store *MemoryStore) Update(fn func(tx Tx) error) (err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.closed {
+		return ErrClosed
+	}
+	tx := &memoryTx{store: store, writable: true}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			tx.rollback()
+			panic(recovered)
+		}
+		if err != nil {
+			tx.rollback()
+		}
+	}()
+
+	return fn(tx)
+}
+
+func (store *MemoryStore) Close() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.closed = true
+	return nil
+}
+
+type memoryTx struct {
+	store    *MemoryStore
+	writable bool
+	undo     []func()
+}
+
+func (tx *memoryTx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+}
+
+func (tx *memoryTx) Bucket(name []byte) Bucket {
+	bucket, ok := tx.store.buckets[string(name)]
+	if !ok {
+		return nil
+	}
+	return &memoryBucketTx{tx: tx, bucket: bucket}
+}
+
+func (tx *memoryTx) CreateBucket(name []byte) (Bucket, error) {
+	if !tx.writable {
+		return nil, ErrTxNotWritable
+	}
+	if _, ok := tx.store.buckets[string(name)]; ok {
+		return nil, ErrBucketExists
+	}
+
+	bucket := &memoryBucket{items: make(map[string][]byte)}
+	tx.store.buckets[string(name)] = bucket
+	tx.undo = append(tx.undo, func() {
+		delete(tx.store.buckets, string(name))
+	})
+
+	return &memoryBucketTx{tx: tx, bucket: bucket}, nil
+}
+
+func (tx *memoryTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	if bucket := tx.Bucket(name); bucket != nil {
+		return bucket, nil
+	}
+	return tx.CreateBucket(name)
+}
+
+func (tx *memoryTx) DeleteBucket(name []byte) error {
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	bucket, ok := tx.store.buckets[string(name)]
+	if !ok {
+		return ErrBucketNotFound
+	}
+
+	delete(tx.store.buckets, string(name))
+	tx.undo = append(tx.undo, func() {
+		tx.store.buckets[string(name)] = bucket
+	})
+
+	return nil
+}
+
+type memoryBucket struct {
+	items map[string][]byte
+}
+
+func (bucket *memoryBucket) keys() []string {
+	keys := make([]string, 0, len(bucket.items))
+	for key := range bucket.items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+type memoryBucketTx struct {
+	tx     *memoryTx
+	bucket *memoryBucket
+}
+
+func (bucket *memoryBucketTx) Get(key []byte) []byte {
+	return bucket.bucket.items[string(key)]
+}
+
+func (bucket *memoryBucketTx) Put(key []byte, value []byte) error {
+	if !bucket.tx.writable {
+		return ErrTxNotWritable
+	}
+
+	items := bucket.bucket.items
+	k := string(key)
+	previous, existed := items[k]
+	items[k] = append([]byte{}, value...)
+	bucket.tx.undo = append(bucket.tx.undo, func() {
+		if existed {
+			items[k] = previous
+		} else {
+			delete(items, k)
+		}
+	})
+
+	return nil
+}
+
+func (bucket *memoryBucketTx) Delete(key []byte) error {
+	if !bucket.tx.writable {
+		return ErrTxNotWritable
+	}
+
+	items := bucket.bucket.items
+	k := string(key)
+	previous, existed := items[k]
+	if !existed {
+		return nil
+	}
+	delete(items, k)
+	bucket.tx.undo = append(bucket.tx.undo, func() {
+		items[k] = previous
+	})
+
+	return nil
+}
+
+func (bucket *memoryBucketTx) ForEach(fn func(key []byte, value []byte) error) error {
+	for _, key := range bucket.bucket.keys() {
+		if err := fn([]byte(key), bucket.bucket.items[key]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (bucket *memoryBucketTx) Cursor() Cursor {
+	return &memoryCursor{bucket: bucket.bucket, keys: bucket.bucket.keys(), position: -1}
+}
+
+type memoryCursor struct {
+	bucket   *memoryBucket
+	keys     []string
+	position int
+}
+
+func (cursor *memoryCursor) current() ([]byte, []byte) {
+	for cursor.position < len(cursor.keys) {
+		key := cursor.keys[cursor.position]
+		if value, ok := cursor.bucket.items[key]; ok {
+			return []byte(key), value
+		}
+		cursor.position++
+	}
+	return nil, nil
+}
+
+func (cursor *memoryCursor) First() ([]byte, []byte) {
+	cursor.position = 0
+	return cursor.current()
+}
+
+func (cursor *memoryCursor) Seek(seek []byte) ([]byte, []byte) {
+	cursor.position = sort.Search(len(cursor.keys), func(i int) bool {
+		return bytes.Compare([]byte(cursor.keys[i]), seek) >= 0
+	})
+	return cursor.current()
+}
+
+func (cursor *memoryCursor) Next() ([]byte, []byte) {
+	cursor.position++
+	return cursor.current()
+}
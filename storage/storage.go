@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"errors"
+)
+
+var (
+	ErrBucketNotFound = errors.New("bucket not found")
+	ErrBucketExists   = errors.New("bucket already exists")
+	ErrTxNotWritable  = errors.New("tx not writable")
+	ErrClosed         = errors.New("store is closed")
+	ErrLocked         = errors.New("database is in use by another process")
+)
+
+// Store is a key/value database split into named buckets. Update runs its
+// function atomically: either every write is applied or none is.
+type Store interface {
+	View(fn func(tx Tx) error) error
+	Update(fn func(tx Tx) error) error
+	Close() error
+}
+
+type Tx interface {
+	// Bucket returns nil if the bucket does not exist.
+	Bucket(name []byte) Bucket
+	CreateBucket(name []byte) (Bucket, error)
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	DeleteBucket(name []byte) error
+}
+
+// Bucket values are only valid for the life of the transaction.
+type Bucket interface {
+	Get(key []byte) []byte
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+	ForEach(fn func(key []byte, value []byte) error) error
+	Cursor() Cursor
+}
+
+// Cursor walks a bucket in key order.
+type Cursor interface {
+	First() (key []byte, value []byte)
+	Seek(seek []byte) (key []byte, value []byte)
+	Next() (key []byte, value []byte)
+}
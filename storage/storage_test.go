@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+var errTest = errors.New("test error")
+
+// forEachStore runs test against a bolt file and a memory store, which
+// must behave the same.
+func forEachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	t.Run("bolt", func(t *testing.T) {
+		store, err := OpenBolt(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		test(t, store)
+	})
+	t.Run("memory", func(t *testing.T) {
+		store := NewMemory()
+		defer store.Close()
+		test(t, store)
+	})
+}
+
+func put(t *testing.T, store Store, bucket string, pairs ...string) {
+	t.Helper()
+
+	err := store.Update(func(tx Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(pairs); i += 2 {
+			if err := bucket.Put([]byte(pairs[i]), []byte(pairs[i+1])); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// get returns the value of key, or "<nil>" if it or the bucket is missing.
+func get(t *testing.T, store Store, bucket, key string) string {
+	t.Helper()
+
+	value := "<nil>"
+	err := store.View(func(tx Tx) error {
+		bucket := tx.Bucket([]byte(bucket))
+		if bucket == nil {
+			return nil
+		}
+		if found := bucket.Get([]byte(key)); found != nil {
+			value = string(found)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return value
+}
+
+func TestPutGetDelete(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		put(t, store, "items", "a", "1", "b", "2")
+		put(t, store, "items", "a", "3")
+		if value := get(t, store, "items", "a"); value != "3" {
+			t.Errorf("a = %s, want 3", value)
+		}
+		if value := get(t, store, "items", "b"); value != "2" {
+			t.Errorf("b = %s, want 2", value)
+		}
+
+		err := store.Update(func(tx Tx) error {
+			if err := tx.Bucket([]byte("items")).Delete([]byte("a")); err != nil {
+				return err
+			}
+			return tx.Bucket([]byte("items")).Delete([]byte("missing"))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value := get(t, store, "items", "a"); value != "<nil>" {
+			t.Errorf("deleted a = %s", value)
+		}
+
+		err = store.View(func(tx Tx) error {
+			return tx.Bucket([]byte("items")).Put([]byte("c"), []byte("4"))
+		})
+		if !errors.Is(err, ErrTxNotWritable) {
+			t.Errorf("Put in View = %v, want %v", err, ErrTxNotWritable)
+		}
+	})
+}
+
+func TestBuckets(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		put(t, store, "first", "key", "1")
+		put(t, store, "second", "key", "2")
+		if value := get(t, store, "first", "key"); value != "1" {
+			t.Errorf("first key = %s, want 1", value)
+		}
+		if value := get(t, store, "second", "key"); value != "2" {
+			t.Errorf("second key = %s, want 2", value)
+		}
+
+		err := store.Update(func(tx Tx) error {
+			if _, err := tx.CreateBucket([]byte("first")); !errors.Is(err, ErrBucketExists) {
+				t.Errorf("CreateBucket of an existing bucket = %v, want %v", err, ErrBucketExists)
+			}
+			if err := tx.DeleteBucket([]byte("missing")); !errors.Is(err, ErrBucketNotFound) {
+				t.Errorf("DeleteBucket of a missing bucket = %v, want %v", err, ErrBucketNotFound)
+			}
+			if tx.Bucket([]byte("missing")) != nil {
+				t.Error("Bucket of a missing bucket is not nil")
+			}
+			return tx.DeleteBucket([]byte("first"))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value := get(t, store, "first", "key"); value != "<nil>" {
+			t.Errorf("key of a deleted bucket = %s", value)
+		}
+		if value := get(t, store, "second", "key"); value != "2" {
+			t.Errorf("second key = %s after deleting first, want 2", value)
+		}
+
+		// A recreated bucket starts empty.
+		put(t, store, "first")
+		if value := get(t, store, "first", "key"); value != "<nil>" {
+			t.Errorf("key of a recreated bucket = %s", value)
+		}
+	})
+}
+
+func TestCursorOrder(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		put(t, store, "items", "b", "2", "\x00", "0", "ab", "1", "c", "3", "a", "1")
+
+		err := store.View(func(tx Tx) error {
+			cursor := tx.Bucket([]byte("items")).Cursor()
+			var keys []string
+			for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+				keys = append(keys, string(key))
+			}
+			if want := []string{"\x00", "a", "ab", "b", "c"}; !equal(keys, want) {
+				t.Errorf("cursor keys = %q, want %q", keys, want)
+			}
+
+			key, value := cursor.Seek([]byte("aa"))
+			if string(key) != "ab" || string(value) != "1" {
+				t.Errorf("Seek(aa) = %q %q, want ab 1", key, value)
+			}
+			if key, _ = cursor.Next(); string(key) != "b" {
+				t.Errorf("Next after Seek = %q, want b", key)
+			}
+			if key, _ = cursor.Seek([]byte("d")); key != nil {
+				t.Errorf("Seek past the end = %q, want nil", key)
+			}
+
+			var walked []string
+			err := tx.Bucket([]byte("items")).ForEach(func(key, value []byte) error {
+				walked = append(walked, string(key))
+				return nil
+			})
+			if !equal(walked, keys) {
+				t.Errorf("ForEach keys = %q, want %q", walked, keys)
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestFailedUpdateRollsBack(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		put(t, store, "items", "kept", "1", "deleted", "2")
+		put(t, store, "dropped", "key", "3")
+
+		err := store.Update(func(tx Tx) error {
+			items := tx.Bucket([]byte("items"))
+			if err := items.Put([]byte("kept"), []byte("changed")); err != nil {
+				return err
+			}
+			if err := items.Put([]byte("added"), []byte("4")); err != nil {
+				return err
+			}
+			if err := items.Delete([]byte("deleted")); err != nil {
+				return err
+			}
+			if err := tx.DeleteBucket([]byte("dropped")); err != nil {
+				return err
+			}
+			created, err := tx.CreateBucket([]byte("created"))
+			if err != nil {
+				return err
+			}
+			if err = created.Put([]byte("key"), []byte("5")); err != nil {
+				return err
+			}
+			return errTest
+		})
+		if !errors.Is(err, errTest) {
+			t.Fatalf("Update = %v, want %v", err, errTest)
+		}
+
+		for _, check := range []struct{ bucket, key, want string }{
+			{"items", "kept", "1"},
+			{"items", "deleted", "2"},
+			{"items", "added", "<nil>"},
+			{"dropped", "key", "3"},
+			{"created", "key", "<nil>"},
+		} {
+			if value := get(t, store, check.bucket, check.key); value != check.want {
+				t.Errorf("%s/%s = %s after a failed update, want %s", check.bucket, check.key, value, check.want)
+			}
+		}
+		err = store.View(func(tx Tx) error {
+			if tx.Bucket([]byte("created")) != nil {
+				t.Error("bucket created by a failed update exists")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -6,15 +6,19 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
 	"fmt"
-	"log"
 
 	"golang.org/x/crypto/ripemd160"
 )
 
 const (
 	checksumLength = 4
-	version        = byte(0x00)
+)
+
+var (
+	ErrInvalidAddress = errors.New("invalid address")
+	ErrWalletNotFound = errors.New("address is not in the wallet file")
 )
 
 type Wallet struct {
@@ -26,60 +30,74 @@ func GetChecksumLength() int {
 	return checksumLength
 }
 
-func (w *Wallet) Address() []byte {
-	publicHash := PublicKeyHash(w.PublicKey)
-
-	versionedHash := append([]byte{version}, publicHash...)
+func EncodeAddress(publicKeyHash []byte, version byte) []byte {
+	versionedHash := append([]byte{version}, publicKeyHash...)
 	checksum := CheckSum(versionedHash)
 
 	fullHash := append(versionedHash, checksum...)
-	address := Base58Encode(fullHash)
-
-	fmt.Printf("pub key: %x\n", w.PublicKey)
-	fmt.Printf("pub hash: %x\n", publicHash)
-	fmt.Printf("address: %s\n", address)
+	return Base58Encode(fullHash)
+}
 
-	return address
+func (w *Wallet) Address(version byte) []byte {
+	publicHash := PublicKeyHash(w.PublicKey)
+	return EncodeAddress(publicHash, version)
 }
 
-func NewKeyPair() (ecdsa.PrivateKey, []byte) {
+func NewKeyPair() (ecdsa.PrivateKey, []byte, error) {
 	curve := elliptic.P256()
 
 	private, err := ecdsa.GenerateKey(curve, rand.Reader)
 	if err != nil {
-		log.Panic(err)
+		return ecdsa.PrivateKey{}, nil, err
 	}
 
-	pub := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
-	return *private, pub
+	size := (curve.Params().BitSize + 7) / 8
+	pub := make([]byte, 2*size)
+	private.PublicKey.X.FillBytes(pub[:size])
+	private.PublicKey.Y.FillBytes(pub[size:])
+	return *private, pub, nil
 }
 
-func MakeWallet() *Wallet {
-	private, public := NewKeyPair()
+func MakeWallet() (*Wallet, error) {
+	private, public, err := NewKeyPair()
+	if err != nil {
+		return nil, err
+	}
 	wallet := Wallet{PrivateKey: private, PublicKey: public}
 
-	return &wallet
+	return &wallet, nil
 }
 
-func ValidateAddress(address string) bool {
-	publicKeyFullHash := Base58Decode([]byte(address))
+func DecodeAddress(address string, version byte) ([]byte, error) {
+	publicKeyFullHash, err := Base58Decode([]byte(address))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", address, err)
+	}
+	if len(publicKeyFullHash) <= 1+checksumLength || publicKeyFullHash[0] != version {
+		return nil, fmt.Errorf("%s: %w", address, ErrInvalidAddress)
+	}
 	actualChecksum := publicKeyFullHash[len(publicKeyFullHash)-checksumLength:]
-	version := publicKeyFullHash[0]
 	publicKeyHash := publicKeyFullHash[1 : len(publicKeyFullHash)-checksumLength]
 
 	targetChecksum := CheckSum(append([]byte{version}, publicKeyHash...))
+	if !bytes.Equal(actualChecksum, targetChecksum) {
+		return nil, fmt.Errorf("%s: %w", address, ErrInvalidAddress)
+	}
 
-	return bytes.Compare(actualChecksum, targetChecksum) == 0
+	return publicKeyHash, nil
+}
+
+func ValidateAddress(address string, version byte) bool {
+	_, err := DecodeAddress(address, version)
+
+	return err == nil
 }
 
 func PublicKeyHash(publicKey []byte) []byte {
 	publicHash := sha256.Sum256(publicKey)
 
 	hasher := ripemd160.New()
-	_, err := hasher.Write(publicHash[:])
-	if err != nil {
-		log.Panic(err)
-	}
+	hasher.Write(publicHash[:])
 
 	publicRipMD := hasher.Sum(nil)
 
@@ -4,19 +4,24 @@ import (
 	"bytes"
 	"crypto/elliptic"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
-	"log"
 	"os"
+	"path/filepath"
 )
 
-const walletFile = "./tmp/wallets.data"
+const walletFile = "wallets.data"
 
 type Wallets struct {
 	Wallets map[string]*Wallet
+
+	path    string
+	version byte
 }
 
-func (ws *Wallets) SaveFile() {
+func (ws *Wallets) SaveFile() error {
 	var content bytes.Buffer
 
 	gob.Register(elliptic.P256())
@@ -24,23 +29,24 @@ func (ws *Wallets) SaveFile() {
 	encoder := gob.NewEncoder(&content)
 	err := encoder.Encode(ws)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	err = ioutil.WriteFile(walletFile, content.Bytes(), 0644)
+	err = os.MkdirAll(filepath.Dir(ws.path), 0700)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
+	return ioutil.WriteFile(ws.path, content.Bytes(), 0644)
 }
 
 func (ws *Wallets) LoadFile() error {
-	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
+	if _, err := os.Stat(ws.path); err != nil {
 		return err
 	}
 
 	var wallets Wallets
 
-	fileContent, err := ioutil.ReadFile(walletFile)
+	fileContent, err := ioutil.ReadFile(ws.path)
 	if err != nil {
 		return err
 	}
@@ -57,22 +63,28 @@ func (ws *Wallets) LoadFile() error {
 	return nil
 }
 
-func CreateWallets() (*Wallets, error) {
-	wallets := Wallets{}
+func CreateWallets(dataDir string, version byte) (*Wallets, error) {
+	wallets := Wallets{path: filepath.Join(dataDir, walletFile), version: version}
 	wallets.Wallets = make(map[string]*Wallet)
 
 	err := wallets.LoadFile()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
 
-	return &wallets, err
+	return &wallets, nil
 }
 
-func (ws *Wallets) AddWallet() string {
-	wallet := MakeWallet()
-	address := fmt.Sprintf("%s", wallet.Address())
+func (ws *Wallets) AddWallet() (string, error) {
+	wallet, err := MakeWallet()
+	if err != nil {
+		return "", err
+	}
+	address := fmt.Sprintf("%s", wallet.Address(ws.version))
 
 	ws.Wallets[address] = wallet
 
-	return address
+	return address, nil
 }
 
 func (ws *Wallets) GetAllAddresses() []string {
@@ -85,6 +97,11 @@ func (ws *Wallets) GetAllAddresses() []string {
 	return addresses
 }
 
-func (ws *Wallets) GetWallet(address string) Wallet {
-	return *ws.Wallets[address]
+func (ws *Wallets) GetWallet(address string) (Wallet, error) {
+	wallet, ok := ws.Wallets[address]
+	if !ok {
+		return Wallet{}, fmt.Errorf("%s: %w", address, ErrWalletNotFound)
+	}
+
+	return *wallet, nil
 }